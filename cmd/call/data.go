@@ -0,0 +1,28 @@
+package call
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// Prefix marking the data flag as a path to read the request from
+	dataFilePrefix = "@"
+	// Path that reads the request from stdin
+	dataStdin = "-"
+)
+
+// Resolves the data flag into the raw request. The flag can either be the request itself,
+// @<path> to read the request from a file, or @- to read the request from stdin.
+func readData(data string, stdin io.Reader) ([]byte, error) {
+	if !strings.HasPrefix(data, dataFilePrefix) {
+		return []byte(data), nil
+	}
+
+	path := strings.TrimPrefix(data, dataFilePrefix)
+	if path == dataStdin {
+		return ioutil.ReadAll(stdin)
+	}
+	return ioutil.ReadFile(path)
+}
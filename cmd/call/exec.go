@@ -0,0 +1,85 @@
+package call
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/wearefair/gurl/pkg/options"
+)
+
+// Parses the --token-exec command, which is split into arguments like a shell would
+func execCredentials(command string) (*options.ExecCredentials, error) {
+	words, err := splitCommand(command)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid --token-exec command: %s", err)
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("--token-exec command is empty")
+	}
+	return &options.ExecCredentials{Command: words[0], Args: words[1:]}, nil
+}
+
+// Splits a command into words on whitespace, following the shell's quoting rules: single quotes
+// keep everything inside them, a backslash inside double quotes only escapes ", \, $ and `, and a
+// backslash outside of quotes escapes the next character. Variables aren't expanded.
+func splitCommand(command string) ([]string, error) {
+	var (
+		words []string
+		word  strings.Builder
+		// Whether a word has started, so quoted empty strings are kept as words
+		inWord bool
+		quote  rune
+		escape bool
+	)
+	for _, r := range command {
+		switch {
+		case escape:
+			escape = false
+			if quote == '"' && !strings.ContainsRune("\"\\$`", r) {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(r)
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escape = true
+			default:
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\':
+			escape = true
+			inWord = true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escape {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,44 @@
+package call
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wearefair/gurl/pkg/options"
+)
+
+func TestExecCredentials(t *testing.T) {
+	testCases := []struct {
+		Command  string
+		Expected *options.ExecCredentials
+		IsErr    bool
+	}{
+		{Command: "gcloud auth print-access-token", Expected: &options.ExecCredentials{Command: "gcloud", Args: []string{"auth", "print-access-token"}}},
+		{Command: "  token-helper  ", Expected: &options.ExecCredentials{Command: "token-helper", Args: []string{}}},
+		// Quoted arguments are kept together, without their quotes
+		{Command: `vault read -field="token" x`, Expected: &options.ExecCredentials{Command: "vault", Args: []string{"read", "-field=token", "x"}}},
+		{Command: `sh -c 'echo "$TOKEN"'`, Expected: &options.ExecCredentials{Command: "sh", Args: []string{"-c", `echo "$TOKEN"`}}},
+		{Command: `print "a \"b\" \c" '' d\ e`, Expected: &options.ExecCredentials{Command: "print", Args: []string{`a "b" \c`, "", "d e"}}},
+		// Blank commands have nothing to run
+		{Command: "", IsErr: true},
+		{Command: " ", IsErr: true},
+		{Command: `vault read -field="token`, IsErr: true},
+		{Command: `vault read \`, IsErr: true},
+	}
+	for _, testCase := range testCases {
+		exec, err := execCredentials(testCase.Command)
+		if testCase.IsErr {
+			if err == nil {
+				t.Errorf("Command: %q, expected an error, got: %#v", testCase.Command, exec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Command: %q, unexpected error: %s", testCase.Command, err)
+			continue
+		}
+		if !reflect.DeepEqual(exec, testCase.Expected) {
+			t.Errorf("Command: %q, expected: %#v, got: %#v", testCase.Command, testCase.Expected, exec)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package call
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/wearefair/gurl/pkg/jsonpb"
+	"google.golang.org/grpc"
+)
+
+// Response, or error, of one pod called with --all-pods
+type podResult struct {
+	pod      string
+	response string
+	err      error
+}
+
+// Sends the message to every pod concurrently and prints the results grouped by pod name,
+// followed by a summary of the pods that failed or responded differently from the rest.
+// Returns an error if any of the pods failed.
+func callAllPods(client *jsonpb.Client, method *desc.MethodDescriptor, message proto.Message, podAddresses map[string]string, dialOptions []grpc.DialOption) error {
+	results := make([]podResult, 0, len(podAddresses))
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for pod, address := range podAddresses {
+		wg.Add(1)
+		go func(pod, address string) {
+			defer wg.Done()
+			result := callPod(client, method, message, address, dialOptions)
+			result.pod = pod
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}(pod, address)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].pod < results[j].pod })
+
+	for _, result := range results {
+		if result.err != nil {
+			fmt.Printf("Pod %s:\nError: %s\n\n", result.pod, result.err)
+			continue
+		}
+		fmt.Printf("Pod %s:\nResponse:\n%s\n\n", result.pod, result.response)
+	}
+
+	summary, failed := summarizePods(results)
+	fmt.Printf("Summary:\n%s\n", strings.Join(summary, "\n"))
+	if failed > 0 {
+		return fmt.Errorf("%d of %d pods returned errors", failed, len(results))
+	}
+	return nil
+}
+
+// Calls one pod over its own connection
+func callPod(client *jsonpb.Client, method *desc.MethodDescriptor, message proto.Message, address string, dialOptions []grpc.DialOption) podResult {
+	dialCtx, cancelDial := callOptions.DialContext(context.Background())
+	defer cancelDial()
+	podClient, err := client.Dial(dialCtx, address, dialOptions...)
+	if err != nil {
+		return podResult{err: err}
+	}
+	defer podClient.Close()
+
+	callCtx, cancelCall := callOptions.CallContext(context.Background())
+	defer cancelCall()
+	response, err := podClient.Invoke(callCtx, method, message)
+	if err != nil {
+		return podResult{err: timeoutError(err, callOptions.MaxTime)}
+	}
+	var prettyResponse bytes.Buffer
+	if err := json.Indent(&prettyResponse, response, "", "  "); err != nil {
+		return podResult{err: err}
+	}
+	return podResult{response: prettyResponse.String()}
+}
+
+// Returns a line per group of pods that responded the same, with the most common response
+// first, and a line per pod that failed. Also returns how many pods failed.
+func summarizePods(results []podResult) ([]string, int) {
+	var (
+		groups  [][]string
+		indexes = make(map[string]int)
+		errors  []string
+	)
+	for _, result := range results {
+		if result.err != nil {
+			errors = append(errors, fmt.Sprintf("  %s returned an error: %s", result.pod, result.err))
+			continue
+		}
+		i, ok := indexes[result.response]
+		if !ok {
+			i = len(groups)
+			indexes[result.response] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], result.pod)
+	}
+	// Ties go to the group with the first pod by name
+	sort.SliceStable(groups, func(i, j int) bool { return len(groups[i]) > len(groups[j]) })
+
+	var summary []string
+	for i, group := range groups {
+		switch {
+		case i == 0 && len(groups) == 1:
+			summary = append(summary, fmt.Sprintf("  %d of %d pods returned the same response: %s", len(group), len(results), strings.Join(group, ", ")))
+		case i == 0:
+			summary = append(summary, fmt.Sprintf("  %d of %d pods returned the most common response: %s", len(group), len(results), strings.Join(group, ", ")))
+		default:
+			summary = append(summary, fmt.Sprintf("  %s returned a different response", strings.Join(group, ", ")))
+		}
+	}
+	return append(summary, errors...), len(errors)
+}
@@ -0,0 +1,165 @@
+package call
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wearefair/gurl/pkg/jsonpb"
+	"google.golang.org/grpc"
+)
+
+// Calls several pods at once, which is run with -race to check that the pods' calls don't
+// share anything they write to
+func TestCallAllPods(t *testing.T) {
+	servicePath, err := filepath.Abs("../../pkg/protobuf/testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialOptions := []grpc.DialOption{grpc.WithInsecure()}
+	// Every pod is dialed separately, so the client's own connection is never used
+	client, err := jsonpb.NewClient(&jsonpb.Config{
+		Address:      "127.0.0.1:1",
+		DialOptions:  dialOptions,
+		ServicePaths: []string{servicePath},
+	})
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err.Error())
+	}
+	defer client.Close()
+	create, err := client.Method("gurltest.People", "Create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	podAddresses := map[string]string{"api-0": "", "api-1": "", "api-2": ""}
+	for pod := range podAddresses {
+		podAddresses[pod] = startEchoServer(t, create.GetInputType())
+	}
+
+	// Server streaming methods are sent as unary calls too
+	for _, rpc := range []string{"Create", "List"} {
+		method, err := client.Method("gurltest.People", rpc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, err := client.Construct(method, []byte(`{"name": "alice"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := callAllPods(client, method, message, podAddresses, dialOptions); err != nil {
+			t.Errorf("%s: expected every pod to respond, got: %s", rpc, err)
+		}
+		if !method.IsServerStreaming() && rpc == "List" {
+			t.Errorf("%s: expected the method descriptor to be left unchanged", rpc)
+		}
+	}
+
+	// Pods that can't be reached fail the call
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	podAddresses["api-3"] = listener.Addr().String()
+	message, err := client.Construct(create, []byte(`{"name": "alice"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callAllPods(client, create, message, podAddresses, dialOptions); err == nil {
+		t.Error("Expected an error when a pod can't be reached")
+	}
+}
+
+// Starts a server that responds to every method with the request it was sent
+func startEchoServer(t *testing.T, messageDescriptor *desc.MessageDescriptor) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		request := dynamic.NewMessage(messageDescriptor)
+		if err := stream.RecvMsg(request); err != nil {
+			return err
+		}
+		return stream.SendMsg(request)
+	}))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func TestSummarizePods(t *testing.T) {
+	testCases := []struct {
+		Name string
+		// Results sorted by pod name, as callAllPods passes them
+		Results  []podResult
+		Summary  []string
+		Failures int
+	}{
+		{
+			Name: "every pod agrees",
+			Results: []podResult{
+				{pod: "api-0", response: "{}"},
+				{pod: "api-1", response: "{}"},
+			},
+			Summary: []string{"  2 of 2 pods returned the same response: api-0, api-1"},
+		},
+		{
+			Name: "the most common response comes first",
+			Results: []podResult{
+				{pod: "api-0", response: `{"version": "1"}`},
+				{pod: "api-1", response: `{"version": "2"}`},
+				{pod: "api-2", response: `{"version": "2"}`},
+			},
+			Summary: []string{
+				"  2 of 3 pods returned the most common response: api-1, api-2",
+				"  api-0 returned a different response",
+			},
+		},
+		{
+			Name: "ties go to the group with the first pod by name",
+			Results: []podResult{
+				{pod: "api-0", response: `{"version": "2"}`},
+				{pod: "api-1", response: `{"version": "1"}`},
+				{pod: "api-2", response: `{"version": "1"}`},
+				{pod: "api-3", response: `{"version": "2"}`},
+			},
+			Summary: []string{
+				"  2 of 4 pods returned the most common response: api-0, api-3",
+				"  api-1, api-2 returned a different response",
+			},
+		},
+		{
+			Name: "errors are listed last and counted",
+			Results: []podResult{
+				{pod: "api-0", err: errors.New("unavailable")},
+				{pod: "api-1", response: "{}"},
+				{pod: "api-2", err: errors.New("deadline exceeded")},
+			},
+			Summary: []string{
+				"  1 of 3 pods returned the same response: api-1",
+				"  api-0 returned an error: unavailable",
+				"  api-2 returned an error: deadline exceeded",
+			},
+			Failures: 2,
+		},
+		{
+			Name: "every pod fails",
+			Results: []podResult{
+				{pod: "api-0", err: errors.New("unavailable")},
+			},
+			Summary:  []string{"  api-0 returned an error: unavailable"},
+			Failures: 1,
+		},
+	}
+	for _, testCase := range testCases {
+		summary, failures := summarizePods(testCase.Results)
+		if !reflect.DeepEqual(summary, testCase.Summary) || failures != testCase.Failures {
+			t.Errorf("%s: expected %d failures and:\n%q\ngot %d failures and:\n%q", testCase.Name, testCase.Failures, testCase.Summary, failures, summary)
+		}
+	}
+}
@@ -1,12 +1,17 @@
 package call
 
 import (
+	"bufio"
 	"fmt"
+	"os"
 	"strings"
 
+	"github.com/wearefair/gurl/pkg/util"
 	"google.golang.org/grpc/metadata"
 )
 
+const headerFormat = "Header must be in the format '<Header-Name>:<Header-Value>'"
+
 type flagMetadata metadata.MD
 
 func (f flagMetadata) String() string {
@@ -17,15 +22,92 @@ func (f flagMetadata) String() string {
 	return builder.String()
 }
 
+// Set adds a header in the format '<Header-Name>:<Header-Value>', or every header in a file
+// with @<file>. Repeating a header adds another value.
 func (f flagMetadata) Set(val string) error {
-	components := strings.Split(val, ":")
-	if len(components) != 2 {
-		return fmt.Errorf("Header must be in the format '<Header-Name>:<Header-Value>'")
+	if strings.HasPrefix(val, "@") {
+		return f.addFile(val[1:])
 	}
-	metadata.MD(f).Append(components[0], components[1])
-	return nil
+	return f.add(val)
 }
 
 func (f flagMetadata) Type() string {
 	return "metadata.MD"
 }
+
+// Only the first colon separates the name, so values can contain colons
+func (f flagMetadata) add(header string) error {
+	components := strings.SplitN(header, ":", 2)
+	if len(components) != 2 || strings.TrimSpace(components[0]) == "" {
+		return fmt.Errorf(headerFormat)
+	}
+	metadata.MD(f).Append(strings.TrimSpace(components[0]), strings.TrimSpace(components[1]))
+	return nil
+}
+
+// Adds a header per line of the file, skipping blank lines and lines starting with #
+func (f flagMetadata) addFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		header := strings.TrimSpace(scanner.Text())
+		if header == "" || strings.HasPrefix(header, "#") {
+			continue
+		}
+		if err := f.add(header); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Adds the environment variables whose names start with the prefix, named by the rest of the
+// variable's name with underscores as dashes. With GURL_HEADER_, GURL_HEADER_X_API_KEY is sent
+// as x-api-key.
+func (f flagMetadata) addEnv(prefix string, environ []string) {
+	for _, variable := range environ {
+		components := strings.SplitN(variable, "=", 2)
+		if len(components) != 2 || !strings.HasPrefix(components[0], prefix) || components[0] == prefix {
+			continue
+		}
+		key := strings.ReplaceAll(strings.TrimPrefix(components[0], prefix), "_", "-")
+		metadata.MD(f).Append(key, components[1])
+	}
+}
+
+// Adds the headers of a set saved in the config
+func (f flagMetadata) addSet(name string, sets map[string][]string) error {
+	set, ok := sets[name]
+	if !ok {
+		return fmt.Errorf("No header set named %s in the config", name)
+	}
+	for _, header := range set {
+		if err := f.add(header); err != nil {
+			return fmt.Errorf("Header set %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Decodes the base64 values of binary headers, with keys ending in -bin, to the raw bytes
+// that gRPC encodes again on the wire
+func decodeBinaryHeaders(md metadata.MD) error {
+	for key, vals := range md {
+		if !strings.HasSuffix(key, "-bin") {
+			continue
+		}
+		for i, val := range vals {
+			decoded, err := util.DecodeBinaryHeader(val)
+			if err != nil {
+				return fmt.Errorf("Binary header %s must be base64 encoded: %s", key, err)
+			}
+			vals[i] = string(decoded)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package call
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wearefair/gurl/pkg/util"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestFlagMetadataAdd(t *testing.T) {
+	testCases := []struct {
+		Headers  []string
+		Expected metadata.MD
+		IsErr    bool
+	}{
+		{Headers: []string{"X-Request-Id: abc"}, Expected: metadata.MD{"x-request-id": {"abc"}}},
+		// Only the first colon separates the name from the value
+		{Headers: []string{"Referer: https://example.com:8443/path"}, Expected: metadata.MD{"referer": {"https://example.com:8443/path"}}},
+		{Headers: []string{"x-sent-at:2018-01-01T00:00:00Z"}, Expected: metadata.MD{"x-sent-at": {"2018-01-01T00:00:00Z"}}},
+		// Names and values are trimmed, and empty values are kept
+		{Headers: []string{"  x-empty :  "}, Expected: metadata.MD{"x-empty": {""}}},
+		// Repeating a header adds another value
+		{Headers: []string{"x-tag: a", "X-Tag: b"}, Expected: metadata.MD{"x-tag": {"a", "b"}}},
+		{Headers: []string{"x-no-colon"}, IsErr: true},
+		{Headers: []string{" : value"}, IsErr: true},
+	}
+	for _, testCase := range testCases {
+		md := flagMetadata{}
+		var err error
+		for _, header := range testCase.Headers {
+			if err = md.Set(header); err != nil {
+				break
+			}
+		}
+		if testCase.IsErr {
+			if err == nil {
+				t.Errorf("Headers: %q, expected an error, got: %v", testCase.Headers, md)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Headers: %q, unexpected error: %s", testCase.Headers, err)
+			continue
+		}
+		if !reflect.DeepEqual(metadata.MD(md), testCase.Expected) {
+			t.Errorf("Headers: %q, expected: %v, got: %v", testCase.Headers, testCase.Expected, md)
+		}
+	}
+}
+
+func TestFlagMetadataAddFile(t *testing.T) {
+	testCases := []struct {
+		Contents string
+		Expected metadata.MD
+		// Substring of the expected error
+		Err string
+	}{
+		{
+			Contents: "# Staging headers\nx-api-key: secret\n\n  # indented comment\nreferer: https://example.com:8443\n",
+			Expected: metadata.MD{"x-api-key": {"secret"}, "referer": {"https://example.com:8443"}},
+		},
+		// Errors point at the line of the file
+		{Contents: "x-api-key: secret\n\nnot a header\n", Err: ":3: " + headerFormat},
+	}
+	for _, testCase := range testCases {
+		path := filepath.Join(t.TempDir(), "headers")
+		if err := ioutil.WriteFile(path, []byte(testCase.Contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		md := flagMetadata{}
+		err := md.Set("@" + path)
+		if testCase.Err != "" {
+			if err == nil || !strings.HasSuffix(err.Error(), testCase.Err) || !strings.HasPrefix(err.Error(), path) {
+				t.Errorf("Contents: %q, expected an error ending in %q, got: %v", testCase.Contents, testCase.Err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Contents: %q, unexpected error: %s", testCase.Contents, err)
+			continue
+		}
+		if !reflect.DeepEqual(metadata.MD(md), testCase.Expected) {
+			t.Errorf("Contents: %q, expected: %v, got: %v", testCase.Contents, testCase.Expected, md)
+		}
+	}
+
+	if err := (flagMetadata{}).Set("@" + filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected error for a missing header file")
+	}
+}
+
+func TestFlagMetadataAddEnv(t *testing.T) {
+	environ := []string{
+		"GURL_HEADER_X_API_KEY=secret",
+		"GURL_HEADER_REFERER=https://example.com:8443/a=b",
+		// The prefix on its own has no header name
+		"GURL_HEADER_=ignored",
+		"GURL_HEADERS=ignored",
+		"HOME=/root",
+	}
+	md := flagMetadata{}
+	md.addEnv("GURL_HEADER_", environ)
+
+	expected := metadata.MD{"x-api-key": {"secret"}, "referer": {"https://example.com:8443/a=b"}}
+	if !reflect.DeepEqual(metadata.MD(md), expected) {
+		t.Errorf("Expected: %v, got: %v", expected, md)
+	}
+}
+
+func TestFlagMetadataAddSet(t *testing.T) {
+	sets := map[string][]string{
+		"staging": {"x-env: staging", "x-sent-at: 2018-01-01T00:00:00Z"},
+		"broken":  {"x-env: staging", "not a header"},
+	}
+	testCases := []struct {
+		Name     string
+		Expected metadata.MD
+		IsErr    bool
+	}{
+		{Name: "staging", Expected: metadata.MD{"x-env": {"staging"}, "x-sent-at": {"2018-01-01T00:00:00Z"}}},
+		{Name: "broken", IsErr: true},
+		{Name: "missing", IsErr: true},
+	}
+	for _, testCase := range testCases {
+		md := flagMetadata{}
+		err := md.addSet(testCase.Name, sets)
+		if testCase.IsErr {
+			if err == nil {
+				t.Errorf("Set %s, expected an error, got: %v", testCase.Name, md)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Set %s, unexpected error: %s", testCase.Name, err)
+			continue
+		}
+		if !reflect.DeepEqual(metadata.MD(md), testCase.Expected) {
+			t.Errorf("Set %s, expected: %v, got: %v", testCase.Name, testCase.Expected, md)
+		}
+	}
+}
+
+func TestDecodeBinaryHeaders(t *testing.T) {
+	testCases := []struct {
+		MD       metadata.MD
+		Expected metadata.MD
+		IsErr    bool
+	}{
+		// Padded and unpadded base64 decode the same
+		{MD: metadata.MD{"trace-bin": {"AQID"}}, Expected: metadata.MD{"trace-bin": {"\x01\x02\x03"}}},
+		{MD: metadata.MD{"trace-bin": {"AQI="}}, Expected: metadata.MD{"trace-bin": {"\x01\x02"}}},
+		{MD: metadata.MD{"trace-bin": {"AQI"}}, Expected: metadata.MD{"trace-bin": {"\x01\x02"}}},
+		// Only -bin headers are decoded
+		{MD: metadata.MD{"x-api-key": {"AQID"}}, Expected: metadata.MD{"x-api-key": {"AQID"}}},
+		{MD: metadata.MD{"trace-bin": {"not base64!"}}, IsErr: true},
+	}
+	for _, testCase := range testCases {
+		md := testCase.MD.Copy()
+		err := decodeBinaryHeaders(md)
+		if testCase.IsErr {
+			if err == nil {
+				t.Errorf("MD: %v, expected an error, got: %v", testCase.MD, md)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("MD: %v, unexpected error: %s", testCase.MD, err)
+			continue
+		}
+		if !reflect.DeepEqual(md, testCase.Expected) {
+			t.Errorf("MD: %v, expected: %q, got: %q", testCase.MD, testCase.Expected, md)
+		}
+
+		// HTTP transports send the decoded bytes as unpadded base64 again
+		headers := util.HeadersFromContext(metadata.NewOutgoingContext(context.Background(), md))
+		for key, vals := range testCase.MD {
+			if strings.HasSuffix(key, "-bin") {
+				vals = []string{strings.TrimRight(vals[0], "=")}
+			}
+			if actual := headers.Values(key); !reflect.DeepEqual(actual, vals) {
+				t.Errorf("MD: %v, expected %s to round trip as %q, got: %q", testCase.MD, key, vals, actual)
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package call
+
+import (
+	"fmt"
+	"strings"
+)
+
+type flagVars map[string]string
+
+func (f flagVars) String() string {
+	builder := &strings.Builder{}
+	for key, val := range f {
+		builder.WriteString(fmt.Sprintf("%s=%s; ", key, val))
+	}
+	return builder.String()
+}
+
+func (f flagVars) Set(val string) error {
+	components := strings.SplitN(val, "=", 2)
+	if len(components) != 2 || components[0] == "" {
+		return fmt.Errorf("Variable must be in the format '<name>=<value>'")
+	}
+	f[components[0]] = components[1]
+	return nil
+}
+
+func (f flagVars) Type() string {
+	return "vars"
+}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/wearefair/gurl/pkg/log"
+	"github.com/wearefair/gurl/pkg/options"
 )
 
 const (
@@ -41,6 +42,38 @@ type Config struct {
 		ServicePaths []string `json:"service_paths"`
 	} `json:"local"`
 	KubeConfig string
+	// Targets holds settings for specific hosts, keyed by host:port or host
+	Targets map[string]*Target `yaml:"targets"`
+	// HeaderSets are named lists of headers, in the '<Header-Name>:<Header-Value>' format, to
+	// send with --header-set
+	HeaderSets map[string][]string `yaml:"header_sets"`
+	// Redact masks sensitive values in logs
+	Redact Redact `yaml:"redact"`
+}
+
+// Redact lists sensitive values to mask in logs, on top of the headers that are always masked
+// and fields marked with the debug_redact option
+type Redact struct {
+	// Headers whose values are masked
+	Headers []string `yaml:"headers"`
+	// Fully qualified names of request and response fields to mask, such as users.User.password
+	Fields []string `yaml:"fields"`
+}
+
+// Target holds settings used whenever a specific host is called
+type Target struct {
+	TLS *options.TLS `yaml:"tls"`
+	// Where the token sent with every call comes from
+	Credentials *options.Credentials `yaml:"credentials"`
+}
+
+// Target returns the settings for a host, preferring an entry for host:port over one for
+// the host alone. Returns nil if neither is configured.
+func (c *Config) Target(host, port string) *Target {
+	if target, ok := c.Targets[host+":"+port]; ok {
+		return target
+	}
+	return c.Targets[host]
 }
 
 func homeDir() string {
@@ -83,11 +116,17 @@ func Save(config *Config) error {
 	if err != nil {
 		return log.LogAndReturn(err)
 	}
-	err = os.MkdirAll(configDir, 0744)
+	// The config can hold credentials, so only the user can read it, like the token cache
+	err = os.MkdirAll(configDir, 0700)
 	if err != nil {
 		return log.LogAndReturn(err)
 	}
-	return ioutil.WriteFile(filepath.Join(homeDir(), configFile), contents, 0644)
+	configPath := filepath.Join(homeDir(), configFile)
+	if err := ioutil.WriteFile(configPath, contents, 0600); err != nil {
+		return log.LogAndReturn(err)
+	}
+	// WriteFile keeps the permissions of an existing file, which used to be readable by everyone
+	return log.LogAndReturn(os.Chmod(configPath, 0600))
 }
 
 func defaults() {
@@ -0,0 +1,292 @@
+// Package connect sends calls with the Connect protocol, over plain HTTP POSTs for unary calls
+// and Connect envelopes for streaming calls. See https://connectrpc.com/docs/protocol
+package connect
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wearefair/gurl/pkg/log"
+	"github.com/wearefair/gurl/pkg/util"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Codec is the encoding of the messages sent and received
+type Codec string
+
+const (
+	CodecProto Codec = "proto"
+	CodecJSON  Codec = "json"
+)
+
+const (
+	protocolVersion = "1"
+
+	// Envelope flag set on compressed messages
+	compressedFlag = 0x01
+	// Envelope flag set on the message that ends the stream
+	endStreamFlag     = 0x02
+	envelopeHeaderLen = 5
+)
+
+// Connect's error codes are the gRPC codes in snake case, except for canceled
+var codeNames = map[string]codes.Code{
+	"canceled":            codes.Canceled,
+	"unknown":             codes.Unknown,
+	"invalid_argument":    codes.InvalidArgument,
+	"deadline_exceeded":   codes.DeadlineExceeded,
+	"not_found":           codes.NotFound,
+	"already_exists":      codes.AlreadyExists,
+	"permission_denied":   codes.PermissionDenied,
+	"resource_exhausted":  codes.ResourceExhausted,
+	"failed_precondition": codes.FailedPrecondition,
+	"aborted":             codes.Aborted,
+	"out_of_range":        codes.OutOfRange,
+	"unimplemented":       codes.Unimplemented,
+	"internal":            codes.Internal,
+	"unavailable":         codes.Unavailable,
+	"data_loss":           codes.DataLoss,
+	"unauthenticated":     codes.Unauthenticated,
+}
+
+// ParseCodec parses the name of a codec, proto or json
+func ParseCodec(name string) (Codec, error) {
+	switch codec := Codec(strings.ToLower(name)); codec {
+	case CodecProto, CodecJSON:
+		return codec, nil
+	}
+	return "", fmt.Errorf("Unsupported Connect codec %q, must be proto or json", name)
+}
+
+// Transport sends calls to a Connect endpoint. Implements jsonpb.Transport and
+// jsonpb.StreamTransport.
+type Transport struct {
+	client *http.Client
+	// Scheme and host the calls are sent to, e.g. https://api.example.com:443
+	baseURL string
+	codec   Codec
+}
+
+// NewTransport creates a transport that sends calls to the base URL with the client, encoding
+// messages with the codec
+func NewTransport(client *http.Client, baseURL string, codec Codec) *Transport {
+	return &Transport{
+		client:  client,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		codec:   codec,
+	}
+}
+
+// Invoke sends a unary call and returns the response. Errors are converted to gRPC statuses.
+func (t *Transport) Invoke(ctx context.Context, methodDescriptor *desc.MethodDescriptor, request proto.Message) (proto.Message, error) {
+	payload, err := t.marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.post(ctx, methodDescriptor, "application/"+string(t.codec), payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, unaryError(resp.StatusCode, body)
+	}
+	return t.unmarshal(methodDescriptor, body)
+}
+
+// InvokeStream sends a single request to a streaming method and returns every response
+func (t *Transport) InvokeStream(ctx context.Context, methodDescriptor *desc.MethodDescriptor, request proto.Message) ([]proto.Message, error) {
+	payload, err := t.marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.post(ctx, methodDescriptor, "application/connect+"+string(t.codec), envelope(0, payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, unaryError(resp.StatusCode, body)
+	}
+
+	responses := make([]proto.Message, 0)
+	for {
+		flags, payload, err := readEnvelope(resp.Body)
+		if err == io.EOF {
+			return nil, status.Error(codes.Internal, "Connect stream ended without an end of stream message")
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Invalid Connect stream: %s", err)
+		}
+		if flags&endStreamFlag != 0 {
+			if err := endStreamError(payload); err != nil {
+				return nil, err
+			}
+			return responses, nil
+		}
+		response, err := t.unmarshal(methodDescriptor, payload)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, response)
+	}
+}
+
+func (t *Transport) post(ctx context.Context, methodDescriptor *desc.MethodDescriptor, contentType string, body []byte) (*http.Response, error) {
+	endpoint := fmt.Sprintf("%s/%s/%s", t.baseURL, methodDescriptor.GetService().GetFullyQualifiedName(), methodDescriptor.GetName())
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header = util.HeadersFromContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Connect-Protocol-Version", protocolVersion)
+	if deadline, ok := ctx.Deadline(); ok {
+		millis := time.Until(deadline).Milliseconds()
+		if millis < 1 {
+			millis = 1
+		}
+		req.Header.Set("Connect-Timeout-Ms", strconv.FormatInt(millis, 10))
+	}
+
+	log.Infof("connect - POST %s", endpoint)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, status.Error(codes.DeadlineExceeded, err.Error())
+		}
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return resp, nil
+}
+
+func (t *Transport) marshal(message proto.Message) ([]byte, error) {
+	if t.codec == CodecJSON {
+		marshaler := &jsonpb.Marshaler{}
+		contents, err := marshaler.MarshalToString(message)
+		return []byte(contents), err
+	}
+	return proto.Marshal(message)
+}
+
+func (t *Transport) unmarshal(methodDescriptor *desc.MethodDescriptor, payload []byte) (proto.Message, error) {
+	response := dynamic.NewMessage(methodDescriptor.GetOutputType())
+	var err error
+	if t.codec == CodecJSON {
+		err = response.UnmarshalJSONPB(&jsonpb.Unmarshaler{AllowUnknownFields: true}, payload)
+	} else {
+		err = response.Unmarshal(payload)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to unmarshal response: %s", err)
+	}
+	return response, nil
+}
+
+// Prefixes the payload with the flags and its length
+func envelope(flags byte, payload []byte) []byte {
+	enveloped := make([]byte, envelopeHeaderLen+len(payload))
+	enveloped[0] = flags
+	binary.BigEndian.PutUint32(enveloped[1:envelopeHeaderLen], uint32(len(payload)))
+	copy(enveloped[envelopeHeaderLen:], payload)
+	return enveloped
+}
+
+// Reads the next envelope, returning io.EOF if the stream ended between envelopes
+func readEnvelope(reader io.Reader) (byte, []byte, error) {
+	header := make([]byte, envelopeHeaderLen)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if err == io.EOF {
+			return 0, nil, err
+		}
+		return 0, nil, fmt.Errorf("truncated envelope header")
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, nil, fmt.Errorf("truncated envelope")
+	}
+	if header[0]&compressedFlag != 0 {
+		return 0, nil, fmt.Errorf("compressed envelopes aren't supported")
+	}
+	return header[0], payload, nil
+}
+
+// Connect's JSON error, sent as the body of failed unary calls and in the end of stream
+// message of streaming calls
+type connectError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details []struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"details"`
+}
+
+func (e *connectError) err() error {
+	code, ok := codeNames[e.Code]
+	if !ok {
+		code = codes.Unknown
+	}
+	statusProto := &spb.Status{Code: int32(code), Message: e.Message}
+	for _, detail := range e.Details {
+		// Values are base64 encoded without padding
+		value, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(detail.Value, "="))
+		if err != nil {
+			continue
+		}
+		statusProto.Details = append(statusProto.Details, &any.Any{
+			TypeUrl: "type.googleapis.com/" + detail.Type,
+			Value:   value,
+		})
+	}
+	return status.FromProto(statusProto).Err()
+}
+
+// Returns the error from a failed unary call, falling back to the HTTP status if the body
+// isn't a Connect error
+func unaryError(httpStatus int, body []byte) error {
+	connectErr := &connectError{}
+	if err := json.Unmarshal(body, connectErr); err != nil || connectErr.Code == "" {
+		return status.Errorf(util.HTTPStatusToCode(httpStatus), "Connect request failed with HTTP status %d", httpStatus)
+	}
+	return connectErr.err()
+}
+
+// Returns the error in an end of stream message, or nil if the stream succeeded
+func endStreamError(payload []byte) error {
+	var endStream struct {
+		Error *connectError `json:"error"`
+	}
+	if err := json.Unmarshal(payload, &endStream); err != nil {
+		return status.Errorf(codes.Internal, "Invalid Connect end of stream message: %s", err)
+	}
+	if endStream.Error == nil {
+		return nil
+	}
+	return endStream.Error.err()
+}
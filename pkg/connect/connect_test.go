@@ -0,0 +1,230 @@
+package connect
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wearefair/gurl/pkg/protobuf"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Stand-in for a Connect server for gurltest.People. Create echoes the person back with their
+// name upper cased and List streams them back once per tag.
+func newTestServer(t *testing.T, service *desc.ServiceDescriptor) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := service.FindMethodByName(strings.TrimPrefix(r.URL.Path, "/gurltest.People/"))
+		if method == nil || r.Header.Get("Connect-Protocol-Version") != "1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("X-Token") != "secret" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code": "unauthenticated", "message": "missing token"}`))
+			return
+		}
+		contentType := r.Header.Get("Content-Type")
+		codec := CodecProto
+		if strings.HasSuffix(contentType, "json") {
+			codec = CodecJSON
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if method.IsServerStreaming() {
+			body = body[envelopeHeaderLen:]
+		}
+
+		transport := &Transport{codec: codec}
+		request, err := transport.unmarshal(method, body)
+		if err != nil {
+			t.Errorf("Error unmarshalling request: %s", err.Error())
+			return
+		}
+		person := request.(*dynamic.Message)
+		name := person.GetFieldByName("name").(string)
+		person.SetFieldByName("name", strings.ToUpper(name))
+
+		if !method.IsServerStreaming() {
+			if name == "missing" {
+				retryInfo, _ := proto.Marshal(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(0)})
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"code":    "not_found",
+					"message": "no such person",
+					"details": []map[string]string{{"type": "google.rpc.RetryInfo", "value": base64.RawStdEncoding.EncodeToString(retryInfo)}},
+				})
+				return
+			}
+			payload, _ := transport.marshal(person)
+			w.Header().Set("Content-Type", contentType)
+			w.Write(payload)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		for i := 0; i < person.FieldLength(person.FindFieldDescriptorByName("tags")); i++ {
+			payload, _ := transport.marshal(person)
+			w.Write(envelope(0, payload))
+		}
+		endStream := `{}`
+		if name == "missing" {
+			endStream = `{"error": {"code": "canceled", "message": "gave up"}}`
+		}
+		w.Write(envelope(endStreamFlag, []byte(endStream)))
+	}))
+}
+
+func TestInvoke(t *testing.T) {
+	service := createService(t)
+	create := service.FindMethodByName("Create")
+	server := newTestServer(t, service)
+	defer server.Close()
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-token", "secret")
+
+	testCases := []struct {
+		Codec    Codec
+		Name     string
+		Expected string
+		Code     codes.Code
+	}{
+		{Codec: CodecProto, Name: "alice", Expected: "ALICE"},
+		{Codec: CodecJSON, Name: "alice", Expected: "ALICE"},
+		{Codec: CodecProto, Name: "missing", Code: codes.NotFound},
+		{Codec: CodecJSON, Name: "missing", Code: codes.NotFound},
+	}
+
+	for _, testCase := range testCases {
+		transport := NewTransport(server.Client(), server.URL, testCase.Codec)
+		request := dynamic.NewMessage(create.GetInputType())
+		request.SetFieldByName("name", testCase.Name)
+
+		response, err := transport.Invoke(ctx, create, request)
+		if status.Code(err) != testCase.Code {
+			t.Errorf("Name: %s, codec: %s, expected %s, got: %v", testCase.Name, testCase.Codec, testCase.Code, err)
+			continue
+		}
+		if err != nil {
+			// Error details are kept
+			if details := status.Convert(err).Details(); len(details) != 1 {
+				t.Errorf("Name: %s, codec: %s, expected a RetryInfo detail, got: %v", testCase.Name, testCase.Codec, details)
+			}
+			continue
+		}
+		if name := response.(*dynamic.Message).GetFieldByName("name"); name != testCase.Expected {
+			t.Errorf("Name: %s, codec: %s, expected %s, got: %s", testCase.Name, testCase.Codec, testCase.Expected, name)
+		}
+	}
+
+	// Headers are sent as metadata
+	_, err := NewTransport(server.Client(), server.URL, CodecProto).Invoke(context.Background(), create, dynamic.NewMessage(create.GetInputType()))
+	if st := status.Convert(err); st.Code() != codes.Unauthenticated || st.Message() != "missing token" {
+		t.Errorf("Expected %s: missing token, got: %v", codes.Unauthenticated, err)
+	}
+
+	// HTTP errors without a Connect error are mapped to a code
+	_, err = NewTransport(server.Client(), server.URL+"/prefix", CodecProto).Invoke(ctx, create, dynamic.NewMessage(create.GetInputType()))
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected %s for a 404, got: %v", codes.Unimplemented, err)
+	}
+}
+
+func TestInvokeStream(t *testing.T) {
+	service := createService(t)
+	list := service.FindMethodByName("List")
+	server := newTestServer(t, service)
+	defer server.Close()
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-token", "secret")
+
+	for _, codec := range []Codec{CodecProto, CodecJSON} {
+		transport := NewTransport(server.Client(), server.URL, codec)
+		request := dynamic.NewMessage(list.GetInputType())
+		request.SetFieldByName("name", "alice")
+		request.SetFieldByName("tags", []string{"a", "b", "c"})
+
+		responses, err := transport.InvokeStream(ctx, list, request)
+		if err != nil {
+			t.Errorf("Codec: %s, unexpected error: %s", codec, err.Error())
+			continue
+		}
+		if len(responses) != 3 {
+			t.Errorf("Codec: %s, expected 3 responses, got: %d", codec, len(responses))
+		}
+		for _, response := range responses {
+			if name := response.(*dynamic.Message).GetFieldByName("name"); name != "ALICE" {
+				t.Errorf("Codec: %s, expected ALICE, got: %s", codec, name)
+			}
+		}
+
+		// Errors are read from the end of stream message
+		request.SetFieldByName("name", "missing")
+		_, err = transport.InvokeStream(ctx, list, request)
+		if st := status.Convert(err); st.Code() != codes.Canceled || st.Message() != "gave up" {
+			t.Errorf("Codec: %s, expected %s: gave up, got: %v", codec, codes.Canceled, err)
+		}
+	}
+}
+
+func TestReadEnvelope(t *testing.T) {
+	truncated := envelope(0, []byte("message"))
+	binary.BigEndian.PutUint32(truncated[1:], 100)
+	invalid := [][]byte{
+		{0, 0},
+		truncated,
+		envelope(compressedFlag, []byte("message")),
+	}
+	for _, body := range invalid {
+		if _, _, err := readEnvelope(strings.NewReader(string(body))); err == nil {
+			t.Errorf("Expected error reading envelope from %q", body)
+		}
+	}
+
+	if err := endStreamError([]byte("not json")); status.Code(err) != codes.Internal {
+		t.Errorf("Expected %s for an invalid end of stream message, got: %v", codes.Internal, err)
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	testCases := map[string]Codec{
+		"proto": CodecProto,
+		"JSON":  CodecJSON,
+	}
+	for name, expected := range testCases {
+		if codec, err := ParseCodec(name); err != nil || codec != expected {
+			t.Errorf("Expected %s from %s, got: %s, %v", expected, name, codec, err)
+		}
+	}
+	if _, err := ParseCodec("xml"); err == nil {
+		t.Error("Expected error parsing xml")
+	}
+}
+
+func createService(t *testing.T) *desc.ServiceDescriptor {
+	path, err := filepath.Abs("../protobuf/testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptors, err := protobuf.Collect([]string{}, []string{path})
+	if err != nil {
+		t.Fatalf("Error collecting test descriptors: %s", err.Error())
+	}
+	service, err := protobuf.NewCollector(descriptors).GetService("gurltest.People")
+	if err != nil {
+		t.Fatalf("Error getting service descriptor: %s", err.Error())
+	}
+	return service
+}
@@ -0,0 +1,244 @@
+// Package grpcweb sends unary calls with the gRPC-Web protocol, for services that are only
+// reachable through a gRPC-Web proxy such as Envoy's grpc_web filter. See
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-WEB.md
+package grpcweb
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wearefair/gurl/pkg/log"
+	"github.com/wearefair/gurl/pkg/util"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	contentType     = "application/grpc-web+proto"
+	textContentType = "application/grpc-web-text+proto"
+
+	// Frame flag set on the frame holding the trailers
+	trailerFlag = 0x80
+	// Frame flag set on compressed frames
+	compressedFlag = 0x01
+	frameHeaderLen = 5
+)
+
+// Transport sends calls to a gRPC-Web endpoint. Implements jsonpb.Transport.
+type Transport struct {
+	client *http.Client
+	// Scheme and host the calls are sent to, e.g. https://api.example.com:443
+	baseURL string
+	// Whether to use the base64 encoded grpc-web-text format, for proxies that only pass text
+	text bool
+}
+
+// NewTransport creates a transport that sends calls to the base URL with the client. Text
+// selects the base64 encoded grpc-web-text format.
+func NewTransport(client *http.Client, baseURL string, text bool) *Transport {
+	return &Transport{
+		client:  client,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		text:    text,
+	}
+}
+
+// Invoke sends the request to the method and returns the response. Errors are gRPC statuses,
+// read from the trailers or mapped from the HTTP status.
+func (t *Transport) Invoke(ctx context.Context, methodDescriptor *desc.MethodDescriptor, request proto.Message) (proto.Message, error) {
+	payload, err := proto.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	body := frame(0, payload)
+	if t.text {
+		body = []byte(base64.StdEncoding.EncodeToString(body))
+	}
+
+	endpoint := fmt.Sprintf("%s/%s/%s", t.baseURL, methodDescriptor.GetService().GetFullyQualifiedName(), methodDescriptor.GetName())
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header = util.HeadersFromContext(ctx)
+	if t.text {
+		req.Header.Set("Content-Type", textContentType)
+		req.Header.Set("Accept", textContentType)
+	} else {
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Accept", contentType)
+	}
+	req.Header.Set("X-Grpc-Web", "1")
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set("Grpc-Timeout", util.EncodeTimeout(time.Until(deadline)))
+	}
+
+	log.Infof("grpcweb - POST %s", endpoint)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, status.Error(codes.DeadlineExceeded, err.Error())
+		}
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	// Trailers-only responses put the status in the headers
+	if err := statusFromHeader(resp.Header); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, status.Errorf(util.HTTPStatusToCode(resp.StatusCode), "gRPC-Web request failed with HTTP status %s", resp.Status)
+	}
+	if t.text {
+		if respBody, err = decodeText(respBody); err != nil {
+			return nil, status.Errorf(codes.Internal, "Invalid grpc-web-text response: %s", err)
+		}
+	}
+
+	message, trailer, err := readFrames(respBody)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Invalid gRPC-Web response: %s", err)
+	}
+	if trailer == nil {
+		return nil, status.Error(codes.Internal, "gRPC-Web response is missing trailers")
+	}
+	if err := statusFromHeader(trailer); err != nil {
+		return nil, err
+	}
+	if message == nil {
+		return nil, status.Error(codes.Internal, "gRPC-Web response is missing a message")
+	}
+
+	response := dynamic.NewMessage(methodDescriptor.GetOutputType())
+	if err := response.Unmarshal(message); err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to unmarshal response: %s", err)
+	}
+	return response, nil
+}
+
+// Prefixes the payload with the flags and its length
+func frame(flags byte, payload []byte) []byte {
+	framed := make([]byte, frameHeaderLen+len(payload))
+	framed[0] = flags
+	binary.BigEndian.PutUint32(framed[1:frameHeaderLen], uint32(len(payload)))
+	copy(framed[frameHeaderLen:], payload)
+	return framed
+}
+
+// Reads the first message and the trailers out of the response body
+func readFrames(body []byte) ([]byte, http.Header, error) {
+	var (
+		message []byte
+		trailer http.Header
+	)
+	reader := bytes.NewReader(body)
+	for reader.Len() > 0 {
+		header := make([]byte, frameHeaderLen)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return nil, nil, fmt.Errorf("truncated frame header")
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return nil, nil, fmt.Errorf("truncated frame")
+		}
+		if header[0]&compressedFlag != 0 {
+			return nil, nil, fmt.Errorf("compressed frames aren't supported")
+		}
+
+		if header[0]&trailerFlag != 0 {
+			parsed, err := parseTrailer(payload)
+			if err != nil {
+				return nil, nil, err
+			}
+			trailer = parsed
+		} else if message == nil {
+			message = payload
+		}
+	}
+	return message, trailer, nil
+}
+
+// Trailers are encoded as HTTP/1 headers, each terminated by CRLF
+func parseTrailer(payload []byte) (http.Header, error) {
+	trailer := make(http.Header)
+	for _, line := range strings.Split(string(payload), "\r\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid trailer %q", line)
+		}
+		trailer.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return trailer, nil
+}
+
+// Returns the status in the grpc-status header as an error, or nil if it's OK or missing
+func statusFromHeader(header http.Header) error {
+	value := header.Get("Grpc-Status")
+	if value == "" {
+		return nil
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Invalid grpc-status %q", value)
+	}
+	if codes.Code(code) == codes.OK {
+		return nil
+	}
+
+	if details := header.Get("Grpc-Status-Details-Bin"); details != "" {
+		if decoded, err := util.DecodeBinaryHeader(details); err == nil {
+			statusProto := &spb.Status{}
+			if err := proto.Unmarshal(decoded, statusProto); err == nil {
+				return status.FromProto(statusProto).Err()
+			}
+		}
+	}
+	// The message is percent encoded
+	message := header.Get("Grpc-Message")
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		message = unescaped
+	}
+	return status.Error(codes.Code(code), message)
+}
+
+// Decodes a grpc-web-text body, which may be several base64 chunks each with their own
+// padding, so every 4 character quantum is decoded on its own
+func decodeText(body []byte) ([]byte, error) {
+	encoded := bytes.Join(bytes.Fields(body), nil)
+	if len(encoded)%4 != 0 {
+		return nil, fmt.Errorf("base64 body length %d isn't a multiple of 4", len(encoded))
+	}
+	decoded := make([]byte, 0, len(encoded)/4*3)
+	quantum := make([]byte, 3)
+	for i := 0; i < len(encoded); i += 4 {
+		n, err := base64.StdEncoding.Decode(quantum, encoded[i:i+4])
+		if err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, quantum[:n]...)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,147 @@
+package grpcweb
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wearefair/gurl/pkg/protobuf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Stand-in for a gRPC-Web proxy in front of gurltest.People/Create, which echoes the person
+// back with their name upper cased
+func newTestServer(t *testing.T, method *desc.MethodDescriptor) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gurltest.People/Create" || r.Header.Get("X-Grpc-Web") != "1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("X-Token") != "secret" || r.Header.Get("X-Trace-Bin") != base64.RawStdEncoding.EncodeToString([]byte{0, 1}) {
+			w.Header().Set("Grpc-Status", "16")
+			w.Header().Set("Grpc-Message", "missing%20token")
+			return
+		}
+		text := strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc-web-text")
+		body, _ := ioutil.ReadAll(r.Body)
+		if text {
+			body, _ = base64.StdEncoding.DecodeString(string(body))
+		}
+
+		person := dynamic.NewMessage(method.GetInputType())
+		if err := person.Unmarshal(body[frameHeaderLen:]); err != nil {
+			t.Errorf("Error unmarshalling request: %s", err.Error())
+		}
+		name := person.GetFieldByName("name").(string)
+		if name == "missing" {
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "no%20such%20person")
+			return
+		}
+		person.SetFieldByName("name", strings.ToUpper(name))
+		payload, _ := person.Marshal()
+		message := frame(0, payload)
+		trailer := frame(trailerFlag, []byte("grpc-status: 0\r\ngrpc-message: \r\n"))
+
+		if text {
+			// Each frame is encoded on its own, so the padding lands mid-body
+			w.Header().Set("Content-Type", textContentType)
+			w.Write([]byte(base64.StdEncoding.EncodeToString(message) + base64.StdEncoding.EncodeToString(trailer)))
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(message)
+		w.Write(trailer)
+	}))
+}
+
+func TestInvoke(t *testing.T) {
+	method := createMethod(t)
+	server := newTestServer(t, method)
+	defer server.Close()
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-token", "secret", "x-trace-bin", string([]byte{0, 1}))
+
+	testCases := []struct {
+		Text     bool
+		Name     string
+		Expected string
+		Code     codes.Code
+	}{
+		{Name: "alice", Expected: "ALICE"},
+		{Text: true, Name: "alice", Expected: "ALICE"},
+		{Name: "missing", Code: codes.NotFound},
+		{Text: true, Name: "missing", Code: codes.NotFound},
+	}
+
+	for _, testCase := range testCases {
+		transport := NewTransport(server.Client(), server.URL, testCase.Text)
+		request := dynamic.NewMessage(method.GetInputType())
+		request.SetFieldByName("name", testCase.Name)
+
+		response, err := transport.Invoke(ctx, method, request)
+		if status.Code(err) != testCase.Code {
+			t.Errorf("Name: %s, text: %t, expected %s, got: %v", testCase.Name, testCase.Text, testCase.Code, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if name := response.(*dynamic.Message).GetFieldByName("name"); name != testCase.Expected {
+			t.Errorf("Name: %s, text: %t, expected %s, got: %s", testCase.Name, testCase.Text, testCase.Expected, name)
+		}
+	}
+
+	// Headers are sent as metadata
+	_, err := NewTransport(server.Client(), server.URL, false).Invoke(context.Background(), method, dynamic.NewMessage(method.GetInputType()))
+	if st := status.Convert(err); st.Code() != codes.Unauthenticated || st.Message() != "missing token" {
+		t.Errorf("Expected %s: missing token, got: %v", codes.Unauthenticated, err)
+	}
+
+	// HTTP errors without a gRPC status are mapped to a code
+	_, err = NewTransport(server.Client(), server.URL+"/prefix", false).Invoke(ctx, method, dynamic.NewMessage(method.GetInputType()))
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected %s for a 404, got: %v", codes.Unimplemented, err)
+	}
+}
+
+func TestReadFrames(t *testing.T) {
+	truncated := frame(0, []byte("message"))
+	binary.BigEndian.PutUint32(truncated[1:], 100)
+	invalid := [][]byte{
+		{0, 0},
+		truncated,
+		frame(compressedFlag, []byte("message")),
+		frame(trailerFlag, []byte("no colon")),
+	}
+	for _, body := range invalid {
+		if _, _, err := readFrames(body); err == nil {
+			t.Errorf("Expected error reading frames from %q", body)
+		}
+	}
+}
+
+func createMethod(t *testing.T) *desc.MethodDescriptor {
+	path, err := filepath.Abs("../protobuf/testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptors, err := protobuf.Collect([]string{}, []string{path})
+	if err != nil {
+		t.Fatalf("Error collecting test descriptors: %s", err.Error())
+	}
+	service, err := protobuf.NewCollector(descriptors).GetService("gurltest.People")
+	if err != nil {
+		t.Fatalf("Error getting service descriptor: %s", err.Error())
+	}
+	return service.FindMethodByName("Create")
+}
@@ -1,43 +1,143 @@
 package jsonpb
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
-	"github.com/jhump/protoreflect/dynamic/grpcdynamic"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wearefair/gurl/pkg/log"
 	"github.com/wearefair/gurl/pkg/protobuf"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// Transport sends a request to a method and returns the response
+type Transport interface {
+	Invoke(ctx context.Context, methodDescriptor *desc.MethodDescriptor, request proto.Message) (proto.Message, error)
+}
+
+// StreamTransport is implemented by transports that can read every response of a server
+// streaming call
+type StreamTransport interface {
+	InvokeStream(ctx context.Context, methodDescriptor *desc.MethodDescriptor, request proto.Message) ([]proto.Message, error)
+}
+
+// Sends calls over gRPC. Every call is sent as a unary call, whether or not the method streams.
+type grpcTransport struct {
+	conn *grpc.ClientConn
+}
+
+func (g grpcTransport) Invoke(ctx context.Context, methodDescriptor *desc.MethodDescriptor, request proto.Message) (proto.Message, error) {
+	// Sent over the connection directly rather than with grpcdynamic's stub, which refuses
+	// streaming methods. Descriptors are shared between concurrent calls, so they can't be
+	// changed to look unary instead.
+	response := dynamic.NewMessageFactoryWithDefaults().NewMessage(methodDescriptor.GetOutputType())
+	fullMethod := fmt.Sprintf("/%s/%s", methodDescriptor.GetService().GetFullyQualifiedName(), methodDescriptor.GetName())
+	if err := g.conn.Invoke(ctx, fullMethod, request, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
 // Client handles constructing and dialing a gRPC service
 type Client struct {
-	stub grpcdynamic.Stub
+	transport Transport
+	// Connection the gRPC transport sends calls over, nil for other transports
+	conn *grpc.ClientConn
 	// TODO: Might want to turn this into an interface?
-	collector *protobuf.Collector
+	collector    *protobuf.Collector
+	format       protobuf.Format
+	redactFields []string
 }
 
 // NewClient creates a client with a Stub
 func NewClient(cfg *Config) (*Client, error) {
-	conn, err := grpc.Dial(cfg.Address, cfg.DialOptions...)
-	if err != nil {
-		return nil, err
+	return NewClientContext(context.Background(), cfg)
+}
+
+// NewClientContext creates a client with a Stub, giving up on blocking dials when the context
+// is done
+func NewClientContext(ctx context.Context, cfg *Config) (*Client, error) {
+	transport := cfg.Transport
+	var conn *grpc.ClientConn
+	if transport == nil {
+		var err error
+		conn, err = grpc.DialContext(ctx, cfg.Address, cfg.DialOptions...)
+		if err == context.DeadlineExceeded {
+			return nil, status.Errorf(codes.DeadlineExceeded, "timed out connecting to %s", cfg.Address)
+		}
+		if err != nil {
+			return nil, err
+		}
+		transport = grpcTransport{conn: conn}
 	}
 	// Walks the proto import and service paths defined in the config and returns all descriptors
 	descriptors, err := protobuf.Collect(cfg.ImportPaths, cfg.ServicePaths)
 	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
 		return nil, err
 	}
 
 	return &Client{
-		stub:      grpcdynamic.NewStub(conn),
-		collector: protobuf.NewCollector(descriptors),
+		transport:    transport,
+		conn:         conn,
+		collector:    protobuf.NewCollector(descriptors),
+		format:       cfg.InputFormat,
+		redactFields: cfg.RedactFields,
 	}, nil
 }
 
-// Call takes in a context, service, RPC, and message as JSON string to convert to protobuf and
-// send across the wire.
+// Dial returns a client that shares this client's descriptors and sends calls over gRPC to
+// another address, so the same call can be sent to several servers without collecting the
+// descriptors again
+func (c *Client) Dial(ctx context.Context, address string, dialOptions ...grpc.DialOption) (*Client, error) {
+	conn, err := grpc.DialContext(ctx, address, dialOptions...)
+	if err == context.DeadlineExceeded {
+		return nil, status.Errorf(codes.DeadlineExceeded, "timed out connecting to %s", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dialed := *c
+	dialed.transport = grpcTransport{conn: conn}
+	dialed.conn = conn
+	return &dialed, nil
+}
+
+// Close closes the client's gRPC connection. Clients with a custom transport have nothing to
+// close.
+func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// Call takes in a context, service, RPC, and message encoded in the configured input format
+// (JSON by default) to convert to protobuf and send across the wire.
 func (c *Client) Call(ctx context.Context, service, rpc string, rawMsg []byte) ([]byte, error) {
+	methodDescriptor, err := c.Method(service, rpc)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := c.Construct(methodDescriptor, rawMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Invoke(ctx, methodDescriptor, message)
+}
+
+// Method looks up the descriptor for an RPC on a service
+func (c *Client) Method(service, rpc string) (*desc.MethodDescriptor, error) {
 	serviceDescriptor, err := c.collector.GetService(service)
 	if err != nil {
 		return nil, err
@@ -49,32 +149,65 @@ func (c *Client) Call(ctx context.Context, service, rpc string, rawMsg []byte) (
 		err := fmt.Errorf("No method %s found", service)
 		return nil, err
 	}
+	return methodDescriptor, nil
+}
 
-	methodProto := methodDescriptor.AsMethodDescriptorProto()
-	messageDescriptor, err := c.collector.GetMessage(
-		protobuf.NormalizeMessageName(*methodProto.InputType),
-	)
+// Construct converts a message encoded in the configured input format into the method's
+// input message
+func (c *Client) Construct(methodDescriptor *desc.MethodDescriptor, rawMsg []byte) (*dynamic.Message, error) {
+	messageDescriptor, err := c.inputMessage(methodDescriptor)
 	if err != nil {
 		return nil, err
 	}
 
-	message, err := protobuf.Construct(messageDescriptor, rawMsg)
+	return protobuf.ConstructFormat(messageDescriptor, rawMsg, c.format)
+}
+
+// Check reports any problems with a message encoded in the configured input format before
+// it's constructed, such as unknown fields that would otherwise be silently dropped.
+func (c *Client) Check(methodDescriptor *desc.MethodDescriptor, rawMsg []byte) (*protobuf.Report, error) {
+	messageDescriptor, err := c.inputMessage(methodDescriptor)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: Allow for streaming calls. This locks us to unary calls
-	// Disabled server and client streaming calls
-	disableStreaming := false
-	methodProto.ClientStreaming = &disableStreaming
-	methodProto.ServerStreaming = &disableStreaming
+	return protobuf.CheckFormat(messageDescriptor, rawMsg, c.format)
+}
+
+func (c *Client) inputMessage(methodDescriptor *desc.MethodDescriptor) (*desc.MessageDescriptor, error) {
+	methodProto := methodDescriptor.AsMethodDescriptorProto()
+	return c.collector.GetMessage(
+		protobuf.NormalizeMessageName(*methodProto.InputType),
+	)
+}
+
+// Invoke sends the message to the method and returns the response as JSON. The responses of
+// server streaming calls are returned as a JSON array when the transport supports streaming.
+func (c *Client) Invoke(ctx context.Context, methodDescriptor *desc.MethodDescriptor, message proto.Message) ([]byte, error) {
+	marshaler := &runtime.JSONPb{}
+	c.logMessage("Request", message)
+	if streamer, ok := c.transport.(StreamTransport); ok && methodDescriptor.IsServerStreaming() {
+		responses, err := streamer.InvokeStream(ctx, methodDescriptor, message)
+		if err != nil {
+			return nil, err
+		}
+		responsesJSON := make([][]byte, len(responses))
+		for i, response := range responses {
+			c.logMessage("Response", response)
+			if responsesJSON[i], err = marshaler.Marshal(response); err != nil {
+				return nil, err
+			}
+		}
+		return append(append([]byte("["), bytes.Join(responsesJSON, []byte(","))...), ']'), nil
+	}
 
-	response, err := c.stub.InvokeRpc(ctx, methodDescriptor, message)
+	// TODO: Allow for streaming calls over gRPC. The gRPC transport sends every call as unary
+	response, err := c.transport.Invoke(ctx, methodDescriptor, message)
 	if err != nil {
 		return nil, err
 	}
 
-	marshaler := &runtime.JSONPb{}
+	c.logMessage("Response", response)
 	// Marshals PB response into JSON
 	responseJSON, err := marshaler.Marshal(response)
 	if err != nil {
@@ -83,3 +216,19 @@ func (c *Client) Call(ctx context.Context, service, rpc string, rawMsg []byte) (
 
 	return responseJSON, nil
 }
+
+// Logs a request or response with its sensitive fields redacted
+func (c *Client) logMessage(kind string, message proto.Message) {
+	if !log.InfoEnabled() {
+		return
+	}
+	dynamicMessage, err := dynamic.AsDynamicMessage(message)
+	if err != nil {
+		return
+	}
+	messageJSON, err := (&runtime.JSONPb{}).Marshal(protobuf.Redact(dynamicMessage, c.redactFields))
+	if err != nil {
+		return
+	}
+	log.Infof("%s: %s", kind, messageJSON)
+}
@@ -1,13 +1,22 @@
 package jsonpb
 
 import (
+	"github.com/wearefair/gurl/pkg/protobuf"
 	"google.golang.org/grpc"
 )
 
 // Config handles everything necessary to construct a Client
 type Config struct {
-	Address      string
-	DialOptions  []grpc.DialOption
+	Address     string
+	DialOptions []grpc.DialOption
+	// Transport sends calls over a protocol other than gRPC, such as gRPC-Web. The address and
+	// dial options are ignored when it's set.
+	Transport    Transport
 	ImportPaths  []string
 	ServicePaths []string
+	// InputFormat is the encoding of the raw messages passed to Call. Defaults to JSON.
+	InputFormat protobuf.Format
+	// RedactFields are the fully qualified names of fields masked when requests and responses
+	// are logged
+	RedactFields []string
 }
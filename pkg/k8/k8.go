@@ -8,10 +8,13 @@ import (
 	"os"
 
 	"github.com/wearefair/gurl/pkg/log"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/portforward"
 	"k8s.io/client-go/transport/spdy"
 )
@@ -23,6 +26,12 @@ type k8Client interface {
 	Config() rest.Config
 	Service(ctx context.Context, namespace, name string) (*v1.Service, error)
 	Endpoints(ctx context.Context, namespace, name string) (*v1.Endpoints, error)
+	Pod(ctx context.Context, namespace, name string) (*v1.Pod, error)
+	Pods(ctx context.Context, namespace string, selector labels.Selector) ([]v1.Pod, error)
+	Deployment(ctx context.Context, namespace, name string) (*appsv1.Deployment, error)
+	StatefulSet(ctx context.Context, namespace, name string) (*appsv1.StatefulSet, error)
+	Node(ctx context.Context, name string) (*v1.Node, error)
+	Secret(ctx context.Context, namespace, name string) (*v1.Secret, error)
 	PortForwarder(url *url.URL, localPort, remotePort string, ready, stop chan struct{}) (k8PortForwarder, error)
 }
 
@@ -31,6 +40,50 @@ type k8PortForwarder interface {
 	ForwardPorts() error
 }
 
+// Builds a client for the requested context, falling back to the current context if it's empty.
+// Returns the client config for the context as well, so callers can look up its namespace.
+func newK8ClientForContext(config clientcmd.ClientConfig, context string) (clientcmd.ClientConfig, *k8ClientImpl, error) {
+	rawConfig, err := config.RawConfig()
+	if err != nil {
+		log.Errorf("k8 - error getting raw config: %s", err)
+		return nil, nil, err
+	}
+
+	newConfig := clientcmd.NewDefaultClientConfig(rawConfig, &clientcmd.ConfigOverrides{
+		CurrentContext: context,
+	})
+
+	clientConfig, err := newConfig.ClientConfig()
+	if err != nil {
+		log.Errorf("k8 - failed to get client config: %s", err)
+		return nil, nil, err
+	}
+
+	client, err := newK8Client(clientConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newConfig, client, nil
+}
+
+// Returns the namespace if set. Otherwise looks in the context for a namespace, and
+// falls back to the default namespace.
+func resolveNamespace(config clientcmd.ClientConfig, namespace string) (string, error) {
+	if namespace != "" {
+		return namespace, nil
+	}
+	ns, _, err := config.Namespace()
+	if err != nil {
+		log.Errorf("k8 - error getting namespace from config: %s", err)
+		return "", err
+	}
+	if ns == "" {
+		log.Infof("k8 - namespace was empty, now setting to default: %s", defaultNamespace)
+		ns = defaultNamespace
+	}
+	return ns, nil
+}
+
 func newK8Client(config *rest.Config) (*k8ClientImpl, error) {
 	clientSet, err := kubernetes.NewForConfig(config)
 	if err != nil {
@@ -61,6 +114,34 @@ func (k *k8ClientImpl) Endpoints(ctx context.Context, namespace, name string) (*
 	return k.client.CoreV1().Endpoints(namespace).Get(ctx, name, metav1.GetOptions{})
 }
 
+func (k *k8ClientImpl) Pod(ctx context.Context, namespace, name string) (*v1.Pod, error) {
+	return k.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (k *k8ClientImpl) Pods(ctx context.Context, namespace string, selector labels.Selector) ([]v1.Pod, error) {
+	pods, err := k.client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+func (k *k8ClientImpl) Deployment(ctx context.Context, namespace, name string) (*appsv1.Deployment, error) {
+	return k.client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (k *k8ClientImpl) StatefulSet(ctx context.Context, namespace, name string) (*appsv1.StatefulSet, error) {
+	return k.client.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (k *k8ClientImpl) Node(ctx context.Context, name string) (*v1.Node, error) {
+	return k.client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+}
+
+func (k *k8ClientImpl) Secret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	return k.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
 func (k *k8ClientImpl) PortForwarder(url *url.URL, localPort, remotePort string, ready, stop chan struct{}) (k8PortForwarder, error) {
 	transport, upgrader, err := spdy.RoundTripperFor(k.config)
 	if err != nil {
@@ -0,0 +1,96 @@
+package k8
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Kinds of resources that can be forwarded to.
+const (
+	ServiceKind     = "service"
+	PodKind         = "pod"
+	DeploymentKind  = "deployment"
+	StatefulSetKind = "statefulset"
+)
+
+// Returns the pod, checking that it matches the selector.
+func getPod(ctx context.Context, client k8Client, namespace, name string, selector labels.Selector) (candidate, error) {
+	pod, err := client.Pod(ctx, namespace, name)
+	if err != nil {
+		return candidate{}, err
+	}
+	if !selector.Matches(labels.Set(pod.Labels)) {
+		return candidate{}, fmt.Errorf("Pod %s doesn't match %s", name, selector)
+	}
+	return candidate{name: pod.Name, node: pod.Spec.NodeName}, nil
+}
+
+// Returns the ready pods of the deployment that also match the selector.
+func getDeploymentPods(ctx context.Context, client k8Client, req PortForwardRequest, selector labels.Selector) ([]candidate, error) {
+	deployment, err := client.Deployment(ctx, req.Namespace, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return getReadyPods(ctx, client, req, deployment.Spec.Selector, selector)
+}
+
+// Returns the pod of the statefulset with the requested ordinal, or the ready pods of the
+// statefulset if no ordinal was requested.
+func getStatefulSetPods(ctx context.Context, client k8Client, req PortForwardRequest, selector labels.Selector) ([]candidate, error) {
+	statefulSet, err := client.StatefulSet(ctx, req.Namespace, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if req.Ordinal == "" {
+		return getReadyPods(ctx, client, req, statefulSet.Spec.Selector, selector)
+	}
+	// Statefulset pods are named after the statefulset and their ordinal
+	pod, err := getPod(ctx, client, req.Namespace, fmt.Sprintf("%s-%s", statefulSet.Name, req.Ordinal), selector)
+	if err != nil {
+		return nil, err
+	}
+	return []candidate{pod}, nil
+}
+
+// Returns the ready pods matching both the workload's selector and the requested selector.
+func getReadyPods(ctx context.Context, client k8Client, req PortForwardRequest, workloadSelector *metav1.LabelSelector, selector labels.Selector) ([]candidate, error) {
+	combined, err := metav1.LabelSelectorAsSelector(workloadSelector)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid selector on %s %s: %s", req.Kind, req.Name, err)
+	}
+	requirements, _ := selector.Requirements()
+	combined = combined.Add(requirements...)
+
+	pods, err := client.Pods(ctx, req.Namespace, combined)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []candidate
+	for _, pod := range pods {
+		if podReady(pod) {
+			candidates = append(candidates, candidate{name: pod.Name, node: pod.Spec.NodeName})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("No ready pods found for %s %s matching %s", req.Kind, req.Name, combined)
+	}
+	return candidates, nil
+}
+
+// Pods are ready once they're running and pass their readiness checks, until they start
+// terminating.
+func podReady(pod v1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != v1.PodRunning {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
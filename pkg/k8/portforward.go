@@ -4,12 +4,12 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"strconv"
 	"sync"
 
 	"github.com/wearefair/gurl/pkg/log"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -19,17 +19,49 @@ import (
 // Implements fmt.Stringer so the structure can easily be printed for logging.
 type PortForwardRequest struct {
 	Context string
-	// Namespace the service runs in. Will be "default" if left blank.
+	// Namespace the service runs in. Falls back to the context's namespace, then "default", if left blank.
 	Namespace string
-	// Service name.
+	// Kind of resource to forward to: service, pod, deployment or statefulset. Defaults to service.
+	Kind string
+	// Name of the service, or of the resource of Kind.
+	Name string
+	// Service is read as the Name when Name is left blank.
+	//
+	// Deprecated: use Name, which also names the other kinds of resources.
 	Service string
-	// Service port.
+	// Ordinal of the statefulset's pod to forward to. Any ready pod is chosen if left blank.
+	Ordinal string
+	// Label selector narrowing down the pods that can be forwarded to.
+	Selector string
+	// Service port, or the container port for every other kind. The port named grpc is used if
+	// left blank.
 	Port string
+	// Strategy for choosing between the ready pods: first, random or round-robin. Defaults to first.
+	Strategy string
+	// Pod to forward to, which must be one of the ready pods.
+	Pod string
+	// Ready pods on this node, or in this zone, are chosen from when there are any.
+	PreferNode string
+	PreferZone string
 }
 
 // String func to print the request.
 func (p PortForwardRequest) String() string {
-	return fmt.Sprintf("context: %s, namespace: %s, service: %s, port: %s", p.Context, p.Namespace, p.Service, p.Port)
+	return fmt.Sprintf("context: %s, namespace: %s, %s: %s, selector: %s, port: %s", p.Context, p.Namespace, p.kind(), p.name(), p.Selector, p.Port)
+}
+
+func (p PortForwardRequest) name() string {
+	if p.Name == "" {
+		return p.Service
+	}
+	return p.Name
+}
+
+func (p PortForwardRequest) kind() string {
+	if p.Kind == "" {
+		return ServiceKind
+	}
+	return p.Kind
 }
 
 // PortForward encapsulates all K8 portforwarding coordination.
@@ -38,9 +70,12 @@ type PortForward struct {
 	localPort       string
 	stopChannel     chan struct{}
 	stopCoordinator *sync.Once
+	// The pod connected to
+	pod string
 }
 
-// StartPortForward starts a portforward connection to a pod that is backing the requested service.
+// StartPortForward starts a portforward connection to a pod that is backing the requested service,
+// or to the requested pod or a pod of the requested deployment or statefulset.
 // If the connection was successfully established a PortForward will be returned, which exposes
 // as methods:
 // - The local port it is listening on
@@ -49,23 +84,7 @@ type PortForward struct {
 //
 // Returns an error if the connection could not be established.
 func StartPortForward(config clientcmd.ClientConfig, req PortForwardRequest) (*PortForward, error) {
-	rawConfig, err := config.RawConfig()
-	if err != nil {
-		log.Errorf("port-forward - error getting raw config: %s", err)
-		return nil, err
-	}
-
-	newConfig := clientcmd.NewDefaultClientConfig(rawConfig, &clientcmd.ConfigOverrides{
-		CurrentContext: req.Context,
-	})
-
-	clientConfig, err := newConfig.ClientConfig()
-	if err != nil {
-		log.Errorf("port-forward - failed to get client config: %s", err)
-		return nil, err
-	}
-
-	client, err := newK8Client(clientConfig)
+	newConfig, client, err := newK8ClientForContext(config, req.Context)
 	if err != nil {
 		return nil, err
 	}
@@ -84,35 +103,98 @@ func startPortForward(ctx context.Context, config clientcmd.ClientConfig, req Po
 	// If the caller didn't specify a namespace:
 	// - Look in the context for a namespace
 	// - Fall back to the default namespace
-	if req.Namespace == "" {
-		ns, _, err := config.Namespace()
-		if err != nil {
-			log.Errorf("port-forward - error getting namespace from config: %s", err)
-			return nil, err
-		}
-		if ns == "" {
-			log.Infof("port-forward - namespace was empty, now setting to default: %s", defaultNamespace)
-			ns = defaultNamespace
-		}
-		req.Namespace = ns
+	namespace, err := resolveNamespace(config, req.Namespace)
+	if err != nil {
+		return nil, err
 	}
+	req.Namespace = namespace
+	req.Name = req.name()
 
 	pod, remotePort, err := getPodNameAndRemotePort(ctx, client, req)
 	if err != nil {
 		log.Errorf("port-forward - failed to get pod and remote port: %s", err)
 		return nil, err
 	}
+	return forward(client, req.Namespace, pod, remotePort, localPort)
+}
+
+// StartPortForwards starts a portforward connection to every ready pod backing the requested
+// service, deployment or statefulset, keyed by pod name, so all of them can be called.
+//
+// Returns an error if any of the connections could not be established, after closing the rest.
+func StartPortForwards(config clientcmd.ClientConfig, req PortForwardRequest) (map[string]*PortForward, error) {
+	newConfig, client, err := newK8ClientForContext(config, req.Context)
+	if err != nil {
+		return nil, err
+	}
+	return startPortForwards(context.Background(), newConfig, req, client)
+}
+
+// Helper for StartPortForwards that only takes interfaces so it can be mocked.
+func startPortForwards(ctx context.Context, config clientcmd.ClientConfig, req PortForwardRequest, client k8Client) (map[string]*PortForward, error) {
+	namespace, err := resolveNamespace(config, req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	req.Namespace = namespace
+	req.Name = req.name()
+
+	remotePorts, err := getPodsAndRemotePorts(ctx, client, req)
+	if err != nil {
+		log.Errorf("port-forward - failed to get pods and remote ports: %s", err)
+		return nil, err
+	}
+
+	type result struct {
+		pod         string
+		portForward *PortForward
+		err         error
+	}
+	results := make(chan result, len(remotePorts))
+	for pod, remotePort := range remotePorts {
+		go func(pod, remotePort string) {
+			localPort, err := getAvailablePort()
+			if err != nil {
+				results <- result{pod: pod, err: err}
+				return
+			}
+			portForward, err := forward(client, req.Namespace, pod, remotePort, localPort)
+			results <- result{pod: pod, portForward: portForward, err: err}
+		}(pod, remotePort)
+	}
+
+	portForwards := make(map[string]*PortForward, len(remotePorts))
+	var failed error
+	for range remotePorts {
+		result := <-results
+		if result.err != nil {
+			failed = fmt.Errorf("Failed to port-forward to pod %s: %s", result.pod, result.err)
+			continue
+		}
+		portForwards[result.pod] = result.portForward
+	}
+	if failed != nil {
+		for _, portForward := range portForwards {
+			portForward.Close()
+		}
+		return nil, failed
+	}
+	return portForwards, nil
+}
 
+// Starts a portforward connection to the pod on a local port.
+func forward(client k8Client, namespace, pod, remotePort, localPort string) (*PortForward, error) {
 	activePortForward := &PortForward{
 		localPort:       localPort,
+		pod:             pod,
 		stopChannel:     make(chan struct{}),
 		stopCoordinator: &sync.Once{},
 	}
 
 	log.Infof("port-forward - setting up connection: namespace=%s, pod=%s, remote-port=%s",
-		req.Namespace, pod, remotePort)
+		namespace, pod, remotePort)
 
-	errChan, err := activePortForward.connect(client, req.Namespace, pod, remotePort)
+	errChan, err := activePortForward.connect(client, namespace, pod, remotePort)
 	if err != nil {
 		log.Errorf("port-forward - failed to start port forward: %s", err)
 		return nil, err
@@ -137,6 +219,11 @@ func (p *PortForward) LocalPort() string {
 	return p.localPort
 }
 
+// Pod returns the name of the pod the port forward is connected to.
+func (p *PortForward) Pod() string {
+	return p.pod
+}
+
 // StoppedChannel returns a channel that will be closed when the underlying connection
 // has been closed.
 func (p *PortForward) StoppedChannel() <-chan struct{} {
@@ -196,62 +283,148 @@ func (p *PortForward) connect(client k8Client, namespace, podName, remotePort st
 	}
 }
 
+// The pods a request can be forwarded to, and how to find the port to forward to on each of them.
+type podTarget struct {
+	pods []candidate
+	port func(ctx context.Context, pod string) (string, error)
+}
+
 // Given a service and service port, returns a backing pod name and pod port that match the provided service.
+// Pods, deployments and statefulsets are forwarded to on the requested container port. Without
+// a port, the service port or container port named grpc is used.
 // Returns an error if a pod or port matching could not be determined.
 func getPodNameAndRemotePort(ctx context.Context, client k8Client, req PortForwardRequest) (string, string, error) {
-	podName, err := getPodNameFromServiceEndpoints(ctx, client, req)
+	target, err := getPodTarget(ctx, client, req)
+	if err != nil {
+		return "", "", err
+	}
+	pod, err := choosePod(ctx, client, req, target.pods)
 	if err != nil {
 		return "", "", err
 	}
-	targetPort, err := getPodPortFromServicePort(ctx, client, req)
+	port, err := target.port(ctx, pod)
 	if err != nil {
 		return "", "", err
 	}
-	return podName, targetPort, nil
+	return pod, port, nil
 }
 
-// Returns the pod port that maps to the requested service port.
-func getPodPortFromServicePort(ctx context.Context, client k8Client, req PortForwardRequest) (string, error) {
-	service, err := client.Service(ctx, req.Namespace, req.Service)
+// Returns every pod the request can be forwarded to, mapped to the port to forward to on it.
+func getPodsAndRemotePorts(ctx context.Context, client k8Client, req PortForwardRequest) (map[string]string, error) {
+	target, err := getPodTarget(ctx, client, req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	if len(service.Spec.Ports) == 0 {
-		return "", fmt.Errorf("No ports found for %s", req.Service)
+	ports := make(map[string]string, len(target.pods))
+	for _, pod := range target.pods {
+		if ports[pod.name], err = target.port(ctx, pod.name); err != nil {
+			return nil, err
+		}
 	}
+	return ports, nil
+}
 
-	portInt, err := strconv.Atoi(req.Port)
+func getPodTarget(ctx context.Context, client k8Client, req PortForwardRequest) (*podTarget, error) {
+	selector, err := labels.Parse(req.Selector)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("Invalid label selector %q: %s", req.Selector, err)
 	}
 
-	for _, port := range service.Spec.Ports {
-		if port.Port == int32(portInt) {
-			return strconv.Itoa(int(port.TargetPort.IntVal)), nil
+	var pods []candidate
+	switch req.Kind {
+	case "", ServiceKind:
+		service, err := client.Service(ctx, req.Namespace, req.Name)
+		if err != nil {
+			return nil, err
 		}
+		servicePort, err := getServicePort(service, req.Port)
+		if err != nil {
+			return nil, err
+		}
+		pods, err = getServiceEndpointPods(ctx, client, req, service, selector)
+		if err != nil {
+			return nil, err
+		}
+		return &podTarget{pods: pods, port: func(ctx context.Context, pod string) (string, error) {
+			return getPodPortFromServicePort(ctx, client, req.Namespace, pod, servicePort)
+		}}, nil
+	case PodKind:
+		var pod candidate
+		pod, err = getPod(ctx, client, req.Namespace, req.Name, selector)
+		pods = []candidate{pod}
+	case DeploymentKind:
+		pods, err = getDeploymentPods(ctx, client, req, selector)
+	case StatefulSetKind:
+		pods, err = getStatefulSetPods(ctx, client, req, selector)
+	default:
+		err = fmt.Errorf("Unsupported kind %s, expected %s, %s, %s or %s", req.Kind, ServiceKind, PodKind, DeploymentKind, StatefulSetKind)
 	}
-
-	return "", fmt.Errorf("No ports found for %s", req.Service)
+	if err != nil {
+		return nil, err
+	}
+	return &podTarget{pods: pods, port: func(ctx context.Context, pod string) (string, error) {
+		if req.Port != "" {
+			return req.Port, nil
+		}
+		return getContainerPort(ctx, client, req.Namespace, pod, grpcPortName)
+	}}, nil
 }
 
-// Returns the first pod name from the endpoints on the requested service.
-// If no pods could be found return error.
-func getPodNameFromServiceEndpoints(ctx context.Context, client k8Client, req PortForwardRequest) (string, error) {
-	endpoints, err := client.Endpoints(ctx, req.Namespace, req.Service)
+// Returns the pods of the ready endpoints on the requested service, that also match the
+// selector if one was given. If no pods could be found return error.
+func getServiceEndpointPods(ctx context.Context, client k8Client, req PortForwardRequest, service *v1.Service, selector labels.Selector) ([]candidate, error) {
+	endpoints, err := client.Endpoints(ctx, req.Namespace, req.Name)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	// Endpoints don't carry the pods' labels or state, so the service's pods are looked up to
+	// match the selector. Services that publish not ready addresses can also list pods that
+	// aren't ready or are terminating, which are skipped.
+	podSelector := selector
+	if len(service.Spec.Selector) > 0 {
+		requirements, _ := selector.Requirements()
+		podSelector = labels.SelectorFromSet(service.Spec.Selector).Add(requirements...)
 	}
+	var pods map[string]v1.Pod
+	if !podSelector.Empty() {
+		list, err := client.Pods(ctx, req.Namespace, podSelector)
+		if err != nil {
+			return nil, err
+		}
+		pods = make(map[string]v1.Pod, len(list))
+		for _, pod := range list {
+			pods[pod.Name] = pod
+		}
+	}
+
+	var candidates []candidate
+	seen := make(map[string]bool)
 	for _, subset := range endpoints.Subsets {
 		for _, address := range subset.Addresses {
-			reference := *address.TargetRef
-			if reference.Kind != "Pod" {
+			// Addresses that aren't backed by pods don't have a reference
+			if address.TargetRef == nil || address.TargetRef.Kind != "Pod" || seen[address.TargetRef.Name] {
 				continue
 			}
-			return reference.Name, nil
+			name := address.TargetRef.Name
+			if pod, ok := pods[name]; pods != nil && (!ok || !podReady(pod)) {
+				continue
+			}
+			seen[name] = true
+			node := ""
+			if address.NodeName != nil {
+				node = *address.NodeName
+			}
+			candidates = append(candidates, candidate{name: name, node: node})
+		}
+	}
+	if len(candidates) == 0 {
+		if !selector.Empty() {
+			return nil, fmt.Errorf("No healthy pods found for service %s matching %s", req.Name, selector)
 		}
+		return nil, fmt.Errorf("No healthy pods found for service %s", req.Name)
 	}
-	return "", fmt.Errorf("No healthy pods found for service %s", req.Service)
+	return candidates, nil
 }
 
 // Use net/listen to pick a randomly available port for us to use
@@ -0,0 +1,386 @@
+package k8
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/rest"
+)
+
+// k8Client that serves the objects it's created with, all in the same namespace
+type fakeClient struct {
+	k8Client
+	services     map[string]*v1.Service
+	endpoints    map[string]*v1.Endpoints
+	pods         []v1.Pod
+	deployments  map[string]*appsv1.Deployment
+	statefulSets map[string]*appsv1.StatefulSet
+	nodes        map[string]*v1.Node
+	// Pods that port forwards fail to connect to
+	unreachable map[string]bool
+}
+
+func newFakeClient(objects ...interface{}) *fakeClient {
+	client := &fakeClient{
+		services:     make(map[string]*v1.Service),
+		endpoints:    make(map[string]*v1.Endpoints),
+		deployments:  make(map[string]*appsv1.Deployment),
+		statefulSets: make(map[string]*appsv1.StatefulSet),
+		nodes:        make(map[string]*v1.Node),
+	}
+	for _, object := range objects {
+		switch object := object.(type) {
+		case *v1.Service:
+			client.services[object.Name] = object
+		case *v1.Endpoints:
+			client.endpoints[object.Name] = object
+		case *v1.Pod:
+			client.pods = append(client.pods, *object)
+		case *appsv1.Deployment:
+			client.deployments[object.Name] = object
+		case *appsv1.StatefulSet:
+			client.statefulSets[object.Name] = object
+		case *v1.Node:
+			client.nodes[object.Name] = object
+		}
+	}
+	return client
+}
+
+func (f *fakeClient) Service(ctx context.Context, namespace, name string) (*v1.Service, error) {
+	if service, ok := f.services[name]; ok {
+		return service, nil
+	}
+	return nil, fmt.Errorf("services %q not found", name)
+}
+
+func (f *fakeClient) Endpoints(ctx context.Context, namespace, name string) (*v1.Endpoints, error) {
+	if endpoints, ok := f.endpoints[name]; ok {
+		return endpoints, nil
+	}
+	return nil, fmt.Errorf("endpoints %q not found", name)
+}
+
+func (f *fakeClient) Pod(ctx context.Context, namespace, name string) (*v1.Pod, error) {
+	for i := range f.pods {
+		if f.pods[i].Name == name {
+			return &f.pods[i], nil
+		}
+	}
+	return nil, fmt.Errorf("pods %q not found", name)
+}
+
+func (f *fakeClient) Pods(ctx context.Context, namespace string, selector labels.Selector) ([]v1.Pod, error) {
+	var pods []v1.Pod
+	for _, pod := range f.pods {
+		if selector.Matches(labels.Set(pod.Labels)) {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+func (f *fakeClient) Deployment(ctx context.Context, namespace, name string) (*appsv1.Deployment, error) {
+	if deployment, ok := f.deployments[name]; ok {
+		return deployment, nil
+	}
+	return nil, fmt.Errorf("deployments.apps %q not found", name)
+}
+
+func (f *fakeClient) StatefulSet(ctx context.Context, namespace, name string) (*appsv1.StatefulSet, error) {
+	if statefulSet, ok := f.statefulSets[name]; ok {
+		return statefulSet, nil
+	}
+	return nil, fmt.Errorf("statefulsets.apps %q not found", name)
+}
+
+func (f *fakeClient) Node(ctx context.Context, name string) (*v1.Node, error) {
+	if node, ok := f.nodes[name]; ok {
+		return node, nil
+	}
+	return nil, fmt.Errorf("nodes %q not found", name)
+}
+
+func (f *fakeClient) Config() rest.Config {
+	return rest.Config{Host: "https://localhost:6443"}
+}
+
+func (f *fakeClient) PortForwarder(url *url.URL, localPort, remotePort string, ready, stop chan struct{}) (k8PortForwarder, error) {
+	for pod := range f.unreachable {
+		if strings.Contains(url.Path, "/pods/"+pod+"/") {
+			return nil, fmt.Errorf("pod %s is unreachable", pod)
+		}
+	}
+	return fakeForwarder{ready: ready, stop: stop}, nil
+}
+
+// Port forward that's ready straight away, and runs until it's stopped
+type fakeForwarder struct {
+	ready chan struct{}
+	stop  chan struct{}
+}
+
+func (f fakeForwarder) ForwardPorts() error {
+	close(f.ready)
+	<-f.stop
+	return nil
+}
+
+// A running pod with the labels, which is ready unless it's told otherwise
+func newPod(name string, ready bool, podLabels map[string]string) *v1.Pod {
+	status := v1.ConditionTrue
+	if !ready {
+		status = v1.ConditionFalse
+	}
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: podLabels},
+		Status: v1.PodStatus{
+			Phase:      v1.PodRunning,
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: status}},
+		},
+	}
+}
+
+// Endpoints with an address for each pod
+func newEndpoints(name string, pods ...string) *v1.Endpoints {
+	subset := v1.EndpointSubset{}
+	for _, pod := range pods {
+		subset.Addresses = append(subset.Addresses, v1.EndpointAddress{
+			TargetRef: &v1.ObjectReference{Kind: "Pod", Name: pod},
+		})
+	}
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Subsets:    []v1.EndpointSubset{subset},
+	}
+}
+
+func TestGetPodNameAndRemotePort(t *testing.T) {
+	apiLabels := map[string]string{"app": "api", "track": "stable"}
+	canaryLabels := map[string]string{"app": "api", "track": "canary"}
+	ledgerLabels := map[string]string{"app": "ledger"}
+	client := newFakeClient(
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+				{Port: 80, TargetPort: intstr.FromInt(8080)},
+			}},
+		},
+		newEndpoints("api", "api-1", "api-canary"),
+		newPod("api-1", true, apiLabels),
+		newPod("api-0", false, apiLabels),
+		newPod("api-canary", true, canaryLabels),
+		newPod("ledger-0", true, ledgerLabels),
+		newPod("ledger-1", true, ledgerLabels),
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+			Spec:       appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}}},
+		},
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "ledger", Namespace: "default"},
+			Spec:       appsv1.StatefulSetSpec{Selector: &metav1.LabelSelector{MatchLabels: ledgerLabels}},
+		},
+	)
+
+	testCases := []struct {
+		Request PortForwardRequest
+		Pod     string
+		Port    string
+		IsErr   bool
+	}{
+		// Services are forwarded to on the service port's target port
+		{Request: PortForwardRequest{Name: "api", Port: "80"}, Pod: "api-1", Port: "8080"},
+		{Request: PortForwardRequest{Kind: ServiceKind, Name: "api", Port: "80", Selector: "track=canary"}, Pod: "api-canary", Port: "8080"},
+		{Request: PortForwardRequest{Name: "api", Port: "80", Selector: "track=beta"}, IsErr: true},
+		{Request: PortForwardRequest{Name: "api", Port: "80", Selector: "track in (canary"}, IsErr: true},
+		// Every other kind is forwarded to on the container port
+		{Request: PortForwardRequest{Kind: PodKind, Name: "api-0", Port: "8080"}, Pod: "api-0", Port: "8080"},
+		{Request: PortForwardRequest{Kind: PodKind, Name: "api-0", Port: "8080", Selector: "track=canary"}, IsErr: true},
+		{Request: PortForwardRequest{Kind: PodKind, Name: "missing", Port: "8080"}, IsErr: true},
+		// Deployments skip pods that aren't ready
+		{Request: PortForwardRequest{Kind: DeploymentKind, Name: "api", Port: "8080"}, Pod: "api-1", Port: "8080"},
+		{Request: PortForwardRequest{Kind: DeploymentKind, Name: "api", Port: "8080", Selector: "track=canary"}, Pod: "api-canary", Port: "8080"},
+		{Request: PortForwardRequest{Kind: DeploymentKind, Name: "api", Port: "8080", Selector: "track=beta"}, IsErr: true},
+		{Request: PortForwardRequest{Kind: DeploymentKind, Name: "missing", Port: "8080"}, IsErr: true},
+		{Request: PortForwardRequest{Kind: StatefulSetKind, Name: "ledger", Port: "9090"}, Pod: "ledger-0", Port: "9090"},
+		{Request: PortForwardRequest{Kind: StatefulSetKind, Name: "ledger", Ordinal: "1", Port: "9090"}, Pod: "ledger-1", Port: "9090"},
+		{Request: PortForwardRequest{Kind: StatefulSetKind, Name: "ledger", Ordinal: "2", Port: "9090"}, IsErr: true},
+		{Request: PortForwardRequest{Kind: "daemonset", Name: "agent", Port: "9090"}, IsErr: true},
+	}
+
+	for _, testCase := range testCases {
+		testCase.Request.Namespace = "default"
+		pod, port, err := getPodNameAndRemotePort(context.Background(), client, testCase.Request)
+		if testCase.IsErr {
+			if err == nil {
+				t.Errorf("Request: %s\nexpected error, got: %s:%s", testCase.Request, pod, port)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Request: %s\nunexpected error: %s", testCase.Request, err.Error())
+			continue
+		}
+		if pod != testCase.Pod || port != testCase.Port {
+			t.Errorf("Request: %s\nexpected: %s:%s\ngot: %s:%s", testCase.Request, testCase.Pod, testCase.Port, pod, port)
+		}
+	}
+}
+
+func TestGetRemotePort(t *testing.T) {
+	pod := newPod("api-1", true, map[string]string{"app": "api"})
+	pod.Spec.Containers = []v1.Container{
+		{Name: "api", Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 8080}, {Name: "grpc", ContainerPort: 50051}}},
+		{Name: "metrics", Ports: []v1.ContainerPort{{ContainerPort: 9102}}},
+	}
+	unnamed := newPod("worker-1", true, map[string]string{"app": "worker"})
+	client := newFakeClient(
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromString("http")},
+				{Name: "grpc", Port: 9090, TargetPort: intstr.FromString("grpc")},
+				{Name: "admin", Port: 9000, TargetPort: intstr.FromString("admin")},
+				{Name: "metrics", Port: 9102},
+			}},
+		},
+		newEndpoints("api", "api-1"),
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "worker", Namespace: "default"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80, TargetPort: intstr.FromInt(8080)}}},
+		},
+		newEndpoints("worker", "worker-1"),
+		pod,
+		unnamed,
+	)
+
+	testCases := []struct {
+		Request PortForwardRequest
+		Port    string
+		Err     string
+	}{
+		// Named target ports are looked up in the pod's containers
+		{Request: PortForwardRequest{Name: "api", Port: "80"}, Port: "8080"},
+		// Target ports default to the service port
+		{Request: PortForwardRequest{Name: "api", Port: "9102"}, Port: "9102"},
+		// The grpc port is used when the port is left out
+		{Request: PortForwardRequest{Name: "api"}, Port: "50051"},
+		{Request: PortForwardRequest{Kind: PodKind, Name: "api-1"}, Port: "50051"},
+		{Request: PortForwardRequest{Name: "api", Port: "81"}, Err: "Service api has no port 81, available ports: 80 (http), 9090 (grpc), 9000 (admin), 9102 (metrics)"},
+		{Request: PortForwardRequest{Name: "api", Port: "9000"}, Err: "Pod api-1 has no container port named admin, available ports: 8080 (http), 50051 (grpc), 9102"},
+		{Request: PortForwardRequest{Name: "worker"}, Err: "Service worker has no port named grpc, available ports: 80"},
+		{Request: PortForwardRequest{Kind: PodKind, Name: "worker-1"}, Err: "Pod worker-1 has no container port named grpc, available ports: none"},
+	}
+
+	for _, testCase := range testCases {
+		testCase.Request.Namespace = "default"
+		_, port, err := getPodNameAndRemotePort(context.Background(), client, testCase.Request)
+		if testCase.Err != "" {
+			if err == nil || err.Error() != testCase.Err {
+				t.Errorf("Request: %s\nexpected error: %s\ngot: %v", testCase.Request, testCase.Err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Request: %s\nunexpected error: %s", testCase.Request, err.Error())
+			continue
+		}
+		if port != testCase.Port {
+			t.Errorf("Request: %s\nexpected port: %s\ngot: %s", testCase.Request, testCase.Port, port)
+		}
+	}
+}
+
+func TestGetServiceEndpointPods(t *testing.T) {
+	apiLabels := map[string]string{"app": "api"}
+	terminating := newPod("api-0", true, apiLabels)
+	terminating.DeletionTimestamp = &metav1.Time{}
+	endpoints := newEndpoints("api", "api-0", "api-1", "api-2", "api-3")
+	// Addresses of external IPs aren't backed by pods
+	endpoints.Subsets[0].Addresses = append([]v1.EndpointAddress{{IP: "10.0.0.1"}}, endpoints.Subsets[0].Addresses...)
+	client := newFakeClient(
+		endpoints,
+		terminating,
+		newPod("api-1", false, apiLabels),
+		newPod("api-2", true, apiLabels),
+		newPod("api-3", true, apiLabels),
+	)
+	req := PortForwardRequest{Namespace: "default", Name: "api"}
+
+	// Pods are only looked up when the service has a selector
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api"}}
+	pods, err := getServiceEndpointPods(context.Background(), client, req, service, labels.Everything())
+	expected := []candidate{{name: "api-0"}, {name: "api-1"}, {name: "api-2"}, {name: "api-3"}}
+	if err != nil || !reflect.DeepEqual(pods, expected) {
+		t.Errorf("Expected: %v\ngot: %v, %v", expected, pods, err)
+	}
+
+	// Terminating pods and pods that aren't ready are skipped
+	service.Spec.Selector = apiLabels
+	pods, err = getServiceEndpointPods(context.Background(), client, req, service, labels.Everything())
+	expected = []candidate{{name: "api-2"}, {name: "api-3"}}
+	if err != nil || !reflect.DeepEqual(pods, expected) {
+		t.Errorf("Expected: %v\ngot: %v, %v", expected, pods, err)
+	}
+
+	endpoints.Subsets[0].Addresses = endpoints.Subsets[0].Addresses[:1]
+	if pods, err := getServiceEndpointPods(context.Background(), client, req, service, labels.Everything()); err == nil {
+		t.Errorf("Expected error for endpoints without pods, got: %v", pods)
+	}
+}
+
+func TestStartPortForwards(t *testing.T) {
+	apiLabels := map[string]string{"app": "api"}
+	client := newFakeClient(
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+			Spec: v1.ServiceSpec{
+				Selector: apiLabels,
+				Ports:    []v1.ServicePort{{Port: 80, TargetPort: intstr.FromInt(8080)}},
+			},
+		},
+		newEndpoints("api", "api-0", "api-1", "api-2"),
+		newPod("api-0", true, apiLabels),
+		newPod("api-1", false, apiLabels),
+		newPod("api-2", true, apiLabels),
+	)
+	req := PortForwardRequest{Namespace: "default", Name: "api", Port: "80"}
+
+	portForwards, err := startPortForwards(context.Background(), nil, req, client)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(portForwards) != 2 || portForwards["api-0"] == nil || portForwards["api-2"] == nil {
+		t.Errorf("Expected port forwards to the ready pods api-0 and api-2, got: %v", portForwards)
+	}
+	for pod, portForward := range portForwards {
+		if portForward.Pod() != pod || portForward.LocalPort() == "" {
+			t.Errorf("Expected a local port forwarded to %s, got: %s on %s", pod, portForward.Pod(), portForward.LocalPort())
+		}
+		portForward.Close()
+	}
+
+	// Callers that still set the deprecated Service field are forwarded to the same pods
+	portForwards, err = startPortForwards(context.Background(), nil, PortForwardRequest{Namespace: "default", Service: "api", Port: "80"}, client)
+	if err != nil || len(portForwards) != 2 {
+		t.Errorf("Expected port forwards to the ready pods of the service, got: %v, %v", portForwards, err)
+	}
+	for _, portForward := range portForwards {
+		portForward.Close()
+	}
+
+	// Every port forward fails if one of them does
+	client.unreachable = map[string]bool{"api-2": true}
+	if portForwards, err := startPortForwards(context.Background(), nil, req, client); err == nil {
+		t.Errorf("Expected error for an unreachable pod, got: %v", portForwards)
+	}
+}
@@ -0,0 +1,78 @@
+package k8
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Name of the port forwarded to when no port is requested.
+const grpcPortName = "grpc"
+
+// Returns the service port with the requested number, or the port named grpc if no port was
+// requested.
+func getServicePort(service *v1.Service, requested string) (v1.ServicePort, error) {
+	available := make([]string, len(service.Spec.Ports))
+	for i, port := range service.Spec.Ports {
+		if requested == "" && port.Name == grpcPortName || requested == strconv.Itoa(int(port.Port)) {
+			return port, nil
+		}
+		available[i] = formatPort(port.Port, port.Name)
+	}
+
+	wanted := "port " + requested
+	if requested == "" {
+		wanted = "port named " + grpcPortName
+	}
+	return v1.ServicePort{}, fmt.Errorf("Service %s has no %s, available ports: %s", service.Name, wanted, formatPorts(available))
+}
+
+// Returns the pod port that maps to the service port. Named target ports are looked up in the
+// pod's container ports, and the target port defaults to the service port when it's unset.
+func getPodPortFromServicePort(ctx context.Context, client k8Client, namespace, podName string, servicePort v1.ServicePort) (string, error) {
+	switch {
+	case servicePort.TargetPort.Type == intstr.String:
+		return getContainerPort(ctx, client, namespace, podName, servicePort.TargetPort.StrVal)
+	case servicePort.TargetPort.IntVal == 0:
+		return strconv.Itoa(int(servicePort.Port)), nil
+	default:
+		return strconv.Itoa(int(servicePort.TargetPort.IntVal)), nil
+	}
+}
+
+// Returns the number of the pod's container port with the name.
+func getContainerPort(ctx context.Context, client k8Client, namespace, podName, name string) (string, error) {
+	pod, err := client.Pod(ctx, namespace, podName)
+	if err != nil {
+		return "", err
+	}
+
+	var available []string
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Name == name {
+				return strconv.Itoa(int(port.ContainerPort)), nil
+			}
+			available = append(available, formatPort(port.ContainerPort, port.Name))
+		}
+	}
+	return "", fmt.Errorf("Pod %s has no container port named %s, available ports: %s", podName, name, formatPorts(available))
+}
+
+func formatPort(number int32, name string) string {
+	if name == "" {
+		return strconv.Itoa(int(number))
+	}
+	return fmt.Sprintf("%d (%s)", number, name)
+}
+
+func formatPorts(ports []string) string {
+	if len(ports) == 0 {
+		return "none"
+	}
+	return strings.Join(ports, ", ")
+}
@@ -0,0 +1,79 @@
+package k8
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/wearefair/gurl/pkg/log"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Key holding the CA bundle in a TLS secret. This isn't part of the kubernetes.io/tls type,
+// but is commonly added alongside the certificate, for example by cert-manager.
+const secretCAKey = "ca.crt"
+
+// SecretRequest wraps the information required to read a secret.
+type SecretRequest struct {
+	Context string
+	// Namespace the secret is in. Falls back to the context's namespace, then "default", if left blank.
+	Namespace string
+	// Secret name.
+	Name string
+}
+
+// String func to print the request.
+func (s SecretRequest) String() string {
+	return fmt.Sprintf("context: %s, namespace: %s, secret: %s", s.Context, s.Namespace, s.Name)
+}
+
+// TLSSecret holds the PEM encoded contents of a kubernetes.io/tls secret.
+type TLSSecret struct {
+	Cert []byte
+	Key  []byte
+	// CA is only set if the secret has a ca.crt entry.
+	CA []byte
+	// Namespace the secret was read from, after falling back to the context's namespace.
+	Namespace string
+}
+
+// LoadTLSSecret reads the client certificate, key and CA out of a kubernetes.io/tls secret.
+// Returns an error if the secret can't be read or is missing the certificate or key.
+func LoadTLSSecret(config clientcmd.ClientConfig, req SecretRequest) (*TLSSecret, error) {
+	newConfig, client, err := newK8ClientForContext(config, req.Context)
+	if err != nil {
+		return nil, err
+	}
+	return loadTLSSecret(context.Background(), newConfig, req, client)
+}
+
+// Helper for LoadTLSSecret that only takes interfaces so it can be mocked.
+func loadTLSSecret(ctx context.Context, config clientcmd.ClientConfig, req SecretRequest, client k8Client) (*TLSSecret, error) {
+	namespace, err := resolveNamespace(config, req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	req.Namespace = namespace
+
+	log.Infof("secret - reading TLS secret: %s", req)
+	secret, err := client.Secret(ctx, req.Namespace, req.Name)
+	if err != nil {
+		log.Errorf("secret - failed to get secret %s: %s", req.Name, err)
+		return nil, err
+	}
+	if secret.Type != v1.SecretTypeTLS {
+		log.Warningf("secret - %s has type %s, expected %s", req.Name, secret.Type, v1.SecretTypeTLS)
+	}
+
+	cert, key := secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]
+	if len(cert) == 0 || len(key) == 0 {
+		return nil, fmt.Errorf("Secret %s/%s must have both %s and %s", req.Namespace, req.Name, v1.TLSCertKey, v1.TLSPrivateKeyKey)
+	}
+	return &TLSSecret{
+		Cert:      cert,
+		Key:       key,
+		CA:        secret.Data[secretCAKey],
+		Namespace: req.Namespace,
+	}, nil
+}
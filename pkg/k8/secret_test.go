@@ -0,0 +1,105 @@
+package k8
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// k8Client that only serves secrets, keyed by namespace/name
+type secretClient struct {
+	k8Client
+	secrets map[string]*v1.Secret
+}
+
+func newSecretClient(secrets ...*v1.Secret) *secretClient {
+	client := &secretClient{secrets: make(map[string]*v1.Secret)}
+	for _, secret := range secrets {
+		client.secrets[secret.Namespace+"/"+secret.Name] = secret
+	}
+	return client
+}
+
+func (s *secretClient) Secret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	secret, ok := s.secrets[namespace+"/"+name]
+	if !ok {
+		return nil, fmt.Errorf("secrets %q not found", name)
+	}
+	return secret, nil
+}
+
+func TestLoadTLSSecret(t *testing.T) {
+	client := newSecretClient(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "client-tls", Namespace: "payments"},
+			Type:       v1.SecretTypeTLS,
+			Data: map[string][]byte{
+				v1.TLSCertKey:       []byte("cert"),
+				v1.TLSPrivateKeyKey: []byte("key"),
+				secretCAKey:         []byte("ca"),
+			},
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "client-tls", Namespace: "default"},
+			Type:       v1.SecretTypeTLS,
+			Data: map[string][]byte{
+				v1.TLSCertKey:       []byte("default-cert"),
+				v1.TLSPrivateKeyKey: []byte("default-key"),
+			},
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "no-key", Namespace: "default"},
+			Data:       map[string][]byte{v1.TLSCertKey: []byte("cert")},
+		},
+	)
+
+	testCases := []struct {
+		Namespace string
+		Name      string
+		Expected  *TLSSecret
+	}{
+		{
+			Namespace: "payments",
+			Name:      "client-tls",
+			Expected:  &TLSSecret{Cert: []byte("cert"), Key: []byte("key"), CA: []byte("ca"), Namespace: "payments"},
+		},
+		// Falls back to the default namespace
+		{
+			Name:     "client-tls",
+			Expected: &TLSSecret{Cert: []byte("default-cert"), Key: []byte("default-key"), Namespace: "default"},
+		},
+		{Name: "no-key"},
+		{Name: "missing"},
+	}
+
+	// A context without a namespace, so requests without one fall back to default
+	rawConfig := clientcmdapi.NewConfig()
+	rawConfig.Clusters["test"] = &clientcmdapi.Cluster{Server: "https://localhost:6443"}
+	rawConfig.AuthInfos["test"] = clientcmdapi.NewAuthInfo()
+	rawConfig.Contexts["test"] = &clientcmdapi.Context{Cluster: "test", AuthInfo: "test"}
+	rawConfig.CurrentContext = "test"
+	config := clientcmd.NewDefaultClientConfig(*rawConfig, &clientcmd.ConfigOverrides{})
+	for _, testCase := range testCases {
+		req := SecretRequest{Namespace: testCase.Namespace, Name: testCase.Name}
+		secret, err := loadTLSSecret(context.Background(), config, req, client)
+		if testCase.Expected == nil {
+			if err == nil {
+				t.Errorf("Expected error loading %s, got: %#v", req, secret)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error loading %s: %s", req, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(secret, testCase.Expected) {
+			t.Errorf("Expected: %#v\ngot: %#v", testCase.Expected, secret)
+		}
+	}
+}
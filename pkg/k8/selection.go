@@ -0,0 +1,154 @@
+package k8
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wearefair/gurl/pkg/log"
+)
+
+// Strategies for choosing which of the ready pods to forward to.
+const (
+	FirstStrategy      = "first"
+	RandomStrategy     = "random"
+	RoundRobinStrategy = "round-robin"
+)
+
+// Labels nodes are given with their zone, the current one and the deprecated one.
+var zoneLabels = []string{"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}
+
+// Overridable for tests.
+var (
+	randomIntn = rand.New(rand.NewSource(time.Now().UnixNano())).Intn
+	// Directory the round-robin count of each target is kept in, so consecutive runs take turns
+	roundRobinDir = func() (string, error) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, ".gurl", "round-robin"), nil
+	}
+)
+
+// A ready pod that can be forwarded to, along with the node it runs on.
+type candidate struct {
+	name string
+	node string
+}
+
+// Chooses which of the ready pods to forward to. A requested pod must be one of them.
+// Otherwise pods on the preferred node or zone are chosen from, if there are any, with the
+// request's strategy.
+func choosePod(ctx context.Context, client k8Client, req PortForwardRequest, candidates []candidate) (string, error) {
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].name < candidates[j].name })
+	if req.Pod != "" {
+		names := make([]string, len(candidates))
+		for i, candidate := range candidates {
+			if candidate.name == req.Pod {
+				return candidate.name, nil
+			}
+			names[i] = candidate.name
+		}
+		return "", fmt.Errorf("Pod %s isn't a ready pod of %s %s, ready pods: %s", req.Pod, req.kind(), req.Name, strings.Join(names, ", "))
+	}
+
+	candidates = preferredPods(ctx, client, req, candidates)
+	var chosen candidate
+	switch req.Strategy {
+	case "", FirstStrategy:
+		chosen = candidates[0]
+	case RandomStrategy:
+		chosen = candidates[randomIntn(len(candidates))]
+	case RoundRobinStrategy:
+		chosen = candidates[nextRoundRobin(req, len(candidates))]
+	default:
+		return "", fmt.Errorf("Unsupported pod strategy %s, expected %s, %s or %s", req.Strategy, FirstStrategy, RandomStrategy, RoundRobinStrategy)
+	}
+	log.Infof("port-forward - chose pod %s on node %s out of %d ready pods", chosen.name, chosen.node, len(candidates))
+	return chosen.name, nil
+}
+
+// Returns the pods on the preferred node and in the preferred zone, or every pod if none of
+// them are.
+func preferredPods(ctx context.Context, client k8Client, req PortForwardRequest, candidates []candidate) []candidate {
+	if req.PreferNode == "" && req.PreferZone == "" {
+		return candidates
+	}
+	zones := make(map[string]string)
+	var preferred []candidate
+	for _, candidate := range candidates {
+		if req.PreferNode != "" && candidate.node != req.PreferNode {
+			continue
+		}
+		if req.PreferZone != "" && nodeZone(ctx, client, candidate.node, zones) != req.PreferZone {
+			continue
+		}
+		preferred = append(preferred, candidate)
+	}
+	if len(preferred) == 0 {
+		log.Infof("port-forward - no ready pods on the preferred node or zone, choosing from all of them")
+		return candidates
+	}
+	return preferred
+}
+
+// Returns the zone of the node, caching it since pods share nodes. Nodes that can't be read,
+// for example without permission to, don't have a zone.
+func nodeZone(ctx context.Context, client k8Client, name string, zones map[string]string) string {
+	if name == "" {
+		return ""
+	}
+	if zone, ok := zones[name]; ok {
+		return zone
+	}
+	zone := ""
+	node, err := client.Node(ctx, name)
+	if err != nil {
+		log.Warningf("port-forward - failed to get the zone of node %s: %s", name, err)
+	} else {
+		for _, label := range zoneLabels {
+			if zone = node.Labels[label]; zone != "" {
+				break
+			}
+		}
+	}
+	zones[name] = zone
+	return zone
+}
+
+// Returns the index of the next pod to forward to, counting the runs for each target in a
+// file. Falls back to the first pod if the count can't be kept.
+func nextRoundRobin(req PortForwardRequest, count int) int {
+	dir, err := roundRobinDir()
+	if err != nil {
+		log.Infof("port-forward - not keeping the round-robin count: %s", err)
+		return 0
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{req.Context, req.Namespace, req.kind(), req.Name, req.Selector}, "\x00")))
+	path := filepath.Join(dir, hex.EncodeToString(sum[:]))
+
+	next := 0
+	if contents, err := ioutil.ReadFile(path); err == nil {
+		if last, err := strconv.Atoi(strings.TrimSpace(string(contents))); err == nil && last >= 0 {
+			next = last + 1
+		}
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err == nil {
+		err = ioutil.WriteFile(path, []byte(strconv.Itoa(next)), 0600)
+	}
+	if err != nil {
+		log.Infof("port-forward - not keeping the round-robin count: %s", err)
+	}
+	return next % count
+}
@@ -0,0 +1,84 @@
+package k8
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestChoosePod(t *testing.T) {
+	originalIntn := randomIntn
+	defer func() { randomIntn = originalIntn }()
+	randomIntn = func(n int) int { return n - 1 }
+
+	client := newFakeClient(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a", Labels: map[string]string{"topology.kubernetes.io/zone": "us-east-1a"}}},
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-b", Labels: map[string]string{"failure-domain.beta.kubernetes.io/zone": "us-east-1b"}}},
+	)
+	candidates := []candidate{{name: "api-2", node: "node-b"}, {name: "api-0", node: "node-a"}, {name: "api-1", node: "node-b"}, {name: "api-3", node: "node-c"}}
+
+	testCases := []struct {
+		Request  PortForwardRequest
+		Expected string
+		IsErr    bool
+	}{
+		{Request: PortForwardRequest{}, Expected: "api-0"},
+		{Request: PortForwardRequest{Strategy: FirstStrategy}, Expected: "api-0"},
+		{Request: PortForwardRequest{Strategy: RandomStrategy}, Expected: "api-3"},
+		{Request: PortForwardRequest{Pod: "api-2"}, Expected: "api-2"},
+		{Request: PortForwardRequest{Pod: "api-9"}, IsErr: true},
+		{Request: PortForwardRequest{PreferNode: "node-b"}, Expected: "api-1"},
+		{Request: PortForwardRequest{PreferNode: "node-b", Strategy: RandomStrategy}, Expected: "api-2"},
+		{Request: PortForwardRequest{PreferZone: "us-east-1b"}, Expected: "api-1"},
+		{Request: PortForwardRequest{PreferZone: "us-east-1a", PreferNode: "node-b"}, Expected: "api-0"},
+		// Falls back to every pod when none are preferred
+		{Request: PortForwardRequest{PreferZone: "eu-west-1a"}, Expected: "api-0"},
+		{Request: PortForwardRequest{Strategy: "least-loaded"}, IsErr: true},
+	}
+
+	for _, testCase := range testCases {
+		testCase.Request.Name = "api"
+		pod, err := choosePod(context.Background(), client, testCase.Request, candidates)
+		if testCase.IsErr {
+			if err == nil {
+				t.Errorf("Request: %#v\nexpected error, got: %s", testCase.Request, pod)
+			}
+			continue
+		}
+		if err != nil || pod != testCase.Expected {
+			t.Errorf("Request: %#v\nexpected: %s\ngot: %s, %v", testCase.Request, testCase.Expected, pod, err)
+		}
+	}
+}
+
+func TestChoosePodRoundRobin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gurl-round-robin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	originalDir := roundRobinDir
+	defer func() { roundRobinDir = originalDir }()
+	roundRobinDir = func() (string, error) { return dir, nil }
+
+	candidates := []candidate{{name: "api-1"}, {name: "api-0"}, {name: "api-2"}}
+	api := PortForwardRequest{Namespace: "default", Name: "api", Strategy: RoundRobinStrategy}
+	expected := []string{"api-0", "api-1", "api-2", "api-0"}
+	for i, want := range expected {
+		pod, err := choosePod(context.Background(), newFakeClient(), api, candidates)
+		if err != nil || pod != want {
+			t.Errorf("Run %d: expected %s, got: %s, %v", i, want, pod, err)
+		}
+	}
+
+	// Each target keeps its own count
+	other := api
+	other.Name = "worker"
+	if pod, _ := choosePod(context.Background(), newFakeClient(), other, candidates); pod != "api-0" {
+		t.Errorf("Expected a new target to start from the first pod, got: %s", pod)
+	}
+}
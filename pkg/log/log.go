@@ -43,6 +43,11 @@ func Infof(format string, args ...interface{}) {
 	}
 }
 
+// InfoEnabled reports whether info messages are logged, to skip building messages that won't be
+func InfoEnabled() bool {
+	return bool(glog.V(infoLevel))
+}
+
 func Warning(args ...interface{}) {
 	if glog.V(warnLevel) {
 		glog.Warning(args...)
@@ -0,0 +1,59 @@
+package log
+
+import (
+	"strings"
+	"sync"
+)
+
+// Redacted replaces sensitive values in logs
+const Redacted = "[REDACTED]"
+
+var (
+	mu sync.RWMutex
+	// Headers whose values are always masked
+	sensitiveHeaders = map[string]bool{
+		"authorization":       true,
+		"proxy-authorization": true,
+		"cookie":              true,
+		"set-cookie":          true,
+		"x-api-key":           true,
+	}
+)
+
+// AddSensitiveHeaders masks the values of more headers in logs, on top of the known sensitive
+// ones
+func AddSensitiveHeaders(names ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range names {
+		sensitiveHeaders[strings.ToLower(name)] = true
+	}
+}
+
+// SensitiveHeader reports whether the values of a header are masked in logs. Authorization,
+// cookies, API keys, headers ending in -token and headers added with AddSensitiveHeaders are
+// sensitive, along with their -bin variants.
+func SensitiveHeader(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), "-bin")
+	mu.RLock()
+	defer mu.RUnlock()
+	return sensitiveHeaders[name] || strings.HasSuffix(name, "-token")
+}
+
+// RedactHeaders returns a copy of the headers, or gRPC metadata, with the values of sensitive
+// headers masked
+func RedactHeaders(headers map[string][]string) map[string][]string {
+	redacted := make(map[string][]string, len(headers))
+	for name, vals := range headers {
+		if !SensitiveHeader(name) {
+			redacted[name] = vals
+			continue
+		}
+		masked := make([]string, len(vals))
+		for i := range vals {
+			masked[i] = Redacted
+		}
+		redacted[name] = masked
+	}
+	return redacted
+}
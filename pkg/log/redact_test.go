@@ -0,0 +1,45 @@
+package log
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactHeaders(t *testing.T) {
+	AddSensitiveHeaders("X-Session")
+	defer func() {
+		mu.Lock()
+		delete(sensitiveHeaders, "x-session")
+		mu.Unlock()
+	}()
+
+	headers := map[string][]string{
+		"authorization":  {"Bearer hunter2"},
+		"Cookie":         {"a=b", "c=d"},
+		"x-api-key":      {"key"},
+		"x-auth-token":   {"token"},
+		"x-token-bin":    {"dG9rZW4="},
+		"x-session":      {"session"},
+		"x-request-id":   {"abc"},
+		"content-type":   {"application/grpc"},
+		"x-tokenization": {"on"},
+	}
+	expected := map[string][]string{
+		"authorization":  {Redacted},
+		"Cookie":         {Redacted, Redacted},
+		"x-api-key":      {Redacted},
+		"x-auth-token":   {Redacted},
+		"x-token-bin":    {Redacted},
+		"x-session":      {Redacted},
+		"x-request-id":   {"abc"},
+		"content-type":   {"application/grpc"},
+		"x-tokenization": {"on"},
+	}
+	redacted := RedactHeaders(headers)
+	if !reflect.DeepEqual(redacted, expected) {
+		t.Errorf("Expected: %v\ngot: %v", expected, redacted)
+	}
+	if headers["authorization"][0] != "Bearer hunter2" {
+		t.Error("Expected the original headers to be unchanged")
+	}
+}
@@ -0,0 +1,310 @@
+package options
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wearefair/gurl/pkg/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Cached tokens are refreshed this long before they expire, so they don't expire mid-call
+const expiryDelta = 10 * time.Second
+
+// Overridable for tests
+var now = time.Now
+
+// Credentials selects where the token sent with every call comes from. Exactly one of Env, File,
+// Exec, OAuth2 or ServiceAccount must be set.
+type Credentials struct {
+	// Environment variable holding the token
+	Env string `yaml:"env"`
+	// File holding the token. It's read again if the token is rejected.
+	File string `yaml:"file"`
+	// Command that prints the token
+	Exec *ExecCredentials `yaml:"exec"`
+	// OAuth2 client credentials flow
+	OAuth2 *OAuth2Credentials `yaml:"oauth2"`
+	// JWTs signed with a service account's key
+	ServiceAccount *ServiceAccountCredentials `yaml:"service_account"`
+	// Header the token is sent in. Defaults to authorization.
+	Header string `yaml:"header"`
+	// Scheme the token is prefixed with. Defaults to Bearer for the authorization header.
+	Scheme string `yaml:"scheme"`
+}
+
+// ExecCredentials runs a command to get a token, like kubectl's exec credential plugins. The
+// command prints either the token, or an ExecCredential whose status holds the token and its
+// expirationTimestamp. Tokens are cached until they expire, or for the whole call if they
+// don't have an expiry.
+type ExecCredentials struct {
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+	// Environment variables set for the command on top of gurl's own
+	Env map[string]string `yaml:"env"`
+}
+
+// Fetches the token sent with calls
+type tokenSource interface {
+	token(ctx context.Context) (string, error)
+	// Drops the cached token after the server rejected it. Returns false if getting the
+	// token again wouldn't change it.
+	invalidate() bool
+}
+
+func (c *Credentials) source() (tokenSource, error) {
+	if set := c.sources(); len(set) > 1 {
+		return nil, fmt.Errorf("Credentials must set only one of env, file, exec, oauth2 or service_account, got %s", strings.Join(set, " and "))
+	}
+	switch {
+	case c.OAuth2 != nil:
+		return c.OAuth2.source()
+	case c.ServiceAccount != nil:
+		return c.ServiceAccount.source()
+	case c.Exec != nil:
+		if c.Exec.Command == "" {
+			return nil, fmt.Errorf("Credentials exec must set a command")
+		}
+		return &execToken{exec: c.Exec}, nil
+	case c.File != "":
+		return &fileToken{path: c.File}, nil
+	case c.Env != "":
+		return envToken(c.Env), nil
+	}
+	return nil, fmt.Errorf("Credentials must set env, file, exec, oauth2 or service_account")
+}
+
+// Returns the names of the token sources that are set
+func (c *Credentials) sources() []string {
+	var set []string
+	if c.Env != "" {
+		set = append(set, "env")
+	}
+	if c.File != "" {
+		set = append(set, "file")
+	}
+	if c.Exec != nil {
+		set = append(set, "exec")
+	}
+	if c.OAuth2 != nil {
+		set = append(set, "oauth2")
+	}
+	if c.ServiceAccount != nil {
+		set = append(set, "service_account")
+	}
+	return set
+}
+
+// Returns the header the token is sent in and its value
+func (c *Credentials) header(token string) (string, string) {
+	header := strings.ToLower(c.Header)
+	if header == "" {
+		header = "authorization"
+	}
+	scheme := c.Scheme
+	if scheme == "" && header == "authorization" {
+		scheme = "Bearer"
+	}
+	if scheme == "" {
+		return header, token
+	}
+	return header, scheme + " " + token
+}
+
+type envToken string
+
+func (e envToken) token(ctx context.Context) (string, error) {
+	token := strings.TrimSpace(getenv(string(e)))
+	if token == "" {
+		return "", fmt.Errorf("Environment variable %s holding the token is empty", string(e))
+	}
+	return token, nil
+}
+
+func (e envToken) invalidate() bool {
+	return false
+}
+
+type fileToken struct {
+	mu     sync.Mutex
+	path   string
+	cached string
+}
+
+func (f *fileToken) token(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cached != "" {
+		return f.cached, nil
+	}
+	contents, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return "", fmt.Errorf("Token file %s is empty", f.path)
+	}
+	f.cached = token
+	return token, nil
+}
+
+func (f *fileToken) invalidate() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cached = ""
+	return true
+}
+
+type execToken struct {
+	mu     sync.Mutex
+	exec   *ExecCredentials
+	cached string
+	// Zero if the token doesn't expire
+	expiry time.Time
+}
+
+// The parts of an ExecCredential that gurl reads
+type execCredential struct {
+	Status struct {
+		Token               string    `json:"token"`
+		ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+	} `json:"status"`
+}
+
+func (e *execToken) token(ctx context.Context) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.cached != "" && (e.expiry.IsZero() || now().Add(expiryDelta).Before(e.expiry)) {
+		return e.cached, nil
+	}
+
+	cmd := exec.CommandContext(ctx, e.exec.Command, e.exec.Args...)
+	cmd.Env = os.Environ()
+	for name, value := range e.exec.Env {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	// Lets the command prompt for a login
+	cmd.Stderr = os.Stderr
+	log.Infof("Getting token from %s", e.exec.Command)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Credentials command %s failed: %s", e.exec.Command, err)
+	}
+
+	output = bytes.TrimSpace(output)
+	token, expiry := string(output), time.Time{}
+	if bytes.HasPrefix(output, []byte("{")) {
+		credential := &execCredential{}
+		if err := json.Unmarshal(output, credential); err != nil {
+			return "", fmt.Errorf("Credentials command %s printed an invalid ExecCredential: %s", e.exec.Command, err)
+		}
+		token, expiry = credential.Status.Token, credential.Status.ExpirationTimestamp
+	}
+	if token == "" {
+		return "", fmt.Errorf("Credentials command %s didn't print a token", e.exec.Command)
+	}
+	e.cached, e.expiry = token, expiry
+	return token, nil
+}
+
+func (e *execToken) invalidate() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cached = ""
+	return true
+}
+
+// perRPCCredentials sends the token with every gRPC call. Implements
+// credentials.PerRPCCredentials.
+type perRPCCredentials struct {
+	credentials *Credentials
+	source      tokenSource
+}
+
+func newPerRPCCredentials(credentials *Credentials) (*perRPCCredentials, error) {
+	source, err := credentials.source()
+	if err != nil {
+		return nil, err
+	}
+	return &perRPCCredentials{credentials: credentials, source: source}, nil
+}
+
+func (p *perRPCCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := p.source.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	header, value := p.credentials.header(token)
+	return map[string]string{header: value}, nil
+}
+
+// Tokens are also sent over plaintext connections, which are mostly used for local servers
+func (p *perRPCCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// Calls again with a new token if the server rejects the call as unauthenticated
+func refreshInterceptor(source tokenSource) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if status.Code(err) == codes.Unauthenticated && source.invalidate() {
+			log.Infof("%s was unauthenticated, calling again with a new token", method)
+			err = invoker(ctx, method, req, reply, cc, opts...)
+		}
+		return err
+	}
+}
+
+// credentialsTransport sends the token with every HTTP request, and sends the request again
+// with a new token if it's rejected
+type credentialsTransport struct {
+	base        http.RoundTripper
+	credentials *perRPCCredentials
+}
+
+func (t *credentialsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.roundTrip(req)
+	if err != nil || !unauthenticated(resp) || (req.Body != nil && req.GetBody == nil) || !t.credentials.source.invalidate() {
+		return resp, err
+	}
+	resp.Body.Close()
+	log.Infof("%s was unauthenticated, sending it again with a new token", req.URL)
+
+	retry := req.Clone(req.Context())
+	if req.Body != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.roundTrip(retry)
+}
+
+func (t *credentialsTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	headers, err := t.credentials.GetRequestMetadata(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	// Round trippers mustn't modify the request
+	req = req.Clone(req.Context())
+	for header, value := range headers {
+		req.Header.Set(header, value)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// gRPC-Web responses carry the status in a header rather than the HTTP status
+func unauthenticated(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusUnauthorized || resp.Header.Get("Grpc-Status") == fmt.Sprint(int(codes.Unauthenticated))
+}
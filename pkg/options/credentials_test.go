@@ -0,0 +1,220 @@
+package options
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestCredentialsHeader(t *testing.T) {
+	testCases := []struct {
+		Credentials Credentials
+		Header      string
+		Value       string
+	}{
+		{Credentials: Credentials{}, Header: "authorization", Value: "Bearer token"},
+		{Credentials: Credentials{Scheme: "Basic"}, Header: "authorization", Value: "Basic token"},
+		{Credentials: Credentials{Header: "X-Api-Key"}, Header: "x-api-key", Value: "token"},
+	}
+	for _, testCase := range testCases {
+		header, value := testCase.Credentials.header("token")
+		if header != testCase.Header || value != testCase.Value {
+			t.Errorf("Credentials: %#v, expected %s: %s, got: %s: %s", testCase.Credentials, testCase.Header, testCase.Value, header, value)
+		}
+	}
+
+	if _, err := (&Credentials{}).source(); err == nil {
+		t.Error("Expected error for credentials without a source")
+	}
+	// Several sources are ambiguous rather than one taking precedence
+	ambiguous := []Credentials{
+		{Env: "TOKEN", File: "/token"},
+		{Env: "TOKEN", OAuth2: &OAuth2Credentials{TokenURL: "https://auth.example.com/token"}},
+		{Exec: &ExecCredentials{Command: "token-helper"}, ServiceAccount: &ServiceAccountCredentials{KeyFile: "key.json"}},
+	}
+	for _, credentials := range ambiguous {
+		if _, err := credentials.source(); err == nil || !strings.Contains(err.Error(), "only one of") {
+			t.Errorf("Credentials: %#v, expected an error for several sources, got: %v", credentials, err)
+		}
+	}
+}
+
+func TestEnvToken(t *testing.T) {
+	originalGetenv := getenv
+	defer func() { getenv = originalGetenv }()
+	env := map[string]string{"TOKEN": " secret\n"}
+	getenv = func(name string) string { return env[name] }
+
+	token, err := envToken("TOKEN").token(context.Background())
+	if err != nil || token != "secret" {
+		t.Errorf("Expected secret, got: %q, %v", token, err)
+	}
+	if _, err := envToken("MISSING").token(context.Background()); err == nil {
+		t.Error("Expected error for an empty environment variable")
+	}
+}
+
+func TestExecToken(t *testing.T) {
+	originalNow := now
+	defer func() { now = originalNow }()
+	current := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+
+	dir, err := ioutil.TempDir("", "gurl-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Prints an ExecCredential and counts how many times it's run
+	script := `echo run >> "$COUNT"; echo '{"status": {"token": "'"$TOKEN"'", "expirationTimestamp": "2021-01-01T01:00:00Z"}}'`
+	source := &execToken{exec: &ExecCredentials{
+		Command: "sh",
+		Args:    []string{"-c", script},
+		Env:     map[string]string{"COUNT": filepath.Join(dir, "count"), "TOKEN": "secret"},
+	}}
+	runs := func() int {
+		contents, _ := ioutil.ReadFile(filepath.Join(dir, "count"))
+		return strings.Count(string(contents), "run")
+	}
+
+	for i, step := range []struct {
+		At   time.Time
+		Runs int
+	}{
+		{At: current, Runs: 1},
+		// Cached until shortly before it expires
+		{At: current.Add(50 * time.Minute), Runs: 1},
+		{At: current.Add(59*time.Minute + 55*time.Second), Runs: 2},
+	} {
+		current = step.At
+		token, err := source.token(context.Background())
+		if err != nil || token != "secret" {
+			t.Errorf("Step %d: expected secret, got: %q, %v", i, token, err)
+		}
+		if runs() != step.Runs {
+			t.Errorf("Step %d: expected %d runs, got: %d", i, step.Runs, runs())
+		}
+	}
+	if !source.invalidate() {
+		t.Error("Expected exec tokens to be refreshable")
+	}
+	source.token(context.Background())
+	if runs() != 3 {
+		t.Errorf("Expected the command to run again after invalidating, got: %d runs", runs())
+	}
+
+	// Plain tokens are accepted too
+	plain := &execToken{exec: &ExecCredentials{Command: "echo", Args: []string{"plain"}}}
+	if token, err := plain.token(context.Background()); err != nil || token != "plain" {
+		t.Errorf("Expected plain, got: %q, %v", token, err)
+	}
+
+	for _, exec := range []*ExecCredentials{
+		{Command: "false"},
+		{Command: "echo", Args: []string{`{"status": {}}`}},
+	} {
+		source := &execToken{exec: exec}
+		if _, err := source.token(context.Background()); err == nil {
+			t.Errorf("Expected error running %s %v", exec.Command, exec.Args)
+		}
+	}
+}
+
+func TestPerRPCCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gurl-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rejects the old token and rotates the file, like a token refresher would
+	var tokens []string
+	checkToken := func(token string) bool {
+		tokens = append(tokens, token)
+		if token != "Bearer new" {
+			ioutil.WriteFile(tokenFile, []byte("new"), 0600)
+			return false
+		}
+		return true
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if !checkToken(strings.Join(md.Get("authorization"), ",")) {
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		}
+		return handler(ctx, req)
+	}))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	defer server.Stop()
+
+	_, err = callHealth(Options{Credentials: &Credentials{File: tokenFile}}, listener.Addr().String())
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if expected := []string{"Bearer old", "Bearer new"}; fmt.Sprint(tokens) != fmt.Sprint(expected) {
+		t.Errorf("Expected tokens %v, got: %v", expected, tokens)
+	}
+
+	// Tokens that can't be refreshed aren't sent again
+	tokens = nil
+	os.Setenv("GURL_TEST_TOKEN", "stale")
+	defer os.Unsetenv("GURL_TEST_TOKEN")
+	_, err = callHealth(Options{Credentials: &Credentials{Env: "GURL_TEST_TOKEN"}}, listener.Addr().String())
+	if status.Code(err) != codes.Unauthenticated || len(tokens) != 1 {
+		t.Errorf("Expected a single unauthenticated call, got: %v after %d calls", err, len(tokens))
+	}
+
+	// HTTP requests are sent again with a new token too
+	tokens = nil
+	ioutil.WriteFile(tokenFile, []byte("old"), 0600)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if !checkToken(r.Header.Get("Authorization")) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write(body)
+	}))
+	defer httpServer.Close()
+	client, err := Options{Credentials: &Credentials{File: tokenFile}}.HTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Post(httpServer.URL, "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("Expected the body to be sent again, got: %s %q", resp.Status, body)
+	}
+	if expected := []string{"Bearer old", "Bearer new"}; fmt.Sprint(tokens) != fmt.Sprint(expected) {
+		t.Errorf("Expected tokens %v, got: %v", expected, tokens)
+	}
+}
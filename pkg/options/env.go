@@ -0,0 +1,17 @@
+package options
+
+import "os"
+
+// Reads the environment, for credentials and proxies. Overridden in tests.
+var getenv = os.Getenv
+
+// Returns value, or if it's blank the first of the environment variables that's set
+func firstEnv(value string, names ...string) string {
+	for _, name := range names {
+		if value != "" {
+			break
+		}
+		value = getenv(name)
+	}
+	return value
+}
@@ -0,0 +1,126 @@
+package options
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wearefair/gurl/pkg/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// HedgingPolicy sends several attempts of a call without waiting for the earlier ones to fail,
+// following the hedging policy in gRPC's service config. The first attempt that succeeds or
+// fails with a fatal code is used, and the rest are cancelled.
+type HedgingPolicy struct {
+	// Attempts to make, including the first. 1 or less never hedges.
+	MaxAttempts int
+	// Delay between sending attempts. Zero sends every attempt at once.
+	HedgingDelay time.Duration
+	// Status codes that don't end the call, so the next attempt is sent straight away
+	NonFatalCodes []codes.Code
+}
+
+func (h *HedgingPolicy) nonFatal(code codes.Code) bool {
+	for _, nonFatal := range h.NonFatalCodes {
+		if code == nonFatal {
+			return true
+		}
+	}
+	return false
+}
+
+// Result of one hedged attempt
+type hedgedAttempt struct {
+	attempt int
+	reply   interface{}
+	err     error
+}
+
+// Interceptor that hedges unary calls with the policy returned for their method
+func hedgingInterceptor(policyFor func(method string) *HedgingPolicy) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		policy := policyFor(method)
+		if policy == nil || policy.MaxAttempts <= 1 {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		// Cancels the attempts that are still running once one of them is used
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		results := make(chan hedgedAttempt, policy.MaxAttempts)
+		var (
+			sent, running int
+			// Fires when the next attempt is due, or nil once every attempt is sent
+			next <-chan time.Time
+		)
+		send := func() {
+			sent++
+			running++
+			attempt, attemptReply := sent, newReply(reply)
+			go func() {
+				err := invoker(ctx, method, req, attemptReply, cc, opts...)
+				results <- hedgedAttempt{attempt: attempt, reply: attemptReply, err: err}
+			}()
+			next = nil
+			if sent < policy.MaxAttempts {
+				next = time.After(policy.HedgingDelay)
+			}
+		}
+
+		send()
+		var err error
+		for running > 0 {
+			select {
+			case <-next:
+				log.Infof("hedging - no response after %s, sending attempt %d of %d", policy.HedgingDelay, sent+1, policy.MaxAttempts)
+				send()
+			case result := <-results:
+				running--
+				if result.err == nil {
+					return copyReply(result.reply, reply)
+				}
+				err = result.err
+				code := status.Code(err)
+				if !policy.nonFatal(code) {
+					return err
+				}
+				// Non-fatal failures send the next attempt without waiting for the delay
+				if sent < policy.MaxAttempts {
+					log.Warningf("hedging - attempt %d of %d failed with %s, sending attempt %d", result.attempt, policy.MaxAttempts, code, sent+1)
+					send()
+				}
+			}
+		}
+		return err
+	}
+}
+
+// Returns an empty message of the same type as the reply, so each attempt has its own
+func newReply(reply interface{}) interface{} {
+	if message, ok := reply.(*dynamic.Message); ok {
+		return dynamic.NewMessage(message.GetMessageDescriptor())
+	}
+	return reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+}
+
+// Copies the winning attempt's reply into the caller's reply
+func copyReply(from, to interface{}) error {
+	fromMessage, ok := from.(proto.Message)
+	if !ok {
+		return status.Errorf(codes.Internal, "hedging - reply %T isn't a proto.Message", from)
+	}
+	toMessage, ok := to.(proto.Message)
+	if !ok {
+		return status.Errorf(codes.Internal, "hedging - reply %T isn't a proto.Message", to)
+	}
+	encoded, err := proto.Marshal(fromMessage)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(encoded, toMessage)
+}
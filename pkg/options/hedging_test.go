@@ -0,0 +1,121 @@
+package options
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestHedgingInterceptor(t *testing.T) {
+	// Answers that make an attempt hang until it's cancelled
+	hang := status.Error(codes.DeadlineExceeded, "hang")
+
+	testCases := []struct {
+		Name string
+		// What the server answers each attempt with, in the order they arrive. Attempts past
+		// the end succeed.
+		Answers []error
+		Policy  *HedgingPolicy
+		Code    codes.Code
+		// Attempts the server should see, and how many of them should be cancelled
+		Attempts  int
+		Cancelled int
+	}{
+		{
+			Name:      "hedges a slow attempt and cancels it",
+			Answers:   []error{hang},
+			Policy:    &HedgingPolicy{MaxAttempts: 3, HedgingDelay: 20 * time.Millisecond},
+			Code:      codes.OK,
+			Attempts:  2,
+			Cancelled: 1,
+		},
+		{
+			Name:     "non-fatal codes send the next attempt without waiting",
+			Answers:  []error{status.Error(codes.Unavailable, "down")},
+			Policy:   &HedgingPolicy{MaxAttempts: 3, HedgingDelay: time.Hour, NonFatalCodes: []codes.Code{codes.Unavailable}},
+			Code:     codes.OK,
+			Attempts: 2,
+		},
+		{
+			Name:     "fatal codes end the call",
+			Answers:  []error{status.Error(codes.Internal, "broken")},
+			Policy:   &HedgingPolicy{MaxAttempts: 3, HedgingDelay: time.Hour, NonFatalCodes: []codes.Code{codes.Unavailable}},
+			Code:     codes.Internal,
+			Attempts: 1,
+		},
+		{
+			Name:     "gives up after the max attempts",
+			Answers:  []error{status.Error(codes.Unavailable, "down"), status.Error(codes.Unavailable, "down"), status.Error(codes.Unavailable, "down")},
+			Policy:   &HedgingPolicy{MaxAttempts: 3, NonFatalCodes: []codes.Code{codes.Unavailable}},
+			Code:     codes.Unavailable,
+			Attempts: 3,
+		},
+	}
+
+	for _, testCase := range testCases {
+		var (
+			mu                  sync.Mutex
+			attempts, cancelled int
+			done                sync.WaitGroup
+		)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			done.Add(1)
+			defer done.Done()
+			mu.Lock()
+			attempt := attempts
+			attempts++
+			mu.Unlock()
+			if attempt >= len(testCase.Answers) {
+				return handler(ctx, req)
+			}
+			if testCase.Answers[attempt] == hang {
+				<-ctx.Done()
+				mu.Lock()
+				cancelled++
+				mu.Unlock()
+				return nil, ctx.Err()
+			}
+			return nil, testCase.Answers[attempt]
+		}))
+		healthpb.RegisterHealthServer(server, health.NewServer())
+		go server.Serve(listener)
+
+		response, err := callHealthWithHedging(testCase.Policy, listener.Addr().String())
+		// Wait for the server to see the cancelled attempts
+		done.Wait()
+		server.Stop()
+		if status.Code(err) != testCase.Code {
+			t.Errorf("%s: expected %s, got: %v", testCase.Name, testCase.Code, err)
+		}
+		if err == nil && response.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("%s: expected the winning attempt's response, got: %v", testCase.Name, response)
+		}
+		if attempts != testCase.Attempts || cancelled != testCase.Cancelled {
+			t.Errorf("%s: expected %d attempts with %d cancelled, got: %d with %d cancelled", testCase.Name, testCase.Attempts, testCase.Cancelled, attempts, cancelled)
+		}
+	}
+}
+
+// Calls the health server with only the hedging interceptor, since Options has no field for a
+// hedging policy outside of the service config
+func callHealthWithHedging(policy *HedgingPolicy, target string) (*healthpb.HealthCheckResponse, error) {
+	interceptor := hedgingInterceptor(func(method string) *HedgingPolicy { return policy })
+	conn, err := grpc.Dial(target, grpc.WithInsecure(), grpc.WithUnaryInterceptor(interceptor))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+}
@@ -0,0 +1,255 @@
+package options
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wearefair/gurl/pkg/log"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"golang.org/x/oauth2/jws"
+)
+
+// How long self-signed JWTs are valid for
+const jwtLifetime = time.Hour
+
+// Directory tokens are cached in until they expire. Overridable for tests.
+var tokenCacheDir = func() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".gurl", "tokens"), nil
+}
+
+// OAuth2Credentials gets tokens with the OAuth2 client credentials flow
+type OAuth2Credentials struct {
+	TokenURL string `yaml:"token_url"`
+	ClientID string `yaml:"client_id"`
+	// The client secret, or the environment variable holding it
+	ClientSecret    string   `yaml:"client_secret"`
+	ClientSecretEnv string   `yaml:"client_secret_env"`
+	Scopes          []string `yaml:"scopes"`
+	// Audience parameter sent to the token endpoint, which some providers require
+	Audience string `yaml:"audience"`
+}
+
+// ServiceAccountCredentials signs JWTs with the private key of a service account, which are
+// sent as the token without exchanging them first
+type ServiceAccountCredentials struct {
+	// JSON key file of the service account, with its client_email, private_key_id and
+	// private_key
+	KeyFile string `yaml:"key_file"`
+	// Audience of the JWT, usually the URL of the service
+	Audience string `yaml:"audience"`
+	// Scopes claimed by the JWT, for services that accept scopes instead of an audience
+	Scopes []string `yaml:"scopes"`
+}
+
+func (o *OAuth2Credentials) source() (tokenSource, error) {
+	if o.TokenURL == "" || o.ClientID == "" {
+		return nil, fmt.Errorf("OAuth2 credentials must set a token URL and client ID")
+	}
+	secret := o.ClientSecret
+	if o.ClientSecretEnv != "" {
+		secret = getenv(o.ClientSecretEnv)
+		if secret == "" {
+			return nil, fmt.Errorf("OAuth2 client secret environment variable %s is not set", o.ClientSecretEnv)
+		}
+	}
+	config := &clientcredentials.Config{
+		ClientID:     o.ClientID,
+		ClientSecret: secret,
+		TokenURL:     o.TokenURL,
+		Scopes:       o.Scopes,
+	}
+	if o.Audience != "" {
+		config.EndpointParams = map[string][]string{"audience": {o.Audience}}
+	}
+	// The secret is part of the key so changing it fetches a new token, and it's hashed so it
+	// isn't readable from the cache's file names
+	key := cacheKey("oauth2", o.TokenURL, o.ClientID, secret, o.Audience, strings.Join(o.Scopes, " "))
+	return &cachedToken{key: key, fetch: func(ctx context.Context) (*oauth2.Token, error) {
+		log.Infof("Getting OAuth2 token from %s", o.TokenURL)
+		token, err := config.Token(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get OAuth2 token from %s: %s", o.TokenURL, err)
+		}
+		return token, nil
+	}}, nil
+}
+
+// The fields of a service account key file that are needed to sign JWTs
+type serviceAccountKey struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+}
+
+func (s *ServiceAccountCredentials) source() (tokenSource, error) {
+	if s.KeyFile == "" {
+		return nil, fmt.Errorf("Service account credentials must set a key file")
+	}
+	if s.Audience == "" && len(s.Scopes) == 0 {
+		return nil, fmt.Errorf("Service account credentials must set an audience or scopes")
+	}
+	contents, err := ioutil.ReadFile(s.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	account := &serviceAccountKey{}
+	if err := json.Unmarshal(contents, account); err != nil {
+		return nil, fmt.Errorf("Invalid service account key file %s: %s", s.KeyFile, err)
+	}
+	privateKey, err := parseRSAKey([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid private key in %s: %s", s.KeyFile, err)
+	}
+
+	key := cacheKey("jwt", account.ClientEmail, account.PrivateKeyID, s.Audience, strings.Join(s.Scopes, " "))
+	return &cachedToken{key: key, fetch: func(ctx context.Context) (*oauth2.Token, error) {
+		issued := now()
+		claims := &jws.ClaimSet{
+			Iss:   account.ClientEmail,
+			Sub:   account.ClientEmail,
+			Aud:   s.Audience,
+			Scope: strings.Join(s.Scopes, " "),
+			Iat:   issued.Unix(),
+			Exp:   issued.Add(jwtLifetime).Unix(),
+		}
+		header := &jws.Header{Algorithm: "RS256", Typ: "JWT", KeyID: account.PrivateKeyID}
+		signed, err := jws.Encode(header, claims, privateKey)
+		if err != nil {
+			return nil, err
+		}
+		return &oauth2.Token{AccessToken: signed, TokenType: "Bearer", Expiry: issued.Add(jwtLifetime)}, nil
+	}}, nil
+}
+
+// Parses a PEM encoded PKCS#8 or PKCS#1 RSA private key
+func parseRSAKey(contents []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key isn't an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// Names the cache file of a token by hashing what it was fetched with
+func cacheKey(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedToken caches tokens in memory and on disk until they expire, so they're shared
+// between calls
+type cachedToken struct {
+	mu     sync.Mutex
+	key    string
+	fetch  func(ctx context.Context) (*oauth2.Token, error)
+	cached *oauth2.Token
+}
+
+func (c *cachedToken) token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.valid(c.cached) {
+		return c.cached.AccessToken, nil
+	}
+	if token := c.read(); c.valid(token) {
+		c.cached = token
+		return token.AccessToken, nil
+	}
+
+	token, err := c.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.cached = token
+	c.write(token)
+	return token.AccessToken, nil
+}
+
+func (c *cachedToken) invalidate() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cached = nil
+	if path, err := c.path(); err == nil {
+		os.Remove(path)
+	}
+	return true
+}
+
+// Tokens without an expiry are only cached in memory
+func (c *cachedToken) valid(token *oauth2.Token) bool {
+	return token != nil && token.AccessToken != "" && (token.Expiry.IsZero() || now().Add(expiryDelta).Before(token.Expiry))
+}
+
+func (c *cachedToken) path() (string, error) {
+	dir, err := tokenCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, c.key+".json"), nil
+}
+
+func (c *cachedToken) read() *oauth2.Token {
+	path, err := c.path()
+	if err != nil {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	token := &oauth2.Token{}
+	if err := json.Unmarshal(contents, token); err != nil || token.Expiry.IsZero() {
+		return nil
+	}
+	return token
+}
+
+// Failing to cache the token only means it's fetched again next time, so errors are logged
+func (c *cachedToken) write(token *oauth2.Token) {
+	if token.Expiry.IsZero() {
+		return
+	}
+	path, err := c.path()
+	if err != nil {
+		log.Infof("Not caching token: %s", err)
+		return
+	}
+	contents, err := json.Marshal(token)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(path, contents, 0600)
+	}
+	if err != nil {
+		log.Infof("Not caching token: %s", err)
+	}
+}
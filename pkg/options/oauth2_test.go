@@ -0,0 +1,196 @@
+package options
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2/jws"
+)
+
+// Points the token cache at a temporary directory, returning a func that restores it
+func tempTokenCache(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "gurl-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := tokenCacheDir
+	tokenCacheDir = func() (string, error) { return dir, nil }
+	return func() {
+		tokenCacheDir = original
+		os.RemoveAll(dir)
+	}
+}
+
+func TestOAuth2Credentials(t *testing.T) {
+	defer tempTokenCache(t)()
+	originalGetenv := getenv
+	defer func() { getenv = originalGetenv }()
+	getenv = func(name string) string { return map[string]string{"CLIENT_SECRET": "hunter2"}[name] }
+
+	// Stand-in for a token endpoint
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		id, secret, _ := r.BasicAuth()
+		r.ParseForm()
+		if id != "gurl" || secret != "hunter2" || r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("scope") != "read write" || r.Form.Get("audience") != "api" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "invalid_client"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "token-1", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+
+	credentials := &OAuth2Credentials{
+		TokenURL:        server.URL,
+		ClientID:        "gurl",
+		ClientSecretEnv: "CLIENT_SECRET",
+		Scopes:          []string{"read", "write"},
+		Audience:        "api",
+	}
+	for i := 0; i < 2; i++ {
+		// Each source stands in for a separate run of gurl, sharing the cache on disk
+		source, err := credentials.source()
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := source.token(context.Background())
+		if err != nil || token != "token-1" {
+			t.Errorf("Run %d: expected token-1, got: %q, %v", i, token, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected the token to be cached, got: %d requests", requests)
+	}
+
+	// Invalidating drops the cached token
+	source, _ := credentials.source()
+	source.invalidate()
+	source.token(context.Background())
+	if requests != 2 {
+		t.Errorf("Expected the token to be fetched again, got: %d requests", requests)
+	}
+
+	// Expired tokens are fetched again
+	originalNow := now
+	defer func() { now = originalNow }()
+	now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	source, _ = credentials.source()
+	source.token(context.Background())
+	if requests != 3 {
+		t.Errorf("Expected an expired token to be fetched again, got: %d requests", requests)
+	}
+	now = originalNow
+
+	credentials.ClientSecretEnv = ""
+	credentials.ClientSecret = "wrong"
+	source, _ = credentials.source()
+	if _, err := source.token(context.Background()); err == nil {
+		t.Error("Expected error for an invalid client secret")
+	}
+
+	if _, err := (&OAuth2Credentials{ClientID: "gurl"}).source(); err == nil {
+		t.Error("Expected error for OAuth2 credentials without a token URL")
+	}
+
+	// A missing secret is reported before asking the token endpoint
+	credentials.ClientSecretEnv = "MISSING_SECRET"
+	if _, err := credentials.source(); err == nil || !strings.Contains(err.Error(), "MISSING_SECRET") {
+		t.Errorf("Expected an error naming the unset variable, got: %v", err)
+	}
+}
+
+func TestServiceAccountCredentials(t *testing.T) {
+	defer tempTokenCache(t)()
+	originalNow := now
+	defer func() { now = originalNow }()
+	issued := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return issued }
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := writeServiceAccountKey(t, privateKey)
+	defer os.Remove(keyFile)
+
+	credentials := &ServiceAccountCredentials{KeyFile: keyFile, Audience: "https://api.example.com/"}
+	source, err := credentials.source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := source.token(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err := jws.Verify(token, &privateKey.PublicKey); err != nil {
+		t.Errorf("Expected a JWT signed by the service account, got: %s", err.Error())
+	}
+	claims, err := jws.Decode(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := jws.ClaimSet{
+		Iss: "gurl@example.iam.gserviceaccount.com",
+		Sub: "gurl@example.iam.gserviceaccount.com",
+		Aud: "https://api.example.com/",
+		Iat: issued.Unix(),
+		Exp: issued.Add(time.Hour).Unix(),
+	}
+	if !reflect.DeepEqual(*claims, expected) {
+		t.Errorf("Expected claims: %#v\ngot: %#v", expected, *claims)
+	}
+
+	// Signed tokens are cached until they expire
+	source, _ = credentials.source()
+	if cached, _ := source.token(context.Background()); cached != token {
+		t.Error("Expected the JWT to be cached")
+	}
+
+	invalid := []*ServiceAccountCredentials{
+		{Audience: "https://api.example.com/"},
+		{KeyFile: keyFile},
+		{KeyFile: "missing.json", Audience: "https://api.example.com/"},
+	}
+	for _, credentials := range invalid {
+		if _, err := credentials.source(); err == nil {
+			t.Errorf("Expected error for %#v", credentials)
+		}
+	}
+}
+
+func writeServiceAccountKey(t *testing.T, privateKey *rsa.PrivateKey) string {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "gurl@example.iam.gserviceaccount.com",
+		"private_key_id": "key-1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(os.TempDir(), "gurl-service-account.json")
+	if err := ioutil.WriteFile(keyFile, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return keyFile
+}
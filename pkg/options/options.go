@@ -3,9 +3,20 @@ package options
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
 
+	"github.com/wearefair/gurl/pkg/log"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	// Registers the gzip compressor
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -13,18 +24,146 @@ type Options struct {
 	Metadata   metadata.MD
 	TLS        *TLS
 	Kubernetes *Kubernetes
+	// Deadline for the whole call. Zero means no deadline.
+	MaxTime time.Duration
+	// How long to wait for the connection to be established. Zero dials in the background,
+	// so connection errors only surface when the call is made.
+	ConnectTimeout time.Duration
+	Keepalive      Keepalive
+	// Network to dial the target on. Blank uses gRPC's TCP dialer, unix dials a Unix domain
+	// socket.
+	Network string
+	// URL of an http, socks5 or socks5h proxy to connect through. Blank uses HTTPS_PROXY or
+	// ALL_PROXY from the environment. Hosts in NO_PROXY are connected to directly either way.
+	Proxy string
+	// Hostname of the target, which NO_PROXY is matched against as well as the addresses it
+	// resolves to, such as the IPs dialled for dns:/// targets. Blank only matches addresses.
+	Host string
+	// Compressor to compress requests with, such as gzip. Blank sends requests uncompressed.
+	Compressor string
+	// Largest message that can be sent or received in bytes. Zero uses gRPC's defaults, which
+	// are unlimited for sending and 4MB for receiving.
+	MaxSendMsgSize int
+	MaxRecvMsgSize int
+	// Load balancing policy to spread calls across the resolved addresses with, such as
+	// round_robin. Blank uses gRPC's default, pick_first, or the service config's policy.
+	LoadBalancingPolicy string
+	// gRPC service config JSON, for load balancing, method timeouts, retries and hedging. Retry
+	// and hedging policies are applied by gurl, so they work without GRPC_GO_RETRY=on.
+	ServiceConfig string
+	// Retry policy for every call. Takes precedence over retry and hedging policies in the
+	// service config.
+	Retry *RetryPolicy
+	// Where the token sent with every call comes from. Nil sends no token.
+	Credentials *Credentials
 }
 
+// Keepalive controls the HTTP/2 pings sent to keep the connection alive. Zero values use
+// gRPC's defaults.
+type Keepalive struct {
+	// How long the connection can be idle before a ping is sent
+	Time time.Duration
+	// How long to wait for a ping to be acknowledged before closing the connection
+	Timeout time.Duration
+}
+
+// DialOptions returns the options to dial with. Problems with the options, such as an
+// unreadable certificate, fail every dial with the problem rather than being returned, so use
+// DialOptionsE to find out about them before dialing.
 func (o Options) DialOptions() []grpc.DialOption {
+	options, err := o.DialOptionsE()
+	if err != nil {
+		log.Errorf("options - invalid dial options: %s", err)
+		return []grpc.DialOption{
+			grpc.WithInsecure(),
+			grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+				return nil, err
+			}),
+		}
+	}
+	return options
+}
+
+// DialOptionsE returns the options to dial with, or the problem with the options
+func (o Options) DialOptionsE() ([]grpc.DialOption, error) {
 	options := make([]grpc.DialOption, 0)
 
 	if o.TLS == nil {
 		options = append(options, grpc.WithInsecure())
 	} else {
-		options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(o.TLS.Config())))
+		config, err := o.TLS.ConfigE()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(config)))
 	}
 
-	return options
+	if o.ConnectTimeout > 0 {
+		options = append(options, grpc.WithBlock())
+	}
+	options = append(options, grpc.WithContextDialer(o.dial))
+	if o.Network == "unix" {
+		// The socket path isn't a valid :authority
+		options = append(options, grpc.WithAuthority("localhost"))
+	}
+	callOptions := make([]grpc.CallOption, 0)
+	if o.Compressor != "" {
+		if encoding.GetCompressor(o.Compressor) == nil {
+			return nil, fmt.Errorf("Unsupported compressor %q, must be gzip", o.Compressor)
+		}
+		callOptions = append(callOptions, grpc.UseCompressor(o.Compressor))
+	}
+	if o.MaxSendMsgSize > 0 {
+		callOptions = append(callOptions, grpc.MaxCallSendMsgSize(o.MaxSendMsgSize))
+	}
+	if o.MaxRecvMsgSize > 0 {
+		callOptions = append(callOptions, grpc.MaxCallRecvMsgSize(o.MaxRecvMsgSize))
+	}
+	if len(callOptions) != 0 {
+		options = append(options, grpc.WithDefaultCallOptions(callOptions...))
+	}
+	options = append(options, grpc.WithStatsHandler(wireSizeLogger{}))
+
+	serviceConfig, err := parseServiceConfig(o.ServiceConfig, o.LoadBalancingPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if serviceConfig.grpc != "" {
+		options = append(options, grpc.WithDefaultServiceConfig(serviceConfig.grpc))
+	}
+	interceptors := []grpc.UnaryClientInterceptor{
+		hedgingInterceptor(func(method string) *HedgingPolicy {
+			// Methods are either retried or hedged, and the retry policy takes precedence
+			if o.Retry != nil {
+				return nil
+			}
+			return serviceConfig.hedgingPolicy(method)
+		}),
+		retryInterceptor(func(method string) *RetryPolicy {
+			if o.Retry != nil {
+				return o.Retry
+			}
+			return serviceConfig.retryPolicy(method)
+		}),
+	}
+	if o.Credentials != nil {
+		perRPC, err := newPerRPCCredentials(o.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, grpc.WithPerRPCCredentials(perRPC))
+		// Each retry gets a new token if the token was rejected
+		interceptors = append(interceptors, refreshInterceptor(perRPC.source))
+	}
+	options = append(options, grpc.WithChainUnaryInterceptor(interceptors...))
+	if o.Keepalive.Time > 0 || o.Keepalive.Timeout > 0 {
+		options = append(options, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    o.Keepalive.Time,
+			Timeout: o.Keepalive.Timeout,
+		}))
+	}
+
+	return options, nil
 }
 
 func (o Options) ContextWithOptions(ctx context.Context) context.Context {
@@ -35,18 +174,202 @@ func (o Options) ContextWithOptions(ctx context.Context) context.Context {
 	return ctx
 }
 
+// HTTPClient returns a client for protocols that run over HTTP, such as gRPC-Web, that
+// connects with the same TLS, proxy, connect timeout and credentials settings as DialOptions
+func (o Options) HTTPClient() (*http.Client, error) {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if o.ConnectTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, o.ConnectTimeout)
+				defer cancel()
+			}
+			return o.dial(ctx, addr)
+		},
+	}
+	if o.TLS != nil {
+		config, err := o.TLS.ConfigE()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = config
+	}
+	if o.Credentials != nil {
+		perRPC, err := newPerRPCCredentials(o.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Client{Transport: &credentialsTransport{base: transport, credentials: perRPC}}, nil
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// Dials the target's network, through a proxy if one applies
+func (o Options) dial(ctx context.Context, addr string) (net.Conn, error) {
+	network := "tcp"
+	if o.Network != "" {
+		network = o.Network
+	}
+	if network == "tcp" {
+		proxyURL, err := proxyFor(o.Proxy, o.Host, addr)
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL != nil {
+			return dialProxy(ctx, proxyURL, addr)
+		}
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// DialContext returns a context bounded by the connect timeout, if one is set. The cancel
+// func must always be called.
+func (o Options) DialContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, o.ConnectTimeout)
+}
+
+// CallContext returns a context with the metadata attached and bounded by the max time, if
+// one is set. The cancel func must always be called.
+func (o Options) CallContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(o.ContextWithOptions(ctx), o.MaxTime)
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
 type TLS struct {
-	Insecure   bool
-	ServerName string
+	Insecure bool `yaml:"insecure"`
+	// Whether Insecure was set explicitly, so merging it can turn verification back on
+	InsecureSet bool   `yaml:"-"`
+	ServerName  string `yaml:"server_name"`
+	// PEM encoded client certificate and key, for servers that require mutual TLS
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// PEM encoded CA certificates to verify the server with, instead of the system roots
+	CAFiles []string `yaml:"ca_files"`
+	// Minimum TLS version to accept: 1.0, 1.1, 1.2 or 1.3
+	MinVersion string `yaml:"min_version"`
+	// Protocols to advertise with ALPN
+	NextProtos []string `yaml:"alpn"`
+	// Name of a kubernetes.io/tls secret, in the target's namespace, to load the client
+	// certificate, key and CA from. Only used for k8:// targets.
+	Secret string `yaml:"secret"`
+	// PEM encoded client certificate, key and CA certificates, for credentials that aren't
+	// read from files. The files take precedence when both are set.
+	CertPEM []byte `yaml:"-"`
+	KeyPEM  []byte `yaml:"-"`
+	CAPEM   []byte `yaml:"-"`
 }
 
+// Config returns the TLS config. Problems with the TLS options, such as an unreadable
+// certificate, fail every handshake with the problem rather than being returned, so use ConfigE
+// to find out about them before connecting.
 func (t TLS) Config() *tls.Config {
+	config, err := t.ConfigE()
+	if err != nil {
+		log.Errorf("options - invalid TLS options: %s", err)
+		return &tls.Config{
+			VerifyConnection: func(tls.ConnectionState) error {
+				return err
+			},
+		}
+	}
+	return config
+}
+
+// ConfigE returns the TLS config, or the problem with the TLS options
+func (t TLS) ConfigE() (*tls.Config, error) {
 	config := &tls.Config{}
 
 	config.InsecureSkipVerify = t.Insecure
 	config.ServerName = t.ServerName
+	config.NextProtos = t.NextProtos
 
-	return config
+	if t.CertFile != "" || t.KeyFile != "" {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, fmt.Errorf("Both a TLS client certificate and key are required for mutual TLS")
+		}
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load TLS client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	} else if len(t.CertPEM) != 0 || len(t.KeyPEM) != 0 {
+		cert, err := tls.X509KeyPair(t.CertPEM, t.KeyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load TLS client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(t.CAFiles) != 0 || len(t.CAPEM) != 0 {
+		pool := x509.NewCertPool()
+		if len(t.CAPEM) != 0 && !pool.AppendCertsFromPEM(t.CAPEM) {
+			return nil, fmt.Errorf("No PEM encoded certificates found in TLS CA")
+		}
+		for _, caFile := range t.CAFiles {
+			contents, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read TLS CA file: %s", err)
+			}
+			if !pool.AppendCertsFromPEM(contents) {
+				return nil, fmt.Errorf("No PEM encoded certificates found in TLS CA file %s", caFile)
+			}
+		}
+		config.RootCAs = pool
+	}
+
+	if t.MinVersion != "" {
+		version, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported minimum TLS version %q, must be one of 1.0, 1.1, 1.2 or 1.3", t.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	return config, nil
+}
+
+// Merge sets every field that's set on other onto t, so other takes precedence. Insecure is
+// only unset by other when other.InsecureSet is true.
+func (t *TLS) Merge(other TLS) {
+	if other.Insecure || other.InsecureSet {
+		t.Insecure = other.Insecure
+	}
+	if other.ServerName != "" {
+		t.ServerName = other.ServerName
+	}
+	if other.CertFile != "" {
+		t.CertFile = other.CertFile
+	}
+	if other.KeyFile != "" {
+		t.KeyFile = other.KeyFile
+	}
+	if len(other.CAFiles) != 0 {
+		t.CAFiles = other.CAFiles
+	}
+	if other.MinVersion != "" {
+		t.MinVersion = other.MinVersion
+	}
+	if len(other.NextProtos) != 0 {
+		t.NextProtos = other.NextProtos
+	}
+	if other.Secret != "" {
+		t.Secret = other.Secret
+	}
 }
 
 type Kubernetes struct {
@@ -0,0 +1,421 @@
+package options
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+func TestMessageOptions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodings := make(chan string, 1)
+	server := grpc.NewServer(grpc.StatsHandler(compressionRecorder(encodings)))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	defer server.Stop()
+
+	call := func(options Options) error {
+		dialOptions, err := options.DialOptionsE()
+		if err != nil {
+			return err
+		}
+		conn, err := grpc.Dial(listener.Addr().String(), dialOptions...)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+		return err
+	}
+
+	if err := call(Options{Compressor: "gzip", MaxSendMsgSize: 1024, MaxRecvMsgSize: 1024}); err != nil {
+		t.Fatalf("Error calling with gzip: %s", err.Error())
+	}
+	if encoding := <-encodings; encoding != "gzip" {
+		t.Errorf("Expected the request to be gzipped, got grpc-encoding %q", encoding)
+	}
+
+	// The response is larger than a byte
+	err = call(Options{MaxRecvMsgSize: 1})
+	<-encodings
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected %s with a 1 byte receive limit, got: %v", codes.ResourceExhausted, err)
+	}
+
+	if err := call(Options{Compressor: "brotli"}); err == nil {
+		t.Error("Expected error with an unsupported compressor")
+	}
+}
+
+// Server stats handler that sends the compression of each request down the channel
+type compressionRecorder chan string
+
+func (c compressionRecorder) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (c compressionRecorder) HandleRPC(ctx context.Context, rpcStats stats.RPCStats) {
+	if header, ok := rpcStats.(*stats.InHeader); ok {
+		c <- header.Compression
+	}
+}
+
+func (c compressionRecorder) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (c compressionRecorder) HandleConn(ctx context.Context, connStats stats.ConnStats) {}
+
+func TestDialUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gurl-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	defer server.Stop()
+
+	options := Options{Network: "unix", ConnectTimeout: 5 * time.Second, LoadBalancingPolicy: "round_robin"}
+	dialOptions, err := options.DialOptionsE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := options.DialContext(context.Background())
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "passthrough:///"+path, dialOptions...)
+	if err != nil {
+		t.Fatalf("Error dialing unix socket: %s", err.Error())
+	}
+	defer conn.Close()
+
+	response, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Error calling over unix socket: %s", err.Error())
+	}
+	if response.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected SERVING, got: %s", response.Status)
+	}
+}
+
+// A blocking dial to a server that never completes the HTTP/2 handshake gives up after the
+// connect timeout
+func TestConnectTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	options := Options{ConnectTimeout: 100 * time.Millisecond}
+	dialOptions, err := options.DialOptionsE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := options.DialContext(context.Background())
+	defer cancel()
+
+	start := time.Now()
+	conn, err := grpc.DialContext(ctx, listener.Addr().String(), dialOptions...)
+	if err == nil {
+		conn.Close()
+		t.Fatal("Expected the dial to time out")
+	}
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected %s, got: %s", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the dial to give up after the connect timeout, took %s", elapsed)
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	options := Options{Metadata: metadata.Pairs("key", "value"), MaxTime: time.Minute}
+	ctx, cancel := options.CallContext(context.Background())
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > time.Minute {
+		t.Errorf("Expected a deadline within a minute, got: %s", deadline)
+	}
+	if md, _ := metadata.FromOutgoingContext(ctx); md.Get("key")[0] != "value" {
+		t.Errorf("Expected metadata to be attached, got: %v", md)
+	}
+
+	ctx, cancel = Options{}.CallContext(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("Expected no deadline without a max time")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gurl-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.issue(t, dir, "client", x509.ExtKeyUsageClientAuth)
+
+	config, err := TLS{
+		ServerName: "server",
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		CAFiles:    []string{ca.certFile},
+		MinVersion: "1.2",
+		NextProtos: []string{"h2"},
+	}.ConfigE()
+	if err != nil {
+		t.Fatalf("Error building TLS config: %s", err.Error())
+	}
+	if len(config.Certificates) != 1 {
+		t.Errorf("Expected 1 client certificate, got %d", len(config.Certificates))
+	}
+	if config.RootCAs == nil {
+		t.Error("Expected root CAs to be set")
+	}
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Expected min version %d, got %d", tls.VersionTLS12, config.MinVersion)
+	}
+	if config.ServerName != "server" || !reflect.DeepEqual(config.NextProtos, []string{"h2"}) {
+		t.Errorf("Expected server name and ALPN to be set, got %s and %v", config.ServerName, config.NextProtos)
+	}
+
+	invalid := []TLS{
+		// A certificate without a key
+		{CertFile: certFile},
+		{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: keyFile},
+		{CAFiles: []string{filepath.Join(dir, "missing.pem")}},
+		// A key isn't a certificate
+		{CAFiles: []string{keyFile}},
+		{MinVersion: "1.4"},
+	}
+	for _, tlsOptions := range invalid {
+		if _, err := tlsOptions.ConfigE(); err == nil {
+			t.Errorf("Expected error building TLS config from %#v", tlsOptions)
+		}
+	}
+}
+
+// Runs a handshake against a server that requires client certificates signed by a private CA
+func TestTLSConfigMutualHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gurl-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, dir)
+	serverCertFile, serverKeyFile := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	clientCertFile, clientKeyFile := ca.issue(t, dir, "client", x509.ExtKeyUsageClientAuth)
+
+	serverCert, err := tls.LoadX509KeyPair(serverCertFile, serverKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+
+	handshake := func(tlsOptions TLS) error {
+		clientConfig, err := tlsOptions.ConfigE()
+		if err != nil {
+			return err
+		}
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		defer clientConn.Close()
+		go tls.Server(serverConn, serverConfig).Handshake()
+		return tls.Client(clientConn, clientConfig).Handshake()
+	}
+
+	err = handshake(TLS{ServerName: "server", CertFile: clientCertFile, KeyFile: clientKeyFile, CAFiles: []string{ca.certFile}})
+	if err != nil {
+		t.Errorf("Expected mutual TLS handshake to succeed, got: %s", err)
+	}
+	// Without the private CA the server can't be verified
+	err = handshake(TLS{ServerName: "server", CertFile: clientCertFile, KeyFile: clientKeyFile})
+	if err == nil {
+		t.Error("Expected handshake to fail without the CA")
+	}
+
+	// The same credentials held in memory, as when they're read from a Kubernetes secret
+	certPEM, keyPEM, caPEM := readFile(t, clientCertFile), readFile(t, clientKeyFile), readFile(t, ca.certFile)
+	err = handshake(TLS{ServerName: "server", CertPEM: certPEM, KeyPEM: keyPEM, CAPEM: caPEM})
+	if err != nil {
+		t.Errorf("Expected mutual TLS handshake with PEM credentials to succeed, got: %s", err)
+	}
+	if _, err := (TLS{CertPEM: certPEM}).ConfigE(); err == nil {
+		t.Error("Expected error building TLS config from a PEM certificate without a key")
+	}
+	if _, err := (TLS{CAPEM: keyPEM}).ConfigE(); err == nil {
+		t.Error("Expected error building TLS config from a PEM CA without certificates")
+	}
+}
+
+// DialOptions and Config can't return errors, so problems with the options fail the dial instead
+func TestDeferredOptionErrors(t *testing.T) {
+	config := TLS{MinVersion: "1.4"}.Config()
+	if err := config.VerifyConnection(tls.ConnectionState{}); err == nil || !strings.Contains(err.Error(), "1.4") {
+		t.Errorf("Expected the handshake to fail with the TLS options' problem, got: %v", err)
+	}
+
+	conn, err := grpc.Dial("localhost:1", Options{Compressor: "brotli"}.DialOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err == nil || !strings.Contains(err.Error(), "brotli") {
+		t.Errorf("Expected the call to fail with the options' problem, got: %v", err)
+	}
+}
+
+func TestTLSMerge(t *testing.T) {
+	base := TLS{ServerName: "config", CertFile: "config.pem", KeyFile: "config.key", MinVersion: "1.2"}
+	base.Merge(TLS{Insecure: true, CertFile: "flag.pem", CAFiles: []string{"ca.pem"}, Secret: "client-tls"})
+
+	expected := TLS{
+		Insecure:   true,
+		ServerName: "config",
+		CertFile:   "flag.pem",
+		KeyFile:    "config.key",
+		CAFiles:    []string{"ca.pem"},
+		MinVersion: "1.2",
+		Secret:     "client-tls",
+	}
+	if !reflect.DeepEqual(base, expected) {
+		t.Errorf("Expected: %#v\ngot: %#v", expected, base)
+	}
+
+	// Insecure is only turned off when it's set explicitly
+	base.Merge(TLS{})
+	if !base.Insecure {
+		t.Error("Expected an unset Insecure to be left alone")
+	}
+	base.Merge(TLS{Insecure: false, InsecureSet: true})
+	if base.Insecure {
+		t.Error("Expected an explicitly set Insecure to turn verification back on")
+	}
+}
+
+type testCA struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gurl test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", der)
+	return &testCA{cert: cert, key: key, certFile: certFile}
+}
+
+// Issues a certificate for name signed by the CA and returns the cert and key file paths
+func (c *testCA) issue(t *testing.T, dir, name string, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.cert, &key.PublicKey, c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	keyFile := writePEM(t, filepath.Join(dir, name+".key"), "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func readFile(t *testing.T, path string) []byte {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) string {
+	contents := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
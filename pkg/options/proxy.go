@@ -0,0 +1,143 @@
+package options
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wearefair/gurl/pkg/log"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// Returns the proxy to dial addr through, or nil to dial it directly. An explicit proxy
+// takes precedence over HTTPS_PROXY, then ALL_PROXY. Addresses matched by NO_PROXY, and
+// localhost, are always dialled directly. host is the target's hostname, if addr was resolved
+// from one, so NO_PROXY can exclude it by name too.
+func proxyFor(explicit, host, addr string) (*url.URL, error) {
+	rawProxy := firstEnv(explicit, "HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy")
+	if rawProxy == "" {
+		return nil, nil
+	}
+	// Proxies without a scheme are HTTP proxies
+	if !strings.Contains(rawProxy, "://") {
+		rawProxy = "http://" + rawProxy
+	}
+	proxyURL, err := url.Parse(rawProxy)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy: %s", err)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy %q: missing host", proxyURL.Redacted())
+	}
+
+	// httpproxy only decides whether addr bypasses the proxy, since it rewrites schemes it
+	// doesn't know about, such as socks5h, into HTTP proxies
+	bypass := &httpproxy.Config{
+		HTTPSProxy: "http://proxy",
+		NoProxy:    firstEnv("", "NO_PROXY", "no_proxy"),
+	}
+	candidates := []string{addr}
+	if _, port, err := net.SplitHostPort(addr); err == nil && host != "" {
+		candidates = append(candidates, net.JoinHostPort(host, port))
+	}
+	viaProxy := bypass.ProxyFunc()
+	for _, candidate := range candidates {
+		through, err := viaProxy(&url.URL{Scheme: "https", Host: candidate})
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy: %s", err)
+		}
+		if through == nil {
+			return nil, nil
+		}
+	}
+	return proxyURL, nil
+}
+
+// Dials addr through the proxy. HTTP proxies are sent a CONNECT request, SOCKS5 proxies are
+// dialled with golang.org/x/net/proxy.
+func dialProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	log.Infof("proxy - dialing %s through %s", addr, proxyURL.Redacted())
+	switch proxyURL.Scheme {
+	case "http":
+		return dialHTTPConnect(ctx, proxyURL, addr)
+	case "socks5", "socks5h":
+		dialer, err := proxy.FromURL(proxyURL, proxy.Direct)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy: %s", err)
+		}
+		contextDialer, ok := dialer.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("Proxy %s can't be dialed with a context", proxyURL.Redacted())
+		}
+		return contextDialer.DialContext(ctx, "tcp", addr)
+	}
+	return nil, fmt.Errorf("Unsupported proxy scheme %q, must be http, socks5 or socks5h", proxyURL.Scheme)
+}
+
+// Opens a tunnel to addr with an HTTP CONNECT request
+func dialHTTPConnect(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to proxy %s: %s", proxyAddr, err)
+	}
+	// Bound the CONNECT exchange by the dial's deadline, then clear it for the tunnel
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to send CONNECT to proxy %s: %s", proxyAddr, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to read CONNECT response from proxy %s: %s", proxyAddr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy %s refused CONNECT to %s: %s", proxyAddr, addr, strings.TrimSpace(resp.Status))
+	}
+	if reader.Buffered() > 0 {
+		// The server spoke first and the proxy forwarded it along with the response
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// Conn that reads out what was buffered while reading the CONNECT response first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
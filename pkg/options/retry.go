@@ -0,0 +1,138 @@
+package options
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/wearefair/gurl/pkg/log"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultInitialBackoff    = 100 * time.Millisecond
+	defaultMaxBackoff        = 5 * time.Second
+	defaultBackoffMultiplier = 2
+)
+
+// Overridden in tests
+var (
+	jitter = rand.Float64
+	sleep  = func(ctx context.Context, d time.Duration) error {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+)
+
+// RetryPolicy retries failed calls with exponential backoff, following the retry policy in
+// gRPC's service config. A RetryInfo detail on the error overrides the backoff.
+type RetryPolicy struct {
+	// Attempts to make, including the first. 1 or less never retries.
+	MaxAttempts int
+	// Backoff before the first retry, which grows by the multiplier on each retry up to the
+	// max backoff. The actual backoff is a random duration up to this, so retries from
+	// several clients don't line up. Zero values use 100ms, 5s and 2.
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	// Status codes to retry on
+	RetryableCodes []codes.Code
+}
+
+// ParseCode parses a status code from its name, such as UNAVAILABLE, or its number
+func ParseCode(name string) (codes.Code, error) {
+	var code codes.Code
+	if _, err := strconv.ParseUint(name, 10, 32); err != nil {
+		name = strconv.Quote(strings.ToUpper(name))
+	}
+	if err := code.UnmarshalJSON([]byte(name)); err != nil {
+		return code, fmt.Errorf("Invalid status code %s, expected a name such as UNAVAILABLE", name)
+	}
+	return code, nil
+}
+
+func (r *RetryPolicy) retryable(code codes.Code) bool {
+	for _, retryable := range r.RetryableCodes {
+		if code == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff before the given retry, starting from 1
+func (r *RetryPolicy) backoff(retry int) time.Duration {
+	initial, max, multiplier := r.InitialBackoff, r.MaxBackoff, r.BackoffMultiplier
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	if multiplier <= 0 {
+		multiplier = defaultBackoffMultiplier
+	}
+	backoff := math.Min(float64(initial)*math.Pow(multiplier, float64(retry-1)), float64(max))
+	return time.Duration(jitter() * backoff)
+}
+
+// Returns the delay from a RetryInfo detail on the error, if it has one
+func retryDelay(err error) (time.Duration, bool) {
+	for _, detail := range status.Convert(err).Details() {
+		retryInfo, ok := detail.(*errdetails.RetryInfo)
+		if !ok || retryInfo.RetryDelay == nil {
+			continue
+		}
+		delay, err := ptypes.Duration(retryInfo.RetryDelay)
+		if err == nil && delay >= 0 {
+			return delay, true
+		}
+	}
+	return 0, false
+}
+
+// Interceptor that retries unary calls with the policy returned for their method
+func retryInterceptor(policyFor func(method string) *RetryPolicy) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		policy := policyFor(method)
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if policy == nil {
+			return err
+		}
+
+		for attempt := 2; attempt <= policy.MaxAttempts; attempt++ {
+			code := status.Code(err)
+			if err == nil || !policy.retryable(code) {
+				return err
+			}
+			delay, ok := retryDelay(err)
+			if !ok {
+				delay = policy.backoff(attempt - 1)
+			}
+			// Give up early rather than sleep past the deadline
+			if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+				return err
+			}
+			log.Warningf("retry - attempt %d of %d failed with %s, retrying in %s", attempt-1, policy.MaxAttempts, code, delay)
+			if sleepErr := sleep(ctx, delay); sleepErr != nil {
+				return err
+			}
+			err = invoker(ctx, method, req, reply, cc, opts...)
+		}
+		return err
+	}
+}
@@ -0,0 +1,213 @@
+package options
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseCode(t *testing.T) {
+	testCases := map[string]codes.Code{
+		"UNAVAILABLE":        codes.Unavailable,
+		"resource_exhausted": codes.ResourceExhausted,
+		"14":                 codes.Unavailable,
+	}
+	for name, expected := range testCases {
+		code, err := ParseCode(name)
+		if err != nil || code != expected {
+			t.Errorf("Expected %s from %s, got: %s, %v", expected, name, code, err)
+		}
+	}
+	for _, name := range []string{"Unavailable!", "99", ""} {
+		if _, err := ParseCode(name); err == nil {
+			t.Errorf("Expected error parsing %q", name)
+		}
+	}
+}
+
+func TestRetryInterceptor(t *testing.T) {
+	originalJitter, originalSleep := jitter, sleep
+	defer func() { jitter, sleep = originalJitter, originalSleep }()
+	jitter = func() float64 { return 1 }
+	var delays []time.Duration
+	sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+
+	policy := &RetryPolicy{MaxAttempts: 3, RetryableCodes: []codes.Code{codes.Unavailable}}
+	busy, err := status.New(codes.Unavailable, "busy").WithDetails(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(3 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		// Errors the server returns before it succeeds
+		Failures []error
+		Policy   *RetryPolicy
+		Code     codes.Code
+		Delays   []time.Duration
+	}{
+		{
+			Failures: []error{status.Error(codes.Unavailable, "down"), status.Error(codes.Unavailable, "down")},
+			Policy:   policy,
+			Code:     codes.OK,
+			Delays:   []time.Duration{100 * time.Millisecond, 200 * time.Millisecond},
+		},
+		// RetryInfo overrides the backoff
+		{
+			Failures: []error{busy.Err()},
+			Policy:   policy,
+			Code:     codes.OK,
+			Delays:   []time.Duration{3 * time.Second},
+		},
+		// Gives up after the max attempts
+		{
+			Failures: []error{status.Error(codes.Unavailable, "down"), status.Error(codes.Unavailable, "down"), status.Error(codes.Unavailable, "down")},
+			Policy:   &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: 1500 * time.Millisecond, BackoffMultiplier: 3, RetryableCodes: []codes.Code{codes.Unavailable}},
+			Code:     codes.Unavailable,
+			Delays:   []time.Duration{time.Second, 1500 * time.Millisecond},
+		},
+		// Codes that aren't retryable fail straight away
+		{
+			Failures: []error{status.Error(codes.Internal, "broken")},
+			Policy:   policy,
+			Code:     codes.Internal,
+		},
+		// No policy never retries
+		{
+			Failures: []error{status.Error(codes.Unavailable, "down")},
+			Code:     codes.Unavailable,
+		},
+	}
+
+	for i, testCase := range testCases {
+		delays = nil
+		failures := testCase.Failures
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if len(failures) != 0 {
+				err := failures[0]
+				failures = failures[1:]
+				return nil, err
+			}
+			return handler(ctx, req)
+		}))
+		healthpb.RegisterHealthServer(server, health.NewServer())
+		go server.Serve(listener)
+
+		_, err = callHealth(Options{Retry: testCase.Policy}, listener.Addr().String())
+		server.Stop()
+		if status.Code(err) != testCase.Code {
+			t.Errorf("Test case %d: expected %s, got: %v", i, testCase.Code, err)
+		}
+		if !reflect.DeepEqual(delays, testCase.Delays) {
+			t.Errorf("Test case %d: expected delays %v, got: %v", i, testCase.Delays, delays)
+		}
+	}
+}
+
+func TestParseServiceConfig(t *testing.T) {
+	config, err := parseServiceConfig(`{
+		"loadBalancingPolicy": "pick_first",
+		"methodConfig": [
+			{
+				"name": [{"service": "hello.Greeter", "method": "SayHello"}],
+				"timeout": "1s",
+				"retryPolicy": {"maxAttempts": 5, "initialBackoff": "0.5s", "maxBackoff": "2s", "backoffMultiplier": 3, "retryableStatusCodes": ["UNAVAILABLE", "ABORTED"]}
+			},
+			{
+				"name": [{"service": "hello.Greeter"}],
+				"retryPolicy": {"maxAttempts": 2, "retryableStatusCodes": ["UNAVAILABLE"]}
+			},
+			{
+				"name": [{}],
+				"hedgingPolicy": {"maxAttempts": 3, "hedgingDelay": "0.2s", "nonFatalStatusCodes": ["UNAVAILABLE"]}
+			}
+		]
+	}`, "round_robin")
+	if err != nil {
+		t.Fatalf("Error parsing service config: %s", err.Error())
+	}
+
+	// The load balancing policy is overridden and gurl's policies are removed
+	expected := `{"loadBalancingPolicy":"round_robin","methodConfig":[{"name":[{"method":"SayHello","service":"hello.Greeter"}],"timeout":"1s"},{"name":[{"service":"hello.Greeter"}]},{"name":[{}]}]}`
+	if config.grpc != expected {
+		t.Errorf("Expected: %s\ngot: %s", expected, config.grpc)
+	}
+
+	sayHello := &RetryPolicy{
+		MaxAttempts:       5,
+		InitialBackoff:    500 * time.Millisecond,
+		MaxBackoff:        2 * time.Second,
+		BackoffMultiplier: 3,
+		RetryableCodes:    []codes.Code{codes.Unavailable, codes.Aborted},
+	}
+	greeter := &RetryPolicy{MaxAttempts: 2, RetryableCodes: []codes.Code{codes.Unavailable}}
+	policies := map[string]*RetryPolicy{
+		"/hello.Greeter/SayHello":   sayHello,
+		"/hello.Greeter/SayGoodbye": greeter,
+		"/other.Service/Method":     nil,
+	}
+	for method, expected := range policies {
+		if policy := config.retryPolicy(method); !reflect.DeepEqual(policy, expected) {
+			t.Errorf("Method %s, expected: %#v\ngot: %#v", method, expected, policy)
+		}
+	}
+	// Methods are only hedged if they don't have a more specific retry policy
+	hedging := &HedgingPolicy{MaxAttempts: 3, HedgingDelay: 200 * time.Millisecond, NonFatalCodes: []codes.Code{codes.Unavailable}}
+	hedgingPolicies := map[string]*HedgingPolicy{
+		"/hello.Greeter/SayHello":   nil,
+		"/hello.Greeter/SayGoodbye": nil,
+		"/other.Service/Method":     hedging,
+	}
+	for method, expected := range hedgingPolicies {
+		if policy := config.hedgingPolicy(method); !reflect.DeepEqual(policy, expected) {
+			t.Errorf("Method %s, expected: %#v\ngot: %#v", method, expected, policy)
+		}
+	}
+
+	invalid := []string{
+		`{"methodConfig": {}}`,
+		`{"methodConfig": [{"retryPolicy": {"initialBackoff": "100ms0"}}]}`,
+		`{"methodConfig": [{"retryPolicy": {"retryableStatusCodes": ["SOMETIMES"]}}]}`,
+		`{"methodConfig": [{"hedgingPolicy": {"hedgingDelay": "1m"}}]}`,
+		`{"methodConfig": [{"retryPolicy": {"maxAttempts": 2}, "hedgingPolicy": {"maxAttempts": 2}}]}`,
+	}
+	for _, contents := range invalid {
+		if _, err := parseServiceConfig(contents, ""); err == nil {
+			t.Errorf("Expected error parsing %s", contents)
+		}
+	}
+
+	config, err = parseServiceConfig("", "")
+	if err != nil || config.grpc != "" {
+		t.Errorf("Expected no service config, got: %q, %v", config.grpc, err)
+	}
+}
+
+func callHealth(options Options, target string) (*healthpb.HealthCheckResponse, error) {
+	dialOptions, err := options.DialOptionsE()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.Dial(target, dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+}
@@ -0,0 +1,195 @@
+package options
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// The parts of gRPC's service config that gurl reads, see
+// https://github.com/grpc/grpc/blob/master/doc/service_config.md
+type serviceConfigJSON struct {
+	MethodConfig []methodConfigJSON `json:"methodConfig"`
+}
+
+type methodConfigJSON struct {
+	Name []struct {
+		Service string `json:"service"`
+		Method  string `json:"method"`
+	} `json:"name"`
+	RetryPolicy *struct {
+		MaxAttempts          int          `json:"maxAttempts"`
+		InitialBackoff       string       `json:"initialBackoff"`
+		MaxBackoff           string       `json:"maxBackoff"`
+		BackoffMultiplier    float64      `json:"backoffMultiplier"`
+		RetryableStatusCodes []codes.Code `json:"retryableStatusCodes"`
+	} `json:"retryPolicy"`
+	HedgingPolicy *struct {
+		MaxAttempts         int          `json:"maxAttempts"`
+		HedgingDelay        string       `json:"hedgingDelay"`
+		NonFatalStatusCodes []codes.Code `json:"nonFatalStatusCodes"`
+	} `json:"hedgingPolicy"`
+}
+
+// Service config split into what's handed to gRPC and the retry and hedging policies gurl
+// applies itself, since this version of gRPC only retries and hedges when GRPC_GO_RETRY=on
+type serviceConfig struct {
+	// Service config for gRPC with the retry and hedging policies removed. Blank if there's
+	// nothing left to configure.
+	grpc string
+	// Retry policies keyed by /service/method, /service/ or // for the default
+	retryPolicies map[string]*RetryPolicy
+	// Hedging policies keyed the same way as retry policies
+	hedgingPolicies map[string]*HedgingPolicy
+}
+
+// Parses the service config JSON, setting the load balancing policy on it if one is given
+func parseServiceConfig(contents, loadBalancingPolicy string) (*serviceConfig, error) {
+	parsed := &serviceConfig{
+		retryPolicies:   make(map[string]*RetryPolicy),
+		hedgingPolicies: make(map[string]*HedgingPolicy),
+	}
+	raw := make(map[string]interface{})
+	if strings.TrimSpace(contents) != "" {
+		var config serviceConfigJSON
+		if err := json.Unmarshal([]byte(contents), &config); err != nil {
+			return nil, fmt.Errorf("Invalid service config: %s", err)
+		}
+		if err := json.Unmarshal([]byte(contents), &raw); err != nil {
+			return nil, fmt.Errorf("Invalid service config: %s", err)
+		}
+		if err := parsed.addRetryPolicies(config.MethodConfig); err != nil {
+			return nil, err
+		}
+		if err := parsed.addHedgingPolicies(config.MethodConfig); err != nil {
+			return nil, err
+		}
+		stripPolicies(raw)
+	}
+	if loadBalancingPolicy != "" {
+		raw["loadBalancingPolicy"] = loadBalancingPolicy
+	}
+
+	if len(raw) != 0 {
+		contents, err := json.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		parsed.grpc = string(contents)
+	}
+	return parsed, nil
+}
+
+func (s *serviceConfig) addRetryPolicies(methodConfigs []methodConfigJSON) error {
+	for _, methodConfig := range methodConfigs {
+		if methodConfig.RetryPolicy == nil {
+			continue
+		}
+		policy := &RetryPolicy{
+			MaxAttempts:       methodConfig.RetryPolicy.MaxAttempts,
+			BackoffMultiplier: methodConfig.RetryPolicy.BackoffMultiplier,
+			RetryableCodes:    methodConfig.RetryPolicy.RetryableStatusCodes,
+		}
+		var err error
+		if policy.InitialBackoff, err = parseConfigDuration(methodConfig.RetryPolicy.InitialBackoff); err != nil {
+			return fmt.Errorf("Invalid service config: retryPolicy initialBackoff: %s", err)
+		}
+		if policy.MaxBackoff, err = parseConfigDuration(methodConfig.RetryPolicy.MaxBackoff); err != nil {
+			return fmt.Errorf("Invalid service config: retryPolicy maxBackoff: %s", err)
+		}
+		for _, name := range methodConfig.Name {
+			s.retryPolicies[fmt.Sprintf("/%s/%s", name.Service, name.Method)] = policy
+		}
+	}
+	return nil
+}
+
+func (s *serviceConfig) addHedgingPolicies(methodConfigs []methodConfigJSON) error {
+	for _, methodConfig := range methodConfigs {
+		if methodConfig.HedgingPolicy == nil {
+			continue
+		}
+		// gRPC rejects service configs that both retry and hedge the same methods
+		if methodConfig.RetryPolicy != nil {
+			return fmt.Errorf("Invalid service config: methodConfig can't have both a retryPolicy and a hedgingPolicy")
+		}
+		policy := &HedgingPolicy{
+			MaxAttempts:   methodConfig.HedgingPolicy.MaxAttempts,
+			NonFatalCodes: methodConfig.HedgingPolicy.NonFatalStatusCodes,
+		}
+		var err error
+		if policy.HedgingDelay, err = parseConfigDuration(methodConfig.HedgingPolicy.HedgingDelay); err != nil {
+			return fmt.Errorf("Invalid service config: hedgingPolicy hedgingDelay: %s", err)
+		}
+		for _, name := range methodConfig.Name {
+			s.hedgingPolicies[fmt.Sprintf("/%s/%s", name.Service, name.Method)] = policy
+		}
+	}
+	return nil
+}
+
+// Removes the retry and hedging policies from the raw method configs
+func stripPolicies(raw map[string]interface{}) {
+	methodConfigs, _ := raw["methodConfig"].([]interface{})
+	for _, methodConfig := range methodConfigs {
+		methodConfig, ok := methodConfig.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		delete(methodConfig, "retryPolicy")
+		delete(methodConfig, "hedgingPolicy")
+	}
+}
+
+// Durations in the service config are in the JSON encoding of google.protobuf.Duration, such
+// as "0.1s"
+func parseConfigDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if !strings.HasSuffix(value, "s") {
+		return 0, fmt.Errorf("%q must be in seconds, such as 0.1s", value)
+	}
+	return time.ParseDuration(value)
+}
+
+// Returns the retry policy for a full method name such as /hello.Greeter/SayHello, preferring
+// a policy for the method, then the service, then the default. Methods with a more specific
+// hedging policy aren't retried.
+func (s *serviceConfig) retryPolicy(method string) *RetryPolicy {
+	for _, key := range policyKeys(method) {
+		if policy, ok := s.retryPolicies[key]; ok {
+			return policy
+		}
+		if _, ok := s.hedgingPolicies[key]; ok {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Returns the hedging policy for a full method name, looked up like retry policies. Methods
+// with a more specific retry policy aren't hedged.
+func (s *serviceConfig) hedgingPolicy(method string) *HedgingPolicy {
+	for _, key := range policyKeys(method) {
+		if policy, ok := s.hedgingPolicies[key]; ok {
+			return policy
+		}
+		if _, ok := s.retryPolicies[key]; ok {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Keys that policies for the method could be stored under, from most to least specific
+func policyKeys(method string) []string {
+	keys := []string{method}
+	if i := strings.LastIndex(method, "/"); i > 0 {
+		keys = append(keys, method[:i+1])
+	}
+	return append(keys, "//")
+}
@@ -0,0 +1,30 @@
+package options
+
+import (
+	"context"
+
+	"github.com/wearefair/gurl/pkg/log"
+	"google.golang.org/grpc/stats"
+)
+
+// Logs the size of each message sent and received, before and after compression
+type wireSizeLogger struct{}
+
+func (wireSizeLogger) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (wireSizeLogger) HandleRPC(ctx context.Context, rpcStats stats.RPCStats) {
+	switch payload := rpcStats.(type) {
+	case *stats.OutPayload:
+		log.Infof("wire - sent message: %d bytes uncompressed, %d bytes on the wire", payload.Length, payload.WireLength)
+	case *stats.InPayload:
+		log.Infof("wire - received message: %d bytes uncompressed, %d bytes on the wire", payload.Length, payload.WireLength)
+	}
+}
+
+func (wireSizeLogger) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (wireSizeLogger) HandleConn(ctx context.Context, connStats stats.ConnStats) {}
@@ -0,0 +1,472 @@
+package protobuf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+)
+
+// Root of every JSON path reported by CheckJSON
+const jsonPathRoot = "$"
+
+// Problem is an issue found with a request, located by its path in the request
+type Problem struct {
+	Path    string
+	Message string
+}
+
+// String prints the problem with its path
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// ValidationError is returned when a request has one or more problems
+type ValidationError struct {
+	Problems []Problem
+}
+
+// Error lists every problem on its own line
+func (e *ValidationError) Error() string {
+	builder := &strings.Builder{}
+	builder.WriteString("Invalid request:")
+	for _, problem := range e.Problems {
+		builder.WriteString("\n  ")
+		builder.WriteString(problem.String())
+	}
+	return builder.String()
+}
+
+// Report holds the problems found with a request. Errors will cause the request to be
+// rejected by the server, or silently dropped, while warnings are only informational.
+type Report struct {
+	Errors   []Problem
+	Warnings []Problem
+}
+
+// Err returns a ValidationError if the report has any errors, otherwise nil
+func (r *Report) Err() error {
+	if len(r.Errors) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: r.Errors}
+}
+
+func (r *Report) errorf(path, format string, args ...interface{}) {
+	r.Errors = append(r.Errors, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *Report) warnf(path, format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// CheckFormat checks a request encoded in the given format against the message descriptor.
+// Only JSON and YAML requests are checked, since the other formats can't hold unknown
+// or mistyped fields.
+func CheckFormat(messageDescriptor *desc.MessageDescriptor, request []byte, format Format) (*Report, error) {
+	request = bytes.TrimSpace(request)
+	if len(request) == 0 {
+		return &Report{}, nil
+	}
+	switch format {
+	case FormatJSON, "":
+		return CheckJSON(messageDescriptor, request)
+	case FormatYAML:
+		converted, err := yamlToJSON(request)
+		if err != nil {
+			return nil, err
+		}
+		return CheckJSON(messageDescriptor, converted)
+	}
+	return &Report{}, nil
+}
+
+// CheckJSON walks a JSON request against the message descriptor and reports every problem
+// with its JSON path: unknown fields, type mismatches, invalid enum values and oneof
+// conflicts. Deprecated fields that are set are reported as warnings.
+//
+// An error is only returned if the request isn't valid JSON.
+func CheckJSON(messageDescriptor *desc.MessageDescriptor, request []byte) (*Report, error) {
+	decoder := json.NewDecoder(bytes.NewReader(request))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+
+	report := &Report{}
+	checkMessage(report, jsonPathRoot, messageDescriptor, decoded)
+	return report, nil
+}
+
+func checkMessage(report *Report, path string, md *desc.MessageDescriptor, value interface{}) {
+	if checkWellKnownType(report, path, md, value) {
+		return
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		report.errorf(path, "expected an object for %s, got %s", md.GetFullyQualifiedName(), jsonType(value))
+		return
+	}
+
+	// Tracks which field each key set, to catch fields set twice and oneof conflicts
+	setFields := make(map[*desc.FieldDescriptor]string)
+	setOneOfs := make(map[*desc.OneOfDescriptor]string)
+	for _, key := range sortedKeys(object) {
+		fieldPath := path + "." + key
+		fd := findField(md, key)
+		if fd == nil {
+			report.errorf(fieldPath, "unknown field %q in %s%s", key, md.GetFullyQualifiedName(), suggestField(md, key))
+			continue
+		}
+		if other, ok := setFields[fd]; ok {
+			report.errorf(fieldPath, "field %s is already set by %q", fd.GetName(), other)
+			continue
+		}
+		setFields[fd] = key
+
+		val := object[key]
+		if val == nil {
+			// null is the same as leaving the field unset
+			continue
+		}
+		if fd.GetFieldOptions().GetDeprecated() {
+			report.warnf(fieldPath, "field %s is deprecated", fd.GetName())
+		}
+		if oneOf := fd.GetOneOf(); oneOf != nil {
+			if other, ok := setOneOfs[oneOf]; ok {
+				report.errorf(fieldPath, "only one field of oneof %s can be set, %q is already set", oneOf.GetName(), other)
+			} else {
+				setOneOfs[oneOf] = key
+			}
+		}
+		checkField(report, fieldPath, fd, val)
+	}
+}
+
+func checkField(report *Report, path string, fd *desc.FieldDescriptor, value interface{}) {
+	switch {
+	case fd.IsMap():
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			report.errorf(path, "expected an object for map field %s, got %s", fd.GetName(), jsonType(value))
+			return
+		}
+		for _, key := range sortedKeys(object) {
+			entryPath := fmt.Sprintf("%s[%s]", path, strconv.Quote(key))
+			if _, err := parseFieldValue(fd.GetMapKeyType(), key); err != nil {
+				report.errorf(entryPath, "invalid map key: %s", err)
+			}
+			if object[key] != nil {
+				checkValue(report, entryPath, fd.GetMapValueType(), object[key])
+			}
+		}
+	case fd.IsRepeated():
+		array, ok := value.([]interface{})
+		if !ok {
+			report.errorf(path, "expected an array for repeated field %s, got %s", fd.GetName(), jsonType(value))
+			return
+		}
+		for i, element := range array {
+			elementPath := fmt.Sprintf("%s[%d]", path, i)
+			if element == nil {
+				report.errorf(elementPath, "repeated field %s can't contain null", fd.GetName())
+				continue
+			}
+			checkValue(report, elementPath, fd, element)
+		}
+	default:
+		checkValue(report, path, fd, value)
+	}
+}
+
+// Checks a single (non-repeated) value against the field's type
+func checkValue(report *Report, path string, fd *desc.FieldDescriptor, value interface{}) {
+	switch fd.GetType() {
+	case dpb.FieldDescriptorProto_TYPE_MESSAGE, dpb.FieldDescriptorProto_TYPE_GROUP:
+		checkMessage(report, path, fd.GetMessageType(), value)
+	case dpb.FieldDescriptorProto_TYPE_ENUM:
+		checkEnum(report, path, fd.GetEnumType(), value)
+	default:
+		if err := checkScalar(fd.GetType(), value); err != nil {
+			report.errorf(path, "%s", err)
+		}
+	}
+}
+
+func checkEnum(report *Report, path string, ed *desc.EnumDescriptor, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		if ed.FindValueByName(v) == nil {
+			report.errorf(path, "invalid value %q for enum %s%s", v, ed.GetFullyQualifiedName(), suggestEnum(ed, v))
+		}
+	case json.Number:
+		// Open enums accept unknown numbers, so only check that this is an int32
+		if _, err := strconv.ParseInt(v.String(), 10, 32); err != nil {
+			report.errorf(path, "invalid number %s for enum %s", v, ed.GetFullyQualifiedName())
+		}
+	default:
+		report.errorf(path, "expected a string for enum %s, got %s", ed.GetFullyQualifiedName(), jsonType(value))
+	}
+}
+
+func checkScalar(fieldType dpb.FieldDescriptorProto_Type, value interface{}) error {
+	switch fieldType {
+	case dpb.FieldDescriptorProto_TYPE_STRING:
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("expected a string, got %s", jsonType(value))
+		}
+	case dpb.FieldDescriptorProto_TYPE_BYTES:
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected a base64 encoded string, got %s", jsonType(value))
+		}
+		if !isBase64(str) {
+			return fmt.Errorf("expected a base64 encoded string, got %q", str)
+		}
+	case dpb.FieldDescriptorProto_TYPE_BOOL:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("expected a boolean, got %s", jsonType(value))
+		}
+	case dpb.FieldDescriptorProto_TYPE_INT32, dpb.FieldDescriptorProto_TYPE_SINT32, dpb.FieldDescriptorProto_TYPE_SFIXED32:
+		return checkInteger(value, "int32", math.MinInt32, math.MaxInt32)
+	case dpb.FieldDescriptorProto_TYPE_INT64, dpb.FieldDescriptorProto_TYPE_SINT64, dpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return checkInteger(value, "int64", math.MinInt64, math.MaxInt64)
+	case dpb.FieldDescriptorProto_TYPE_UINT32, dpb.FieldDescriptorProto_TYPE_FIXED32:
+		return checkUnsigned(value, "uint32", math.MaxUint32)
+	case dpb.FieldDescriptorProto_TYPE_UINT64, dpb.FieldDescriptorProto_TYPE_FIXED64:
+		return checkUnsigned(value, "uint64", math.MaxUint64)
+	case dpb.FieldDescriptorProto_TYPE_FLOAT, dpb.FieldDescriptorProto_TYPE_DOUBLE:
+		return checkFloat(value)
+	}
+	return nil
+}
+
+// Integers can be JSON numbers or strings, and may use exponents as long as they're integral
+func numberString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.String(), true
+	case string:
+		return v, true
+	}
+	return "", false
+}
+
+func checkInteger(value interface{}, typeName string, min, max int64) error {
+	str, ok := numberString(value)
+	if !ok {
+		return fmt.Errorf("expected an %s, got %s", typeName, jsonType(value))
+	}
+	if i, err := strconv.ParseInt(str, 10, 64); err == nil {
+		if i < min || i > max {
+			return fmt.Errorf("%s is out of range for an %s", str, typeName)
+		}
+		return nil
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || f != math.Trunc(f) {
+		return fmt.Errorf("expected an %s, got %q", typeName, str)
+	}
+	if f < float64(min) || f > float64(max) {
+		return fmt.Errorf("%s is out of range for an %s", str, typeName)
+	}
+	return nil
+}
+
+func checkUnsigned(value interface{}, typeName string, max uint64) error {
+	str, ok := numberString(value)
+	if !ok {
+		return fmt.Errorf("expected a %s, got %s", typeName, jsonType(value))
+	}
+	if u, err := strconv.ParseUint(str, 10, 64); err == nil {
+		if u > max {
+			return fmt.Errorf("%s is out of range for a %s", str, typeName)
+		}
+		return nil
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || f != math.Trunc(f) {
+		return fmt.Errorf("expected a %s, got %q", typeName, str)
+	}
+	if f < 0 || f > float64(max) {
+		return fmt.Errorf("%s is out of range for a %s", str, typeName)
+	}
+	return nil
+}
+
+func checkFloat(value interface{}) error {
+	str, ok := numberString(value)
+	if !ok {
+		return fmt.Errorf("expected a number, got %s", jsonType(value))
+	}
+	switch str {
+	case "NaN", "Infinity", "-Infinity":
+		return nil
+	}
+	if _, err := strconv.ParseFloat(str, 64); err != nil {
+		return fmt.Errorf("expected a number, got %q", str)
+	}
+	return nil
+}
+
+func isBase64(str string) bool {
+	encodings := []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding}
+	for _, encoding := range encodings {
+		if _, err := encoding.DecodeString(str); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Well known types have special JSON mappings. Returns true if the message is a well known
+// type and has been checked.
+func checkWellKnownType(report *Report, path string, md *desc.MessageDescriptor, value interface{}) bool {
+	switch md.GetFullyQualifiedName() {
+	case "google.protobuf.Timestamp":
+		str, ok := value.(string)
+		if !ok {
+			report.errorf(path, "expected an RFC 3339 timestamp string, got %s", jsonType(value))
+		} else if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+			report.errorf(path, "expected an RFC 3339 timestamp such as 1972-01-01T10:00:20.021Z, got %q", str)
+		}
+	case "google.protobuf.Duration":
+		str, ok := value.(string)
+		if !ok {
+			report.errorf(path, "expected a duration string, got %s", jsonType(value))
+		} else if _, err := strconv.ParseFloat(strings.TrimSuffix(str, "s"), 64); err != nil || !strings.HasSuffix(str, "s") {
+			report.errorf(path, "expected a duration in seconds such as 1.5s, got %q", str)
+		}
+	case "google.protobuf.FieldMask":
+		if _, ok := value.(string); !ok {
+			report.errorf(path, "expected a comma separated field mask string, got %s", jsonType(value))
+		}
+	case "google.protobuf.DoubleValue", "google.protobuf.FloatValue", "google.protobuf.Int64Value",
+		"google.protobuf.UInt64Value", "google.protobuf.Int32Value", "google.protobuf.UInt32Value",
+		"google.protobuf.BoolValue", "google.protobuf.StringValue", "google.protobuf.BytesValue":
+		// Wrappers are represented by the value they wrap
+		if err := checkScalar(md.FindFieldByName("value").GetType(), value); err != nil {
+			report.errorf(path, "%s", err)
+		}
+	case "google.protobuf.Struct":
+		if _, ok := value.(map[string]interface{}); !ok {
+			report.errorf(path, "expected an object, got %s", jsonType(value))
+		}
+	case "google.protobuf.ListValue":
+		if _, ok := value.([]interface{}); !ok {
+			report.errorf(path, "expected an array, got %s", jsonType(value))
+		}
+	case "google.protobuf.Value", "google.protobuf.Any":
+		// Values can be anything, and Any types can't be resolved from the descriptor alone
+	default:
+		return false
+	}
+	return true
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case json.Number:
+		return "a number"
+	case string:
+		return "a string"
+	case []interface{}:
+		return "an array"
+	case map[string]interface{}:
+		return "an object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func suggestField(md *desc.MessageDescriptor, name string) string {
+	candidates := make([]string, 0)
+	for _, fd := range md.GetFields() {
+		candidates = append(candidates, fd.GetName(), fd.GetJSONName())
+	}
+	return suggest(name, candidates)
+}
+
+func suggestEnum(ed *desc.EnumDescriptor, name string) string {
+	candidates := make([]string, 0)
+	for _, val := range ed.GetValues() {
+		candidates = append(candidates, val.GetName())
+	}
+	return suggest(name, candidates)
+}
+
+// Returns a "did you mean" hint for the closest candidate, or an empty string if nothing is close
+func suggest(name string, candidates []string) string {
+	best, bestDistance := "", -1
+	for _, candidate := range candidates {
+		distance := editDistance(strings.ToLower(name), strings.ToLower(candidate))
+		if bestDistance == -1 || distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	// Allow roughly one typo for every three characters
+	threshold := len(name) / 3
+	if threshold < 1 {
+		threshold = 1
+	}
+	if bestDistance == -1 || bestDistance > threshold {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %q?", best)
+}
+
+// Edit distance between two strings, counting transposed characters as a single edit
+func editDistance(a, b string) int {
+	distances := make([][]int, len(a)+1)
+	for i := range distances {
+		distances[i] = make([]int, len(b)+1)
+		distances[i][0] = i
+	}
+	for j := range distances[0] {
+		distances[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			distances[i][j] = minInt(distances[i-1][j]+1, distances[i][j-1]+1, distances[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				distances[i][j] = minInt(distances[i][j], distances[i-2][j-2]+1)
+			}
+		}
+	}
+	return distances[len(a)][len(b)]
+}
+
+func minInt(first int, rest ...int) int {
+	result := first
+	for _, i := range rest {
+		if i < result {
+			result = i
+		}
+	}
+	return result
+}
@@ -0,0 +1,141 @@
+package protobuf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckJSON(t *testing.T) {
+	messageDescriptor := personDescriptor(t)
+
+	testCases := []struct {
+		Input    string
+		Errors   []Problem
+		Warnings []Problem
+	}{
+		// A valid request using both proto and JSON names has no problems
+		{
+			Input: `{
+				"name": "alice",
+				"age": "32",
+				"visits": 1e3,
+				"score": "NaN",
+				"avatar": "cmF3",
+				"color": "BLUE",
+				"address": { "zip": "94107" },
+				"tags": ["a"],
+				"previousAddresses": [{ "street": "Main" }],
+				"labels": { "env": "prod" },
+				"addresses_by_id": { "7": { "zip": "60601" } },
+				"email": "alice@example.com",
+				"phone": null
+			}`,
+		},
+		{
+			Input: `{ "nmae": "alice", "address": { "zipp": "94107" }, "fake": 1 }`,
+			Errors: []Problem{
+				{Path: "$.address.zipp", Message: `unknown field "zipp" in gurltest.Address, did you mean "zip"?`},
+				{Path: "$.fake", Message: `unknown field "fake" in gurltest.Person`},
+				{Path: "$.nmae", Message: `unknown field "nmae" in gurltest.Person, did you mean "name"?`},
+			},
+		},
+		{
+			Input: `{ "name": 1, "age": 1.5, "active": "yes", "visits": -1, "avatar": "!", "tags": "a", "address": [] }`,
+			Errors: []Problem{
+				{Path: "$.active", Message: "expected a boolean, got a string"},
+				{Path: "$.address", Message: "expected an object for gurltest.Address, got an array"},
+				{Path: "$.age", Message: `expected an int32, got "1.5"`},
+				{Path: "$.avatar", Message: `expected a base64 encoded string, got "!"`},
+				{Path: "$.name", Message: "expected a string, got a number"},
+				{Path: "$.tags", Message: "expected an array for repeated field tags, got a string"},
+				{Path: "$.visits", Message: "-1 is out of range for a uint64"},
+			},
+		},
+		{
+			Input: `{ "age": 2147483648, "tags": ["a", null, 1], "labels": { "env": 1 }, "addressesById": { "one": {} } }`,
+			Errors: []Problem{
+				{Path: `$.addressesById["one"]`, Message: `invalid map key: "one" is not a valid int32: invalid syntax`},
+				{Path: "$.age", Message: "2147483648 is out of range for an int32"},
+				{Path: `$.labels["env"]`, Message: "expected a string, got a number"},
+				{Path: "$.tags[1]", Message: "repeated field tags can't contain null"},
+				{Path: "$.tags[2]", Message: "expected a string, got a number"},
+			},
+		},
+		{
+			Input: `{ "color": "BLU" }`,
+			Errors: []Problem{
+				{Path: "$.color", Message: `invalid value "BLU" for enum gurltest.Color, did you mean "BLUE"?`},
+			},
+		},
+		{
+			Input: `{ "email": "alice@example.com", "phone": "555-1234", "name": "alice", "nickname": "al" }`,
+			Errors: []Problem{
+				{Path: "$.phone", Message: `only one field of oneof contact can be set, "email" is already set`},
+			},
+			Warnings: []Problem{
+				{Path: "$.nickname", Message: "field nickname is deprecated"},
+			},
+		},
+		{
+			Input: `{ "previous_addresses": [], "previousAddresses": [] }`,
+			Errors: []Problem{
+				{Path: "$.previous_addresses", Message: `field previous_addresses is already set by "previousAddresses"`},
+			},
+		},
+		{
+			Input: `[]`,
+			Errors: []Problem{
+				{Path: "$", Message: "expected an object for gurltest.Person, got an array"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		report, err := CheckJSON(messageDescriptor, []byte(testCase.Input))
+		if err != nil {
+			t.Errorf("Error checking %s: %s", testCase.Input, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(report.Errors, testCase.Errors) {
+			t.Errorf("Input: %s\nexpected errors: %v\ngot: %v", testCase.Input, testCase.Errors, report.Errors)
+		}
+		if !reflect.DeepEqual(report.Warnings, testCase.Warnings) {
+			t.Errorf("Input: %s\nexpected warnings: %v\ngot: %v", testCase.Input, testCase.Warnings, report.Warnings)
+		}
+		if (report.Err() != nil) != (len(testCase.Errors) > 0) {
+			t.Errorf("Input: %s\nexpected Err() to match errors, got: %v", testCase.Input, report.Err())
+		}
+	}
+
+	if _, err := CheckJSON(messageDescriptor, []byte(`{ "name": `)); err == nil {
+		t.Error("Expected error checking invalid JSON")
+	}
+}
+
+func TestCheckFormat(t *testing.T) {
+	messageDescriptor := personDescriptor(t)
+
+	report, err := CheckFormat(messageDescriptor, []byte("nmae: alice\n"), FormatYAML)
+	if err != nil {
+		t.Fatalf("Error checking YAML: %s", err.Error())
+	}
+	if len(report.Errors) != 1 || report.Errors[0].Path != "$.nmae" {
+		t.Errorf("Expected an unknown field error for $.nmae, got: %v", report.Errors)
+	}
+
+	// Empty requests and formats that can't be checked have no problems
+	for _, format := range []Format{FormatJSON, FormatProtoText, FormatBinary} {
+		input := []byte("")
+		if format != FormatJSON {
+			input = []byte("nmae: alice")
+		}
+		report, err := CheckFormat(messageDescriptor, input, format)
+		if err != nil {
+			t.Errorf("Error checking %s: %s", format, err.Error())
+			continue
+		}
+		if report.Err() != nil || len(report.Warnings) != 0 {
+			t.Errorf("Expected no problems for %s, got: %v", format, report)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package protobuf
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+// FieldAssignment is a parsed field flag in the form of path=value, or path+=value to
+// append to a repeated field.
+//
+// A path is a dot separated list of field names, where map fields are indexed with brackets:
+//
+//	name=alice
+//	address.zip=94107
+//	tags+=a
+//	labels[env]=prod
+//	addresses_by_id[1].zip=94107
+type FieldAssignment struct {
+	Path   []PathSegment
+	Append bool
+	Value  string
+}
+
+// PathSegment is a single field in a FieldAssignment path
+type PathSegment struct {
+	Field string
+	// Key is the map key for map fields, and is only meaningful when HasKey is set
+	Key    string
+	HasKey bool
+}
+
+// String prints the path the same way it's parsed
+func (p PathSegment) String() string {
+	if p.HasKey {
+		return fmt.Sprintf("%s[%s]", p.Field, p.Key)
+	}
+	return p.Field
+}
+
+// ParseFieldAssignment parses a field flag in the form of path=value or path+=value
+func ParseFieldAssignment(assignment string) (*FieldAssignment, error) {
+	depth := 0
+	for i, char := range assignment {
+		switch char {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '=':
+			if depth != 0 {
+				continue
+			}
+			rawPath, appendValue := assignment[:i], false
+			if strings.HasSuffix(rawPath, "+") {
+				rawPath, appendValue = strings.TrimSuffix(rawPath, "+"), true
+			}
+			path, err := parsePath(rawPath)
+			if err != nil {
+				return nil, err
+			}
+			return &FieldAssignment{Path: path, Append: appendValue, Value: assignment[i+1:]}, nil
+		}
+	}
+	return nil, fmt.Errorf("Field %q must be in the format '<path>=<value>' or '<path>+=<value>'", assignment)
+}
+
+func parsePath(rawPath string) ([]PathSegment, error) {
+	if rawPath == "" {
+		return nil, fmt.Errorf("Field path can't be empty")
+	}
+	path := make([]PathSegment, 0)
+	for rest := rawPath; rest != ""; {
+		end := strings.IndexAny(rest, ".[")
+		if end == -1 {
+			end = len(rest)
+		}
+		segment := PathSegment{Field: rest[:end]}
+		if segment.Field == "" {
+			return nil, fmt.Errorf("Field path %q has an empty field name", rawPath)
+		}
+		rest = rest[end:]
+
+		if strings.HasPrefix(rest, "[") {
+			closing := strings.Index(rest, "]")
+			if closing == -1 {
+				return nil, fmt.Errorf("Field path %q is missing a closing ']'", rawPath)
+			}
+			segment.Key, segment.HasKey = rest[1:closing], true
+			rest = rest[closing+1:]
+		}
+		path = append(path, segment)
+
+		if rest == "" {
+			break
+		}
+		if !strings.HasPrefix(rest, ".") || len(rest) == 1 {
+			return nil, fmt.Errorf("Field path %q is malformed near %q", rawPath, rest)
+		}
+		rest = rest[1:]
+	}
+	return path, nil
+}
+
+// SetField parses a field flag and applies it to the message, validating the path
+// and value against the message's descriptor.
+func SetField(message *dynamic.Message, assignment string) error {
+	parsed, err := ParseFieldAssignment(assignment)
+	if err != nil {
+		return err
+	}
+	return parsed.Apply(message)
+}
+
+// Apply sets the assignment's value on the message, creating any intermediate messages
+// along the path.
+func (f *FieldAssignment) Apply(message *dynamic.Message) error {
+	err := f.apply(message, 0)
+	if err != nil {
+		return fmt.Errorf("Field %s: %s", f.pathString(), err)
+	}
+	return nil
+}
+
+func (f *FieldAssignment) pathString() string {
+	segments := make([]string, len(f.Path))
+	for i, segment := range f.Path {
+		segments[i] = segment.String()
+	}
+	return strings.Join(segments, ".")
+}
+
+func (f *FieldAssignment) apply(message *dynamic.Message, depth int) error {
+	segment := f.Path[depth]
+	fd := findField(message.GetMessageDescriptor(), segment.Field)
+	if fd == nil {
+		return fmt.Errorf("%s has no field %q", message.GetMessageDescriptor().GetFullyQualifiedName(), segment.Field)
+	}
+	last := depth == len(f.Path)-1
+
+	if fd.IsMap() {
+		return f.applyMap(message, fd, segment, depth)
+	}
+	if segment.HasKey {
+		return fmt.Errorf("%s is not a map field and can't be indexed", fd.GetName())
+	}
+
+	if fd.IsRepeated() {
+		if !last {
+			return fmt.Errorf("%s is a repeated field, nested paths aren't supported", fd.GetName())
+		}
+		if !f.Append {
+			return fmt.Errorf("%s is a repeated field, use %s+=<value> to append to it", fd.GetName(), fd.GetName())
+		}
+		val, err := parseFieldValue(fd, f.Value)
+		if err != nil {
+			return err
+		}
+		return message.TryAddRepeatedField(fd, val)
+	}
+
+	if err := checkOneOf(message, fd); err != nil {
+		return err
+	}
+	if last {
+		if f.Append {
+			return fmt.Errorf("%s is not a repeated field, use = instead of +=", fd.GetName())
+		}
+		val, err := parseFieldValue(fd, f.Value)
+		if err != nil {
+			return err
+		}
+		return message.TrySetField(fd, val)
+	}
+
+	if fd.GetMessageType() == nil {
+		return fmt.Errorf("%s is not a message and has no field %q", fd.GetName(), f.Path[depth+1].Field)
+	}
+	var existing interface{}
+	if message.HasField(fd) {
+		existing = message.GetField(fd)
+	}
+	nested, err := nestedMessage(fd.GetMessageType(), existing)
+	if err != nil {
+		return err
+	}
+	if err := f.apply(nested, depth+1); err != nil {
+		return err
+	}
+	return message.TrySetField(fd, nested)
+}
+
+func (f *FieldAssignment) applyMap(message *dynamic.Message, fd *desc.FieldDescriptor, segment PathSegment, depth int) error {
+	if !segment.HasKey {
+		return fmt.Errorf("%s is a map field, use %s[<key>] to set an entry", fd.GetName(), fd.GetName())
+	}
+	key, err := parseFieldValue(fd.GetMapKeyType(), segment.Key)
+	if err != nil {
+		return fmt.Errorf("invalid key: %s", err)
+	}
+	valueType := fd.GetMapValueType()
+
+	if depth == len(f.Path)-1 {
+		if f.Append {
+			return fmt.Errorf("%s is a map field, use = instead of +=", fd.GetName())
+		}
+		val, err := parseFieldValue(valueType, f.Value)
+		if err != nil {
+			return err
+		}
+		return message.TryPutMapField(fd, key, val)
+	}
+
+	if valueType.GetMessageType() == nil {
+		return fmt.Errorf("%s values are not messages and have no field %q", fd.GetName(), f.Path[depth+1].Field)
+	}
+	existing, err := message.TryGetMapField(fd, key)
+	if err != nil {
+		return err
+	}
+	nested, err := nestedMessage(valueType.GetMessageType(), existing)
+	if err != nil {
+		return err
+	}
+	if err := f.apply(nested, depth+1); err != nil {
+		return err
+	}
+	return message.TryPutMapField(fd, key, nested)
+}
+
+// Setting a field of a oneof silently clears the field that's already set, whether by the
+// request's JSON or an earlier field flag, so that's reported the same way CheckJSON does
+func checkOneOf(message *dynamic.Message, fd *desc.FieldDescriptor) error {
+	oneOf := fd.GetOneOf()
+	if oneOf == nil {
+		return nil
+	}
+	if other, _ := message.GetOneOfField(oneOf); other != nil && other != fd {
+		return fmt.Errorf("only one field of oneof %s can be set, %q is already set", oneOf.GetName(), other.GetName())
+	}
+	return nil
+}
+
+// Returns the existing value as a dynamic message, or a new one if nothing was set
+func nestedMessage(md *desc.MessageDescriptor, existing interface{}) (*dynamic.Message, error) {
+	if msg, ok := existing.(proto.Message); ok {
+		return dynamic.AsDynamicMessage(msg)
+	}
+	return dynamic.NewMessage(md), nil
+}
+
+// Looks a field up by its proto name, falling back to its JSON name
+func findField(md *desc.MessageDescriptor, name string) *desc.FieldDescriptor {
+	if fd := md.FindFieldByName(name); fd != nil {
+		return fd
+	}
+	return md.FindFieldByJSONName(name)
+}
+
+// Parses a string into the Go type the dynamic message expects for the field
+func parseFieldValue(fd *desc.FieldDescriptor, value string) (interface{}, error) {
+	val, err := parseValue(fd, value)
+	if numErr, ok := err.(*strconv.NumError); ok {
+		typeName := strings.ToLower(strings.TrimPrefix(fd.GetType().String(), "TYPE_"))
+		return nil, fmt.Errorf("%q is not a valid %s: %s", value, typeName, numErr.Err)
+	}
+	return val, err
+}
+
+func parseValue(fd *desc.FieldDescriptor, value string) (interface{}, error) {
+	switch fd.GetType() {
+	case dpb.FieldDescriptorProto_TYPE_STRING:
+		return value, nil
+	case dpb.FieldDescriptorProto_TYPE_BYTES:
+		return parseBytes(value)
+	case dpb.FieldDescriptorProto_TYPE_BOOL:
+		return strconv.ParseBool(value)
+	case dpb.FieldDescriptorProto_TYPE_INT32, dpb.FieldDescriptorProto_TYPE_SINT32, dpb.FieldDescriptorProto_TYPE_SFIXED32:
+		val, err := strconv.ParseInt(value, 10, 32)
+		return int32(val), err
+	case dpb.FieldDescriptorProto_TYPE_INT64, dpb.FieldDescriptorProto_TYPE_SINT64, dpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return strconv.ParseInt(value, 10, 64)
+	case dpb.FieldDescriptorProto_TYPE_UINT32, dpb.FieldDescriptorProto_TYPE_FIXED32:
+		val, err := strconv.ParseUint(value, 10, 32)
+		return uint32(val), err
+	case dpb.FieldDescriptorProto_TYPE_UINT64, dpb.FieldDescriptorProto_TYPE_FIXED64:
+		return strconv.ParseUint(value, 10, 64)
+	case dpb.FieldDescriptorProto_TYPE_FLOAT:
+		val, err := strconv.ParseFloat(value, 32)
+		return float32(val), err
+	case dpb.FieldDescriptorProto_TYPE_DOUBLE:
+		return strconv.ParseFloat(value, 64)
+	case dpb.FieldDescriptorProto_TYPE_ENUM:
+		return parseEnumValue(fd.GetEnumType(), value)
+	case dpb.FieldDescriptorProto_TYPE_MESSAGE, dpb.FieldDescriptorProto_TYPE_GROUP:
+		// Messages are given as JSON, which also covers well known types such as timestamps
+		message, err := Construct(fd.GetMessageType(), []byte(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON for %s: %s", fd.GetMessageType().GetFullyQualifiedName(), err)
+		}
+		return message, nil
+	}
+	return nil, fmt.Errorf("unsupported field type %s", fd.GetType())
+}
+
+// Bytes are base64 encoded like they are in JSON, which accepts the standard and URL safe
+// alphabets, with or without padding
+func parseBytes(value string) ([]byte, error) {
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if decoded, err := encoding.DecodeString(value); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, fmt.Errorf("%q is not valid base64", value)
+}
+
+func parseEnumValue(ed *desc.EnumDescriptor, value string) (int32, error) {
+	if val := ed.FindValueByName(value); val != nil {
+		return val.GetNumber(), nil
+	}
+	if number, err := strconv.ParseInt(value, 10, 32); err == nil {
+		if val := ed.FindValueByNumber(int32(number)); val != nil {
+			return val.GetNumber(), nil
+		}
+	}
+	names := make([]string, 0)
+	for _, val := range ed.GetValues() {
+		names = append(names, val.GetName())
+	}
+	return 0, fmt.Errorf("%q is not a valid %s, must be one of %s", value, ed.GetFullyQualifiedName(), strings.Join(names, ", "))
+}
@@ -0,0 +1,202 @@
+package protobuf
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+func TestParseFieldAssignment(t *testing.T) {
+	testCases := []struct {
+		Input    string
+		Expected *FieldAssignment
+		IsErr    bool
+	}{
+		{
+			Input: "name=alice",
+			Expected: &FieldAssignment{
+				Path:  []PathSegment{{Field: "name"}},
+				Value: "alice",
+			},
+		},
+		{
+			Input: "address.zip=94107",
+			Expected: &FieldAssignment{
+				Path:  []PathSegment{{Field: "address"}, {Field: "zip"}},
+				Value: "94107",
+			},
+		},
+		{
+			Input: "tags+=a=b",
+			Expected: &FieldAssignment{
+				Path:   []PathSegment{{Field: "tags"}},
+				Append: true,
+				Value:  "a=b",
+			},
+		},
+		{
+			Input: "labels[a.b=c]=prod",
+			Expected: &FieldAssignment{
+				Path:  []PathSegment{{Field: "labels", Key: "a.b=c", HasKey: true}},
+				Value: "prod",
+			},
+		},
+		{
+			Input: "addresses_by_id[1].zip=",
+			Expected: &FieldAssignment{
+				Path:  []PathSegment{{Field: "addresses_by_id", Key: "1", HasKey: true}, {Field: "zip"}},
+				Value: "",
+			},
+		},
+		{Input: "name", IsErr: true},
+		{Input: "=alice", IsErr: true},
+		{Input: "address..zip=94107", IsErr: true},
+		{Input: "address.=94107", IsErr: true},
+		{Input: "labels[env=prod", IsErr: true},
+		{Input: "labels[env]zip=prod", IsErr: true},
+	}
+
+	for _, testCase := range testCases {
+		assignment, err := ParseFieldAssignment(testCase.Input)
+		if (err != nil) != testCase.IsErr {
+			t.Errorf("Input: %s, expected error: %t, got: %v", testCase.Input, testCase.IsErr, err)
+		}
+		if !reflect.DeepEqual(assignment, testCase.Expected) {
+			t.Errorf("Input: %s, expected: %#v\ngot: %#v", testCase.Input, testCase.Expected, assignment)
+		}
+	}
+}
+
+func TestSetField(t *testing.T) {
+	messageDescriptor := personDescriptor(t)
+	message := dynamic.NewMessage(messageDescriptor)
+
+	assignments := []string{
+		"name=alice",
+		"age=32",
+		"active=true",
+		"score=9.5",
+		"visits=18446744073709551615",
+		// Bytes are base64, in either alphabet and with or without padding
+		"avatar=cmF3Pz8-",
+		"color=BLUE",
+		"address.street=Main",
+		"address.zip=94107",
+		"tags+=a",
+		"tags+=b",
+		`previous_addresses+={"zip": "10001"}`,
+		"labels[env]=prod",
+		"addresses_by_id[7].zip=60601",
+		"addresses_by_id[7].street=State",
+		// JSON names work as well as proto names
+		"previousAddresses+={}",
+	}
+	for _, assignment := range assignments {
+		if err := SetField(message, assignment); err != nil {
+			t.Fatalf("Error setting %s: %s", assignment, err.Error())
+		}
+	}
+
+	expected := dynamic.NewMessage(messageDescriptor)
+	err := expected.UnmarshalJSON([]byte(`{
+		"name": "alice",
+		"age": 32,
+		"active": true,
+		"score": 9.5,
+		"visits": "18446744073709551615",
+		"avatar": "cmF3Pz8+",
+		"color": "BLUE",
+		"address": { "street": "Main", "zip": "94107" },
+		"tags": ["a", "b"],
+		"previousAddresses": [{ "zip": "10001" }, {}],
+		"labels": { "env": "prod" },
+		"addressesById": { "7": { "street": "State", "zip": "60601" } }
+	}`))
+	if err != nil {
+		t.Fatalf("Error unmarshalling expected message: %s", err.Error())
+	}
+	if !dynamic.Equal(message, expected) {
+		t.Errorf("Expected: %s\ngot: %s", expected.String(), message.String())
+	}
+}
+
+func TestSetFieldErrors(t *testing.T) {
+	messageDescriptor := personDescriptor(t)
+
+	invalid := []string{
+		// Unknown fields
+		"fake=news",
+		"address.fake=news",
+		// Type mismatches
+		"age=old",
+		"age=99999999999",
+		"active=maybe",
+		"address={",
+		// Invalid enum names and numbers
+		"color=GREEN",
+		"color=9",
+		// Wrong operator for the field's cardinality
+		"tags=a",
+		"name+=alice",
+		"labels[env]+=prod",
+		// Paths that don't match the shape of the message
+		"name.first=alice",
+		"labels=prod",
+		"labels[env].zip=prod",
+		"name[0]=alice",
+		"addresses_by_id[one].zip=94107",
+		"previous_addresses.zip=94107",
+		"avatar=not base64!",
+	}
+	for _, assignment := range invalid {
+		message := dynamic.NewMessage(messageDescriptor)
+		if err := SetField(message, assignment); err == nil {
+			t.Errorf("Expected error setting %s", assignment)
+		}
+	}
+}
+
+func TestSetFieldOneOf(t *testing.T) {
+	messageDescriptor := personDescriptor(t)
+	testCases := []struct {
+		// Request the fields are applied on top of
+		JSON   string
+		Fields []string
+		IsErr  bool
+	}{
+		{JSON: `{}`, Fields: []string{"email=a@example.com", "email=b@example.com"}},
+		{JSON: `{"email": "a@example.com"}`, Fields: []string{"email=b@example.com"}},
+		{JSON: `{}`, Fields: []string{"email=a@example.com", "phone=555-0100"}, IsErr: true},
+		{JSON: `{"email": "a@example.com"}`, Fields: []string{"phone=555-0100"}, IsErr: true},
+	}
+	for _, testCase := range testCases {
+		message := dynamic.NewMessage(messageDescriptor)
+		if err := message.UnmarshalJSON([]byte(testCase.JSON)); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		for _, field := range testCase.Fields {
+			if err = SetField(message, field); err != nil {
+				break
+			}
+		}
+		if testCase.IsErr != (err != nil) {
+			t.Errorf("JSON: %s, fields: %q, expected error: %t, got: %v", testCase.JSON, testCase.Fields, testCase.IsErr, err)
+		}
+	}
+}
+
+// Helper to get the gurltest.Person descriptor from the testdata folder
+func personDescriptor(t *testing.T) *desc.MessageDescriptor {
+	descriptors, err := Collect([]string{}, absolutePathify([]string{"./testdata/"}))
+	if err != nil {
+		t.Fatalf("Error collecting test descriptors: %s", err.Error())
+	}
+	messageDescriptor, err := NewCollector(descriptors).GetMessage("gurltest.Person")
+	if err != nil {
+		t.Fatalf("Error getting message descriptor: %s", err.Error())
+	}
+	return messageDescriptor
+}
@@ -0,0 +1,121 @@
+package protobuf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wearefair/gurl/pkg/log"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Format is an encoding that a request message can be read from
+type Format string
+
+const (
+	// FormatJSON is the protobuf JSON mapping. This is the default format.
+	FormatJSON Format = "json"
+	// FormatYAML is YAML that follows the same field naming as the JSON mapping.
+	FormatYAML Format = "yaml"
+	// FormatProtoText is the protobuf text format.
+	FormatProtoText Format = "prototext"
+	// FormatBinary is the protobuf wire format.
+	FormatBinary Format = "binary"
+)
+
+// Formats lists every supported input format
+var Formats = []Format{FormatJSON, FormatYAML, FormatProtoText, FormatBinary}
+
+// ParseFormat returns the Format matching name, or an error if it isn't supported.
+// An empty name returns FormatJSON.
+func ParseFormat(name string) (Format, error) {
+	if name == "" {
+		return FormatJSON, nil
+	}
+	for _, format := range Formats {
+		if strings.EqualFold(name, string(format)) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("Unsupported format %q, must be one of %s", name, formatNames())
+}
+
+func formatNames() string {
+	names := make([]string, len(Formats))
+	for i, format := range Formats {
+		names[i] = string(format)
+	}
+	return strings.Join(names, "|")
+}
+
+// ConstructFormat takes a message descriptor and a message encoded in the given format and
+// returns it as a message, or an error if it can't be decoded. An empty request returns an
+// empty message.
+func ConstructFormat(messageDescriptor *desc.MessageDescriptor, request []byte, format Format) (*dynamic.Message, error) {
+	if format != FormatBinary {
+		request = bytes.TrimSpace(request)
+	}
+	if len(request) == 0 {
+		return dynamic.NewMessage(messageDescriptor), nil
+	}
+
+	switch format {
+	case FormatJSON, "":
+		return Construct(messageDescriptor, request)
+	case FormatYAML:
+		converted, err := yamlToJSON(request)
+		if err != nil {
+			return nil, log.LogAndReturn(err)
+		}
+		return Construct(messageDescriptor, converted)
+	case FormatProtoText:
+		message := dynamic.NewMessage(messageDescriptor)
+		if err := message.UnmarshalText(request); err != nil {
+			return nil, log.LogAndReturn(err)
+		}
+		return message, nil
+	case FormatBinary:
+		message := dynamic.NewMessage(messageDescriptor)
+		if err := message.Unmarshal(request); err != nil {
+			return nil, log.LogAndReturn(err)
+		}
+		return message, nil
+	}
+	return nil, log.LogAndReturn(fmt.Errorf("Unsupported format %q", format))
+}
+
+// Converts a YAML document into JSON so it can be handed off to the JSON unmarshaler
+func yamlToJSON(in []byte) ([]byte, error) {
+	var decoded interface{}
+	if err := yaml.Unmarshal(in, &decoded); err != nil {
+		return nil, err
+	}
+	return json.Marshal(normalizeYAML(decoded))
+}
+
+// YAML allows non-string map keys, which encoding/json can't marshal, so stringify them
+func normalizeYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			v[key] = normalizeYAML(val)
+		}
+		return v
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			converted[fmt.Sprint(key)] = normalizeYAML(val)
+		}
+		return converted
+	case []interface{}:
+		for i, val := range v {
+			v[i] = normalizeYAML(val)
+		}
+		return v
+	}
+	return value
+}
@@ -0,0 +1,88 @@
+package protobuf
+
+import (
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+func TestParseFormat(t *testing.T) {
+	testCases := []struct {
+		Input    string
+		Expected Format
+		IsErr    bool
+	}{
+		{Input: "", Expected: FormatJSON},
+		{Input: "json", Expected: FormatJSON},
+		{Input: "YAML", Expected: FormatYAML},
+		{Input: "prototext", Expected: FormatProtoText},
+		{Input: "binary", Expected: FormatBinary},
+		{Input: "xml", IsErr: true},
+	}
+
+	for _, testCase := range testCases {
+		format, err := ParseFormat(testCase.Input)
+		if (err != nil) != testCase.IsErr {
+			t.Errorf("Expected error: %t, got: %v", testCase.IsErr, err)
+		}
+		if format != testCase.Expected {
+			t.Errorf("Expected: %s, got: %s", testCase.Expected, format)
+		}
+	}
+}
+
+func TestConstructFormat(t *testing.T) {
+	messageDescriptor := helloRequestDescriptor(t)
+
+	populated := dynamic.NewMessage(messageDescriptor)
+	populated.SetFieldByName("name", "cat")
+	binary, err := populated.Marshal()
+	if err != nil {
+		t.Fatalf("Error marshalling message %s", err.Error())
+	}
+
+	testCases := []struct {
+		Input    []byte
+		Format   Format
+		Expected string
+	}{
+		{Input: []byte(`{ "name": "cat" }`), Format: FormatJSON, Expected: "cat"},
+		{Input: []byte("name: cat\n"), Format: FormatYAML, Expected: "cat"},
+		{Input: []byte(`name: "cat"`), Format: FormatProtoText, Expected: "cat"},
+		{Input: binary, Format: FormatBinary, Expected: "cat"},
+		// Empty requests construct an empty message in every format
+		{Input: []byte(""), Format: FormatJSON, Expected: ""},
+		{Input: []byte(" \n"), Format: FormatYAML, Expected: ""},
+		{Input: []byte{}, Format: FormatBinary, Expected: ""},
+	}
+
+	for _, testCase := range testCases {
+		constructed, err := ConstructFormat(messageDescriptor, testCase.Input, testCase.Format)
+		if err != nil {
+			t.Errorf("Error constructing %s message %s", testCase.Format, err.Error())
+			continue
+		}
+		val := constructed.GetFieldByName("name")
+		if val != testCase.Expected {
+			t.Errorf("Expected field name: %s, got: %s", testCase.Expected, val)
+		}
+	}
+
+	if _, err := ConstructFormat(messageDescriptor, []byte("name: [cat"), FormatYAML); err == nil {
+		t.Error("Expected error constructing message from invalid YAML")
+	}
+}
+
+// Helper to get the helloworld.HelloRequest descriptor from the test folder
+func helloRequestDescriptor(t *testing.T) *desc.MessageDescriptor {
+	descriptors, err := Collect([]string{}, absolutePathify([]string{"./test/"}))
+	if err != nil {
+		t.Fatalf("Error collecting test descriptors: %s", err.Error())
+	}
+	messageDescriptor, err := NewCollector(descriptors).GetMessage("helloworld.HelloRequest")
+	if err != nil {
+		t.Fatalf("Error getting message descriptor: %s", err.Error())
+	}
+	return messageDescriptor
+}
@@ -0,0 +1,132 @@
+package protobuf
+
+import (
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wearefair/gurl/pkg/log"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field number of the debug_redact field option. It's newer than the descriptor.proto gurl is
+// built with, so it's read from the options' unknown fields.
+const debugRedactField = 16
+
+// Redact returns a copy of the message with its sensitive fields masked, for logging. Fields
+// are sensitive when they're marked with the debug_redact option or listed in fields by their
+// fully qualified name, such as users.User.password. String and bytes values are replaced
+// and any other values are cleared.
+func Redact(message *dynamic.Message, fields []string) *dynamic.Message {
+	sensitive := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		sensitive[field] = true
+	}
+	// Round tripped so that nested messages aren't shared with the original
+	redacted := dynamic.NewMessage(message.GetMessageDescriptor())
+	raw, err := message.Marshal()
+	if err != nil {
+		return redacted
+	}
+	if err := redacted.Unmarshal(raw); err != nil {
+		return redacted
+	}
+	redact(redacted, sensitive)
+	return redacted
+}
+
+func redact(message *dynamic.Message, sensitive map[string]bool) {
+	for _, fd := range message.GetKnownFields() {
+		if !message.HasField(fd) {
+			continue
+		}
+		if sensitive[fd.GetFullyQualifiedName()] || debugRedact(fd) {
+			mask(message, fd)
+			continue
+		}
+		if fd.GetMessageType() == nil {
+			continue
+		}
+		switch {
+		case fd.IsMap():
+			if fd.GetMapValueType().GetMessageType() == nil {
+				continue
+			}
+			for _, val := range message.GetField(fd).(map[interface{}]interface{}) {
+				redactValue(val, sensitive)
+			}
+		case fd.IsRepeated():
+			for _, val := range message.GetField(fd).([]interface{}) {
+				redactValue(val, sensitive)
+			}
+		default:
+			redactValue(message.GetField(fd), sensitive)
+		}
+	}
+}
+
+// Nested messages are dynamic when they were constructed by gurl, and only walked if they are
+func redactValue(val interface{}, sensitive map[string]bool) {
+	if nested, ok := val.(*dynamic.Message); ok && nested != nil {
+		redact(nested, sensitive)
+	}
+}
+
+func mask(message *dynamic.Message, fd *desc.FieldDescriptor) {
+	var masked interface{}
+	valueType := fd.GetType()
+	if fd.IsMap() {
+		valueType = fd.GetMapValueType().GetType()
+	}
+	switch valueType {
+	case dpb.FieldDescriptorProto_TYPE_STRING:
+		masked = log.Redacted
+	case dpb.FieldDescriptorProto_TYPE_BYTES:
+		masked = []byte(log.Redacted)
+	default:
+		message.ClearField(fd)
+		return
+	}
+
+	switch {
+	case fd.IsMap():
+		for key := range message.GetField(fd).(map[interface{}]interface{}) {
+			message.PutMapField(fd, key, masked)
+		}
+	case fd.IsRepeated():
+		for i := 0; i < message.FieldLength(fd); i++ {
+			message.SetRepeatedField(fd, i, masked)
+		}
+	default:
+		message.SetField(fd, masked)
+	}
+}
+
+// Reports whether the field is marked with [debug_redact = true]
+func debugRedact(fd *desc.FieldDescriptor) bool {
+	options := fd.GetFieldOptions()
+	if options == nil {
+		return false
+	}
+	raw, err := proto.Marshal(options)
+	if err != nil {
+		return false
+	}
+	for len(raw) > 0 {
+		num, typ, n := protowire.ConsumeTag(raw)
+		if n < 0 {
+			return false
+		}
+		raw = raw[n:]
+		if num == debugRedactField && typ == protowire.VarintType {
+			val, n := protowire.ConsumeVarint(raw)
+			return n > 0 && val != 0
+		}
+		n = protowire.ConsumeFieldValue(num, typ, raw)
+		if n < 0 {
+			return false
+		}
+		raw = raw[n:]
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package protobuf
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestRedact(t *testing.T) {
+	messageDescriptor := personDescriptor(t)
+	input := `{
+		"name": "alice",
+		"age": 30,
+		"avatar": "aGk=",
+		"address": {"street": "1 Main St", "zip": "94107"},
+		"tags": ["a", "b"],
+		"previous_addresses": [{"street": "2 Main St", "zip": "94108"}],
+		"labels": {"env": "prod"},
+		"addresses_by_id": {"1": {"street": "3 Main St", "zip": "94109"}}
+	}`
+	message, err := Construct(messageDescriptor, []byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		Fields   []string
+		Expected string
+	}{
+		{
+			Fields:   nil,
+			Expected: `{"name":"alice","age":30,"avatar":"aGk=","address":{"street":"1 Main St","zip":"94107"},"tags":["a","b"],"previousAddresses":[{"street":"2 Main St","zip":"94108"}],"labels":{"env":"prod"},"addressesById":{"1":{"street":"3 Main St","zip":"94109"}}}`,
+		},
+		{
+			Fields:   []string{"gurltest.Person.name", "gurltest.Person.age", "gurltest.Person.avatar", "gurltest.Person.tags", "gurltest.Person.labels"},
+			Expected: `{"name":"[REDACTED]","avatar":"W1JFREFDVEVEXQ==","address":{"street":"1 Main St","zip":"94107"},"tags":["[REDACTED]","[REDACTED]"],"previousAddresses":[{"street":"2 Main St","zip":"94108"}],"labels":{"env":"[REDACTED]"},"addressesById":{"1":{"street":"3 Main St","zip":"94109"}}}`,
+		},
+		{
+			// Nested, repeated and map messages are walked
+			Fields:   []string{"gurltest.Address.street"},
+			Expected: `{"name":"alice","age":30,"avatar":"aGk=","address":{"street":"[REDACTED]","zip":"94107"},"tags":["a","b"],"previousAddresses":[{"street":"[REDACTED]","zip":"94108"}],"labels":{"env":"prod"},"addressesById":{"1":{"street":"[REDACTED]","zip":"94109"}}}`,
+		},
+		{
+			Fields:   []string{"gurltest.Person.address"},
+			Expected: `{"name":"alice","age":30,"avatar":"aGk=","tags":["a","b"],"previousAddresses":[{"street":"2 Main St","zip":"94108"}],"labels":{"env":"prod"},"addressesById":{"1":{"street":"3 Main St","zip":"94109"}}}`,
+		},
+	}
+
+	marshaler := &jsonpb.Marshaler{}
+	for _, testCase := range testCases {
+		redacted, err := marshaler.MarshalToString(Redact(message, testCase.Fields))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if redacted != testCase.Expected {
+			t.Errorf("Fields %v: expected: %s\ngot: %s", testCase.Fields, testCase.Expected, redacted)
+		}
+	}
+
+	// The original message is left alone
+	if message.GetFieldByName("name") != "alice" || message.GetFieldByName("address").(*dynamic.Message).GetFieldByName("street") != "1 Main St" {
+		t.Error("Expected the original message to be unchanged")
+	}
+}
+
+func TestRedactDebugRedactOption(t *testing.T) {
+	// protoparse's descriptor.proto predates debug_redact, so the option is set by hand as an
+	// unknown field, the same way it's parsed against a newer descriptor.proto
+	options := &dpb.FieldOptions{}
+	options.ProtoReflect().SetUnknown(protowire.AppendVarint(protowire.AppendTag(nil, debugRedactField, protowire.VarintType), 1))
+	fileProto := &dpb.FileDescriptorProto{
+		Name:    proto.String("login.proto"),
+		Package: proto.String("gurltest"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*dpb.DescriptorProto{{
+			Name: proto.String("Login"),
+			Field: []*dpb.FieldDescriptorProto{
+				{
+					Name:     proto.String("user"),
+					JsonName: proto.String("user"),
+					Number:   proto.Int32(1),
+					Label:    dpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					Type:     dpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+				},
+				{
+					Name:     proto.String("password"),
+					JsonName: proto.String("password"),
+					Number:   proto.Int32(2),
+					Label:    dpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					Type:     dpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+					Options:  options,
+				},
+			},
+		}},
+	}
+	fileDescriptor, err := desc.CreateFileDescriptor(fileProto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := Construct(fileDescriptor.FindMessage("gurltest.Login"), []byte(`{"user": "alice", "password": "hunter2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	redacted, err := (&jsonpb.Marshaler{}).MarshalToString(Redact(message, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"user":"alice","password":"[REDACTED]"}`
+	if redacted != expected {
+		t.Errorf("Expected: %s\ngot: %s", expected, redacted)
+	}
+}
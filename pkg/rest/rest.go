@@ -0,0 +1,457 @@
+// Package rest calls methods through their google.api.http annotations, for services that are
+// only exposed through a REST gateway such as grpc-gateway or Envoy's gRPC-JSON transcoder.
+// Fields are mapped onto the path, query string and body as described in
+// https://github.com/googleapis/googleapis/blob/master/google/api/http.proto
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wearefair/gurl/pkg/log"
+	"github.com/wearefair/gurl/pkg/util"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Transport sends calls to a REST gateway. Implements jsonpb.Transport.
+type Transport struct {
+	client *http.Client
+	// Scheme and host the calls are sent to, e.g. https://api.example.com:443
+	baseURL string
+}
+
+// NewTransport creates a transport that sends calls to the base URL with the client
+func NewTransport(client *http.Client, baseURL string) *Transport {
+	return &Transport{
+		client:  client,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Rule returns the google.api.http rule of the method, or nil if it isn't annotated
+func Rule(methodDescriptor *desc.MethodDescriptor) (*annotations.HttpRule, error) {
+	options := methodDescriptor.GetMethodOptions()
+	if options == nil {
+		return nil, nil
+	}
+	// Options parsed from source can hold the extension as unknown fields, so they're round
+	// tripped through the wire format to resolve it
+	raw, err := proto.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	parsed := &descriptor.MethodOptions{}
+	if err := proto.Unmarshal(raw, parsed); err != nil {
+		return nil, err
+	}
+	if !proto.HasExtension(parsed, annotations.E_Http) {
+		return nil, nil
+	}
+	rule, err := proto.GetExtension(parsed, annotations.E_Http)
+	if err != nil {
+		return nil, err
+	}
+	return rule.(*annotations.HttpRule), nil
+}
+
+// Invoke sends the request to the method's REST endpoint and maps the JSON response back to
+// the output message. Errors are converted to gRPC statuses.
+func (t *Transport) Invoke(ctx context.Context, methodDescriptor *desc.MethodDescriptor, request proto.Message) (proto.Message, error) {
+	rule, err := Rule(methodDescriptor)
+	if err != nil {
+		return nil, err
+	}
+	if rule == nil {
+		return nil, fmt.Errorf("Method %s has no google.api.http annotation", methodDescriptor.GetFullyQualifiedName())
+	}
+	message, err := dynamic.AsDynamicMessage(request)
+	if err != nil {
+		return nil, err
+	}
+	method, path, body, err := transcode(rule, message)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := t.baseURL + path
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header = util.HeadersFromContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// grpc-gateway passes the deadline on to the service
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set("Grpc-Timeout", util.EncodeTimeout(time.Until(deadline)))
+	}
+
+	// The path and query string hold request fields, which can be sensitive, so only the
+	// template is logged
+	if _, template, err := pattern(rule); err == nil {
+		log.Infof("rest - %s %s%s", method, t.baseURL, template)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, status.Error(codes.DeadlineExceeded, err.Error())
+		}
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, responseError(resp, respBody)
+	}
+
+	response := dynamic.NewMessage(methodDescriptor.GetOutputType())
+	if len(bytes.TrimSpace(respBody)) == 0 {
+		return response, nil
+	}
+	// The body is only one field of the response when response_body is set
+	if field := rule.GetResponseBody(); field != "" {
+		if respBody, err = json.Marshal(map[string]json.RawMessage{field: respBody}); err != nil {
+			return nil, err
+		}
+	}
+	if err := response.UnmarshalJSONPB(&jsonpb.Unmarshaler{AllowUnknownFields: true}, respBody); err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to unmarshal response: %s", err)
+	}
+	return response, nil
+}
+
+// Maps the message onto the rule, returning the HTTP method, the path with the query string
+// and the body, which is nil if the rule has no body
+func transcode(rule *annotations.HttpRule, message *dynamic.Message) (string, string, []byte, error) {
+	method, template, err := pattern(rule)
+	if err != nil {
+		return "", "", nil, err
+	}
+	path, bound, err := expandPath(template, message)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	var body []byte
+	query := url.Values{}
+	switch field := rule.GetBody(); field {
+	case "":
+		// Every field that isn't in the path goes in the query string
+		err = addQuery(query, "", message, bound)
+	case "*":
+		// Every field that isn't in the path goes in the body
+		body, err = marshalWithout(message, bound)
+	default:
+		body, err = marshalField(message, field)
+		bound[field] = true
+		if err == nil {
+			err = addQuery(query, "", message, bound)
+		}
+	}
+	if err != nil {
+		return "", "", nil, err
+	}
+	if len(query) != 0 {
+		path += "?" + query.Encode()
+	}
+	return method, path, body, nil
+}
+
+// Returns the HTTP method and path template of the rule
+func pattern(rule *annotations.HttpRule) (string, string, error) {
+	switch p := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		return http.MethodGet, p.Get, nil
+	case *annotations.HttpRule_Put:
+		return http.MethodPut, p.Put, nil
+	case *annotations.HttpRule_Post:
+		return http.MethodPost, p.Post, nil
+	case *annotations.HttpRule_Delete:
+		return http.MethodDelete, p.Delete, nil
+	case *annotations.HttpRule_Patch:
+		return http.MethodPatch, p.Patch, nil
+	case *annotations.HttpRule_Custom:
+		return p.Custom.GetKind(), p.Custom.GetPath(), nil
+	}
+	return "", "", fmt.Errorf("google.api.http rule has no HTTP method")
+}
+
+// Replaces the variables in the path template, e.g. /v1/{name=shelves/*} or /v1/{shelf.id},
+// with the fields of the message. Returns the path and the field paths that were used.
+func expandPath(template string, message *dynamic.Message) (string, map[string]bool, error) {
+	bound := map[string]bool{}
+	var path strings.Builder
+	for {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			path.WriteString(template)
+			return path.String(), bound, nil
+		}
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			return "", nil, fmt.Errorf("Invalid path template %q: unclosed variable", template)
+		}
+		end += start
+		path.WriteString(template[:start])
+
+		fieldPath, segments := template[start+1:end], "*"
+		if i := strings.Index(fieldPath, "="); i >= 0 {
+			fieldPath, segments = fieldPath[:i], fieldPath[i+1:]
+		}
+		value, err := pathValue(message, fieldPath)
+		if err != nil {
+			return "", nil, err
+		}
+		// Variables matching a single segment escape slashes, ones matching several keep them
+		if segments == "*" {
+			path.WriteString(url.PathEscape(value))
+		} else {
+			parts := strings.Split(value, "/")
+			for i, part := range parts {
+				parts[i] = url.PathEscape(part)
+			}
+			path.WriteString(strings.Join(parts, "/"))
+		}
+		bound[fieldPath] = true
+		template = template[end+1:]
+	}
+}
+
+// Returns the formatted value of the field at the dotted path, which must be set
+func pathValue(message *dynamic.Message, fieldPath string) (string, error) {
+	names := strings.Split(fieldPath, ".")
+	for i, name := range names {
+		fd := message.GetMessageDescriptor().FindFieldByName(name)
+		if fd == nil {
+			return "", fmt.Errorf("Path parameter %s isn't a field of %s", fieldPath, message.GetMessageDescriptor().GetFullyQualifiedName())
+		}
+		if fd.IsRepeated() {
+			return "", fmt.Errorf("Path parameter %s can't be a repeated field", fieldPath)
+		}
+		if !message.HasField(fd) {
+			return "", fmt.Errorf("Path parameter %s must be set", fieldPath)
+		}
+		if i == len(names)-1 {
+			value, err := formatValue(fd, message.GetField(fd))
+			if err != nil {
+				return "", err
+			}
+			if value == "" {
+				return "", fmt.Errorf("Path parameter %s must be set", fieldPath)
+			}
+			return value, nil
+		}
+		nested, ok := message.GetField(fd).(*dynamic.Message)
+		if !ok || nested == nil {
+			return "", fmt.Errorf("Path parameter %s: %s isn't a message", fieldPath, name)
+		}
+		message = nested
+	}
+	return "", fmt.Errorf("Path parameter is empty")
+}
+
+// Adds the fields of the message that are set and aren't bound to the query string, naming
+// nested fields by their dotted path
+func addQuery(query url.Values, prefix string, message *dynamic.Message, bound map[string]bool) error {
+	for _, fd := range message.GetKnownFields() {
+		name := prefix + fd.GetName()
+		if bound[name] || !message.HasField(fd) {
+			continue
+		}
+		value := message.GetField(fd)
+		switch {
+		case fd.IsMap():
+			return fmt.Errorf("Map field %s can't be sent in the query string", name)
+		case fd.IsRepeated():
+			items, _ := value.([]interface{})
+			for _, item := range items {
+				formatted, err := formatValue(fd, item)
+				if err != nil {
+					return err
+				}
+				query.Add(name, formatted)
+			}
+		case fd.GetMessageType() != nil && !wellKnown(fd.GetMessageType()):
+			nested, ok := value.(*dynamic.Message)
+			if !ok || nested == nil {
+				continue
+			}
+			if err := addQuery(query, name+".", nested, bound); err != nil {
+				return err
+			}
+		default:
+			formatted, err := formatValue(fd, value)
+			if err != nil {
+				return err
+			}
+			query.Add(name, formatted)
+		}
+	}
+	return nil
+}
+
+// Formats a single value for the path or query string
+func formatValue(fd *desc.FieldDescriptor, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return base64.URLEncoding.EncodeToString(v), nil
+	case int32:
+		if enum := fd.GetEnumType(); enum != nil {
+			if enumValue := enum.FindValueByNumber(v); enumValue != nil {
+				return enumValue.GetName(), nil
+			}
+		}
+		return strconv.FormatInt(int64(v), 10), nil
+	case proto.Message:
+		// Well known types, such as timestamps and wrappers, are sent in their JSON form
+		marshaled, err := (&jsonpb.Marshaler{}).MarshalToString(v)
+		if err != nil {
+			return "", err
+		}
+		var formatted string
+		if err := json.Unmarshal([]byte(marshaled), &formatted); err == nil {
+			return formatted, nil
+		}
+		if strings.HasPrefix(marshaled, "{") {
+			return "", fmt.Errorf("Message field %s can't be sent in the path or query string", fd.GetName())
+		}
+		return marshaled, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// Well known types have a scalar JSON form, so they're sent whole rather than field by field
+func wellKnown(md *desc.MessageDescriptor) bool {
+	return strings.HasPrefix(md.GetFullyQualifiedName(), "google.protobuf.")
+}
+
+// Marshals the message as JSON without the bound fields
+func marshalWithout(message *dynamic.Message, bound map[string]bool) ([]byte, error) {
+	// Copied through the wire format so the nested messages of the request aren't modified
+	raw, err := message.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	body := dynamic.NewMessage(message.GetMessageDescriptor())
+	if err := body.Unmarshal(raw); err != nil {
+		return nil, err
+	}
+	for fieldPath := range bound {
+		clearField(body, strings.Split(fieldPath, "."))
+	}
+	return marshalJSON(body)
+}
+
+func clearField(message *dynamic.Message, names []string) {
+	fd := message.GetMessageDescriptor().FindFieldByName(names[0])
+	if fd == nil || !message.HasField(fd) {
+		return
+	}
+	if len(names) == 1 {
+		message.ClearField(fd)
+		return
+	}
+	if nested, ok := message.GetField(fd).(*dynamic.Message); ok && nested != nil {
+		clearField(nested, names[1:])
+	}
+}
+
+// Marshals a top level field of the message as JSON
+func marshalField(message *dynamic.Message, field string) ([]byte, error) {
+	fd := message.GetMessageDescriptor().FindFieldByName(field)
+	if fd == nil {
+		return nil, fmt.Errorf("Body %s isn't a field of %s", field, message.GetMessageDescriptor().GetFullyQualifiedName())
+	}
+	marshaled, err := marshalJSON(message)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(marshaled, &fields); err != nil {
+		return nil, err
+	}
+	if value, ok := fields[field]; ok {
+		return value, nil
+	}
+	// Unset fields are left out of the JSON
+	switch {
+	case fd.IsRepeated() && !fd.IsMap():
+		return []byte("[]"), nil
+	case fd.GetMessageType() != nil:
+		return []byte("{}"), nil
+	}
+	return nil, fmt.Errorf("Body field %s must be set", field)
+}
+
+func marshalJSON(message *dynamic.Message) ([]byte, error) {
+	marshaled, err := (&jsonpb.Marshaler{OrigName: true}).MarshalToString(message)
+	return []byte(marshaled), err
+}
+
+// Returns the error from a failed call, read from the google.rpc.Status style body that
+// gateways send or mapped from the HTTP status
+func responseError(resp *http.Response, body []byte) error {
+	var gatewayError struct {
+		Code    int32  `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &gatewayError); err == nil && gatewayError.Code != 0 {
+		return status.Error(codes.Code(gatewayError.Code), gatewayError.Message)
+	}
+	return status.Errorf(httpStatusToCode(resp.StatusCode), "REST request failed with HTTP status %s", resp.Status)
+}
+
+// Maps an HTTP status to the code it's transcoded from, the reverse of
+// https://github.com/googleapis/googleapis/blob/master/google/rpc/code.proto
+func httpStatusToCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case 499:
+		return codes.Canceled
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusInternalServerError:
+		return codes.Internal
+	}
+	return codes.Unknown
+}
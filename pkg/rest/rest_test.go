@@ -0,0 +1,190 @@
+package rest
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wearefair/gurl/pkg/protobuf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestTranscode(t *testing.T) {
+	service := createService(t)
+
+	testCases := []struct {
+		Method   string
+		Request  string
+		Expected string
+		Body     string
+	}{
+		{
+			Method:   "GetBook",
+			Request:  `{"name": "shelves/1/books/my book"}`,
+			Expected: "GET /v1/shelves/1/books/my%20book",
+		},
+		{
+			Method:   "ListBooks",
+			Request:  `{"shelf": 1, "page_size": 10, "genres": ["FICTION", "HISTORY"], "author": {"name": "Ada", "born": 1815}, "published_after": "2020-01-02T03:04:05Z", "cursor": "AP8="}`,
+			Expected: "GET /v1/shelves/1/books?author.born=1815&author.name=Ada&cursor=AP8%3D&genres=FICTION&genres=HISTORY&page_size=10&published_after=2020-01-02T03%3A04%3A05Z",
+		},
+		{
+			Method:   "CreateBook",
+			Request:  `{"shelf": 1, "book": {"title": "Dune", "genre": "FICTION"}, "notify": true}`,
+			Expected: "POST /v1/shelves/1/books?notify=true",
+			Body:     `{"title":"Dune","genre":"FICTION"}`,
+		},
+		// Unset body fields are sent empty
+		{
+			Method:   "CreateBook",
+			Request:  `{"shelf": 1}`,
+			Expected: "POST /v1/shelves/1/books",
+			Body:     `{}`,
+		},
+		// Path fields are left out of the body
+		{
+			Method:   "UpdateBook",
+			Request:  `{"name": "shelves/1/books/2", "title": "Dune"}`,
+			Expected: "PATCH /v1/shelves/1/books/2",
+			Body:     `{"title":"Dune"}`,
+		},
+		{
+			Method:   "ArchiveBook",
+			Request:  `{"name": "shelves/1/books/2"}`,
+			Expected: "ARCHIVE /v1/shelves/1/books/2:archive",
+		},
+	}
+
+	for _, testCase := range testCases {
+		method := service.FindMethodByName(testCase.Method)
+		message := construct(t, method, testCase.Request)
+		rule, err := Rule(method)
+		if err != nil || rule == nil {
+			t.Fatalf("Method: %s, expected a rule, got: %v, %v", testCase.Method, rule, err)
+		}
+
+		httpMethod, path, body, err := transcode(rule, message)
+		if err != nil {
+			t.Errorf("Method: %s, unexpected error: %s", testCase.Method, err.Error())
+			continue
+		}
+		if got := httpMethod + " " + path; got != testCase.Expected {
+			t.Errorf("Method: %s, expected: %s, got: %s", testCase.Method, testCase.Expected, got)
+		}
+		if string(body) != testCase.Body {
+			t.Errorf("Method: %s, expected body: %s, got: %s", testCase.Method, testCase.Body, body)
+		}
+	}
+
+	// Path parameters are required
+	getBook := service.FindMethodByName("GetBook")
+	rule, _ := Rule(getBook)
+	if _, _, _, err := transcode(rule, construct(t, getBook, `{}`)); err == nil {
+		t.Error("Expected error for a missing path parameter")
+	}
+}
+
+func TestRule(t *testing.T) {
+	rule, err := Rule(createService(t).FindMethodByName("Unannotated"))
+	if err != nil || rule != nil {
+		t.Errorf("Expected no rule, got: %v, %v", rule, err)
+	}
+}
+
+func TestInvoke(t *testing.T) {
+	service := createService(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/shelves/1/books":
+			w.Write([]byte(`[{"name": "shelves/1/books/1", "title": "Dune", "genre": "FICTION", "pages": 412}]`))
+		case "/v1/shelves/1/books/1":
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write(body)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": "no such book", "code": 5, "message": "no such book"}`))
+		}
+	}))
+	defer server.Close()
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-token", "secret")
+	transport := NewTransport(server.Client(), server.URL)
+
+	// The body is mapped to the response_body field
+	listBooks := service.FindMethodByName("ListBooks")
+	response, err := transport.Invoke(ctx, listBooks, construct(t, listBooks, `{"shelf": 1}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	books := response.(*dynamic.Message).GetFieldByName("books").([]interface{})
+	if len(books) != 1 || books[0].(*dynamic.Message).GetFieldByName("title") != "Dune" {
+		t.Errorf("Expected a book titled Dune, got: %v", books)
+	}
+
+	updateBook := service.FindMethodByName("UpdateBook")
+	response, err = transport.Invoke(ctx, updateBook, construct(t, updateBook, `{"name": "shelves/1/books/1", "title": "Emma"}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if title := response.(*dynamic.Message).GetFieldByName("title"); title != "Emma" {
+		t.Errorf("Expected Emma, got: %s", title)
+	}
+
+	testCases := []struct {
+		Method  string
+		Request string
+		Context context.Context
+		Code    codes.Code
+	}{
+		// The status in the body is used
+		{Method: "GetBook", Request: `{"name": "shelves/1/books/2"}`, Context: ctx, Code: codes.NotFound},
+		// Otherwise the HTTP status is mapped to a code
+		{Method: "GetBook", Request: `{"name": "shelves/1/books/2"}`, Context: context.Background(), Code: codes.Unauthenticated},
+	}
+	for _, testCase := range testCases {
+		method := service.FindMethodByName(testCase.Method)
+		_, err := transport.Invoke(testCase.Context, method, construct(t, method, testCase.Request))
+		if status.Code(err) != testCase.Code {
+			t.Errorf("Method: %s, expected %s, got: %v", testCase.Method, testCase.Code, err)
+		}
+	}
+
+	unannotated := service.FindMethodByName("Unannotated")
+	if _, err := transport.Invoke(ctx, unannotated, construct(t, unannotated, `{}`)); err == nil {
+		t.Error("Expected error calling a method without a google.api.http annotation")
+	}
+}
+
+func construct(t *testing.T, method *desc.MethodDescriptor, request string) *dynamic.Message {
+	message, err := protobuf.Construct(method.GetInputType(), []byte(request))
+	if err != nil {
+		t.Fatalf("Error constructing %s: %s", request, err.Error())
+	}
+	return message
+}
+
+func createService(t *testing.T) *desc.ServiceDescriptor {
+	path, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptors, err := protobuf.Collect([]string{}, []string{path})
+	if err != nil {
+		t.Fatalf("Error collecting test descriptors: %s", err.Error())
+	}
+	service, err := protobuf.NewCollector(descriptors).GetService("gurltest.Bookstore")
+	if err != nil {
+		t.Fatalf("Error getting service descriptor: %s", err.Error())
+	}
+	return service
+}
@@ -0,0 +1,131 @@
+// Package template expands Go templates in request data and header values before they
+// are sent, so requests can be stored and reused without hard-coding IDs and timestamps.
+//
+// Variables passed in are available as {{.name}} or {{var "name"}}, along with the following functions:
+//
+//	env "NAME"             - value of an environment variable
+//	uuid                   - random (v4) UUID
+//	now                    - current time, RFC 3339 formatted
+//	timestamp "+1h"        - current time shifted by a duration, RFC 3339 formatted
+//	unix                   - current time as seconds since the epoch
+//	randInt 0 100          - random integer in [min, max)
+//	base64 "value"         - standard base64 encoding of a value
+package template
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Templates without this can be skipped entirely
+const leftDelim = "{{"
+
+// Renderer expands templates against a set of variables
+type Renderer struct {
+	vars map[string]string
+	// Overridable for tests
+	now func() time.Time
+}
+
+// New returns a Renderer that exposes vars to the templates it renders
+func New(vars map[string]string) *Renderer {
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	return &Renderer{
+		vars: vars,
+		now:  time.Now,
+	}
+}
+
+// Render expands text as a template. The name is only used to identify the template in errors.
+// Text that doesn't contain any template actions is returned as is.
+func (r *Renderer) Render(name, text string) (string, error) {
+	if !strings.Contains(text, leftDelim) {
+		return text, nil
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(r.funcs()).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, r.vars); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (r *Renderer) funcs() template.FuncMap {
+	return template.FuncMap{
+		"var":       r.variable,
+		"env":       env,
+		"uuid":      newUUID,
+		"now":       func() string { return r.now().UTC().Format(time.RFC3339Nano) },
+		"timestamp": r.timestamp,
+		"unix":      func() int64 { return r.now().Unix() },
+		"randInt":   randInt,
+		"base64":    func(val string) string { return base64.StdEncoding.EncodeToString([]byte(val)) },
+	}
+}
+
+func (r *Renderer) variable(name string) (string, error) {
+	val, ok := r.vars[name]
+	if !ok {
+		return "", fmt.Errorf("Variable %s is not set", name)
+	}
+	return val, nil
+}
+
+// Returns the current time shifted by the offset, which is a duration such as +1h or -30m
+func (r *Renderer) timestamp(offset ...string) (string, error) {
+	now := r.now().UTC()
+	if len(offset) > 1 {
+		return "", fmt.Errorf("timestamp takes at most one offset, got %d", len(offset))
+	}
+	if len(offset) == 1 {
+		duration, err := time.ParseDuration(strings.TrimPrefix(offset[0], "+"))
+		if err != nil {
+			return "", err
+		}
+		now = now.Add(duration)
+	}
+	return now.Format(time.RFC3339Nano), nil
+}
+
+func env(name string) (string, error) {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("Environment variable %s is not set", name)
+	}
+	return val, nil
+}
+
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// Set the version (4) and variant (RFC 4122) bits
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func randInt(min, max int64) (int64, error) {
+	if max <= min {
+		return 0, fmt.Errorf("randInt max (%d) must be greater than min (%d)", max, min)
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(max-min))
+	if err != nil {
+		return 0, err
+	}
+	return n.Int64() + min, nil
+}
@@ -0,0 +1,63 @@
+package template
+
+import (
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestRender(t *testing.T) {
+	os.Setenv("GURL_TEMPLATE_TEST", "from-env")
+	defer os.Unsetenv("GURL_TEMPLATE_TEST")
+
+	renderer := New(map[string]string{"user_id": "1234"})
+	renderer.now = func() time.Time {
+		return time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+
+	testCases := []struct {
+		Input    string
+		Expected string
+		IsErr    bool
+	}{
+		{Input: `{ "name": "cat" }`, Expected: `{ "name": "cat" }`},
+		{Input: `{ "id": "{{.user_id}}" }`, Expected: `{ "id": "1234" }`},
+		{Input: `{ "id": "{{var "user_id"}}" }`, Expected: `{ "id": "1234" }`},
+		{Input: `{{env "GURL_TEMPLATE_TEST"}}`, Expected: "from-env"},
+		{Input: `{{now}}`, Expected: "2018-01-02T03:04:05Z"},
+		{Input: `{{timestamp "+1h"}}`, Expected: "2018-01-02T04:04:05Z"},
+		{Input: `{{timestamp "-30m"}}`, Expected: "2018-01-02T02:34:05Z"},
+		{Input: `{{unix}}`, Expected: "1514862245"},
+		{Input: `{{randInt 7 8}}`, Expected: "7"},
+		{Input: `{{base64 "cat"}}`, Expected: "Y2F0"},
+		// Missing variables and environment variables are errors, not empty strings
+		{Input: `{{.missing}}`, IsErr: true},
+		{Input: `{{var "missing"}}`, IsErr: true},
+		{Input: `{{env "GURL_TEMPLATE_TEST_MISSING"}}`, IsErr: true},
+		{Input: `{{timestamp "tomorrow"}}`, IsErr: true},
+		{Input: `{{randInt 8 7}}`, IsErr: true},
+		{Input: `{{ "unterminated }}`, IsErr: true},
+	}
+
+	for _, testCase := range testCases {
+		rendered, err := renderer.Render("test", testCase.Input)
+		if (err != nil) != testCase.IsErr {
+			t.Errorf("Input: %s, expected error: %t, got: %v", testCase.Input, testCase.IsErr, err)
+		}
+		if rendered != testCase.Expected {
+			t.Errorf("Input: %s, expected: %s, got: %s", testCase.Input, testCase.Expected, rendered)
+		}
+	}
+}
+
+func TestUUID(t *testing.T) {
+	uuidRegexp := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	rendered, err := New(nil).Render("test", "{{uuid}}")
+	if err != nil {
+		t.Fatalf("Error rendering uuid: %s", err.Error())
+	}
+	if !uuidRegexp.MatchString(rendered) {
+		t.Errorf("Expected a v4 UUID, got: %s", rendered)
+	}
+}
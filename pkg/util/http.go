@@ -0,0 +1,83 @@
+package util
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// HeadersFromContext returns the outgoing gRPC metadata on the context as HTTP headers, for
+// protocols that run over plain HTTP. Binary metadata, with keys ending in -bin, is base64
+// encoded like gRPC does on the wire.
+func HeadersFromContext(ctx context.Context) http.Header {
+	headers := make(http.Header)
+	md, _ := metadata.FromOutgoingContext(ctx)
+	for key, vals := range md {
+		for _, val := range vals {
+			if strings.HasSuffix(key, "-bin") {
+				val = base64.RawStdEncoding.EncodeToString([]byte(val))
+			}
+			headers.Add(key, val)
+		}
+	}
+	return headers
+}
+
+// DecodeBinaryHeader decodes a -bin header value, which may or may not be padded
+func DecodeBinaryHeader(value string) ([]byte, error) {
+	if len(value)%4 == 0 {
+		return base64.StdEncoding.DecodeString(value)
+	}
+	return base64.RawStdEncoding.DecodeString(value)
+}
+
+// HTTPStatusToCode maps the HTTP status of a response without a gRPC status to a code, as
+// described in https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md
+func HTTPStatusToCode(status int) codes.Code {
+	switch status {
+	case http.StatusBadRequest:
+		return codes.Internal
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.Unimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return codes.Unavailable
+	}
+	return codes.Unknown
+}
+
+// EncodeTimeout encodes the timeout in the grpc-timeout header format, e.g. 1500m for 1.5
+// seconds
+func EncodeTimeout(timeout time.Duration) string {
+	if timeout <= 0 {
+		return "1n"
+	}
+	// The value can be at most 8 digits, so use the finest unit that fits
+	units := []struct {
+		unit   time.Duration
+		suffix string
+	}{
+		{time.Nanosecond, "n"},
+		{time.Microsecond, "u"},
+		{time.Millisecond, "m"},
+		{time.Second, "S"},
+		{time.Minute, "M"},
+		{time.Hour, "H"},
+	}
+	for _, unit := range units {
+		value := (timeout + unit.unit - 1) / unit.unit
+		if value < 1e8 {
+			return fmt.Sprintf("%d%s", value, unit.suffix)
+		}
+	}
+	return "99999999H"
+}
@@ -0,0 +1,20 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEncodeTimeout(t *testing.T) {
+	testCases := map[time.Duration]string{
+		1500 * time.Millisecond: "1500000u",
+		2 * time.Minute:         "120000m",
+		30000 * time.Hour:       "1800000M",
+		0:                       "1n",
+	}
+	for timeout, expected := range testCases {
+		if encoded := EncodeTimeout(timeout); encoded != expected {
+			t.Errorf("Timeout: %s, expected: %s, got: %s", timeout, expected, encoded)
+		}
+	}
+}
@@ -2,51 +2,114 @@ package util
 
 import (
 	"errors"
-	"regexp"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/wearefair/gurl/pkg/log"
 )
 
+// The structure of a URI passed to gurl in order to properly form a request:
+// protocol://context/host:port/service/rpc?query
+//
+// Protocol - Optional parameter. Currently supports http, k8, unix, unix-abstract,
+// dns, grpc-web, grpc-web-text, connect and rest. k8 will signify to gurl that the request needs
+// to be forwarded to Kubernetes. If not specified, it will default to http
+//
+// Context - Optional parameter for Kubernetes context, only allowed after a
+// protocol. If not specified it will default to the default context.
+//
+// Namespace - Optional Kubernetes namespace of the service, only allowed after the
+// context of a k8 URI. It can also be given in the host as service.namespace, or with the
+// namespace query param. If not specified it will default to the context's namespace.
+//
+// Kind - Optional kind of Kubernetes resource the host names, only allowed in k8 URIs
+// right before the host: service, pod, deployment or statefulset, along with kubectl's short
+// names for them. If not specified the host is a service.
+//
+// Host - Hostname, IPv4 address or bracketed IPv6 address to direct requests.
+// When the request uses the k8:// protocol, this will be the K8 service name.
+//
+// Port - Port to direct requests. This will be the service port to target
+// if using the k8 protocol, and can be left out to target the port named grpc.
+//
+// Service - The FQDN of the gRPC service that you're targeting. This means
+// if you're targeting a service called FooBar in the hello package, you would use
+// hello.FooBar
+//
+// RPC - The name of the RPC to direct the request towards.
+//
+// Query - Optional parameters for the request, see the query params below.
+//
+// Examples of valid URI for gurl:
+// http://localhost:50051/hello.world.package.Foo/Bar
+// k8://fake-context/foo-service:50051/hello.world.package.Foo/Bar?namespace=payments
+// k8://fake-context/payments/foo-service:50051/hello.world.package.Foo/Bar
+// k8://foo-service.payments:50051/hello.world.package.Foo/Bar
+// k8://fake-context/payments/deployment/foo:50051/hello.world.package.Foo/Bar
+// k8://statefulset/foo/0:50051/hello.world.package.Foo/Bar
+// http://[::1]:50051/hello.world.package.Foo/Bar?timeout=5s
 const (
+	// HTTPProtocol calls over gRPC, the same as leaving out the protocol
+	HTTPProtocol = "http"
 	// K8Protocol just represents the protocol used in order to specify that
 	// gurl should forward requests to Kubernetes.
 	K8Protocol = "k8"
-	// TODO: Add support for Kubernetes namespaces.
-	//
-	// Regexp for extracting the information out of a URI that's passed to gurl
-	// in order to properly form a request.
-	//
-	// The current structure of the regexp:
-	// protocol://context/service:port/grpc/rpc/method
-	//
-	// Protocol - Optional parameter. Currently supports http and k8.
-	// k8 will signify to gurl that the request needs to be forwarded
-	// to Kubernetes. If not specified, it will default to http
-	//
-	// Context - Optional parameter for Kubernetes context. If not specified
-	// it will default to the default context.
-	//
-	// Host - Hostname to direct requests. When the request uses the k8://
-	// protocol, this will be the K8 service name.
-	//
-	// Port - Port to direct requests. This will be the service port to target
-	// if using the k8 protocol.
-	//
-	// Service - The FQDN of the gRPC service that you're targeting. This means
-	// if you're targeting a service called FooBar in the hello package, you would use
-	// hello.FooBar
-	//
-	// RPC - The name of the RPC to direct the request towards.
-	//
-	// Examples of valid URI for gurl:
-	// http://localhost:50051/hello.world.package.Foo/Bar
-	// k8://fake-context/foo-service:50051/hello.world.package.Foo/Bar
-	uriRegex = `((?P<protocol>[a-z0-9]{2,5})(?:\:\/\/)((?P<context>[0-9a-z._-]+)(?:\/))?)?(?P<host>[0-9a-z-_.]+)(?:\:)(?P<port>[0-9]{2,5})(?:\/)(?P<service>[0-9a-zA-Z._-]+)(?:\/)(?P<rpc>[0-9a-zA-Z._-]+)`
+	// UnixProtocol targets a Unix domain socket by path, e.g. unix:///var/run/app.sock
+	UnixProtocol = "unix"
+	// UnixAbstractProtocol targets a Unix domain socket in the abstract namespace by name,
+	// e.g. unix-abstract:app
+	UnixAbstractProtocol = "unix-abstract"
+	// DNSProtocol resolves the host with gRPC's DNS resolver, which returns every address so
+	// they can be balanced across, e.g. dns:///foo-service:50051 or dns://8.8.8.8/foo-service:50051
+	DNSProtocol = "dns"
+	// GRPCWebProtocol sends calls with the gRPC-Web protocol over HTTP/1.1, for services
+	// behind a gRPC-Web proxy
+	GRPCWebProtocol = "grpc-web"
+	// GRPCWebTextProtocol sends calls with the base64 encoded grpc-web-text format
+	GRPCWebTextProtocol = "grpc-web-text"
+	// ConnectProtocol sends calls with the Connect protocol over plain HTTP
+	ConnectProtocol = "connect"
+	// RESTProtocol sends calls to a REST gateway, transcoded with the method's google.api.http
+	// annotation
+	RESTProtocol = "rest"
+
+	// Kinds of Kubernetes resources k8 URIs can target
+	K8Service     = "service"
+	K8Pod         = "pod"
+	K8Deployment  = "deployment"
+	K8StatefulSet = "statefulset"
+
+	// Query params
+	namespaceParam = "namespace"
+	timeoutParam   = "timeout"
 )
 
 var (
 	errInvalidURIFormat = errors.New("URI must be in the form of protocol://host:port/rpc/method")
-	uriRegexp           = regexp.MustCompile(uriRegex)
+	// The socket path or dns target of these protocols can contain slashes, so they're split
+	// from the end instead of from the start
+	resolverProtocols = []string{UnixAbstractProtocol, UnixProtocol, DNSProtocol}
+	// Every protocol gurl can call, in the order they're listed in errors
+	protocols = []string{HTTPProtocol, K8Protocol, UnixProtocol, UnixAbstractProtocol, DNSProtocol, GRPCWebProtocol, GRPCWebTextProtocol, ConnectProtocol, RESTProtocol}
+	// The names and short names kubectl accepts for each kind
+	k8Kinds = map[string]string{
+		"service":      K8Service,
+		"services":     K8Service,
+		"svc":          K8Service,
+		"pod":          K8Pod,
+		"pods":         K8Pod,
+		"po":           K8Pod,
+		"deployment":   K8Deployment,
+		"deployments":  K8Deployment,
+		"deploy":       K8Deployment,
+		"statefulset":  K8StatefulSet,
+		"statefulsets": K8StatefulSet,
+		"sts":          K8StatefulSet,
+	}
 )
 
 // URI represents a deconstructed uri structure
@@ -57,34 +120,394 @@ type URI struct {
 	Port     string
 	Service  string
 	RPC      string
+	// Socket path for unix targets, or the socket name for unix-abstract targets
+	Path string
+	// DNS server to resolve dns targets with. Blank uses the system resolver.
+	Authority string
+	// Kubernetes namespace of the service, from the path, host or ?namespace=. Only allowed
+	// for k8 targets.
+	Namespace string
+	// Kind of Kubernetes resource the host names, one of the K8 kinds. Blank for services.
+	Kind string
+	// Ordinal of the statefulset's pod to target, for statefulset/name/ordinal:port
+	Ordinal string
+	// Deadline for the call, from ?timeout=
+	Timeout time.Duration
 }
 
-// ParseURI parses a string URI against the regexp and returns it in an expected format
+// Target returns the target to dial with gRPC
+func (u *URI) Target() string {
+	switch u.Protocol {
+	case UnixProtocol:
+		// Dialled with the unix network, see Network
+		return "passthrough:///" + u.Path
+	case UnixAbstractProtocol:
+		// A leading @ puts the socket in the abstract namespace
+		return "passthrough:///@" + u.Path
+	case DNSProtocol:
+		return fmt.Sprintf("dns://%s/%s", u.Authority, net.JoinHostPort(u.Host, u.Port))
+	}
+	return net.JoinHostPort(u.Host, u.Port)
+}
+
+// Network returns the network the target is dialled on, unix or tcp
+func (u *URI) Network() string {
+	if u.Protocol == UnixProtocol || u.Protocol == UnixAbstractProtocol {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// ParseURI parses a string URI and returns it in an expected format. Errors point out the
+// component of the URI that's invalid.
 func ParseURI(uri string) (*URI, error) {
-	namedMatches := make(map[string]string)
-	// host:port/service/method
-	submatches := uriRegexp.FindStringSubmatch(uri)
-	if submatches == nil {
+	rest, query := uri, ""
+	if i := strings.Index(uri, "?"); i >= 0 {
+		rest, query = uri[:i], uri[i+1:]
+	}
+	if !strings.Contains(rest, "/") {
 		return nil, log.LogAndReturn(errInvalidURIFormat)
 	}
 
-	for i, name := range uriRegexp.SubexpNames() {
-		// The first index is going to be the whole match
-		if i == 0 || name == "" {
+	var (
+		parsed *URI
+		err    error
+	)
+	if protocol := resolverProtocol(rest); protocol != "" {
+		parsed, err = parseResolverURI(protocol, strings.TrimPrefix(rest, protocol+":"))
+	} else {
+		parsed, err = parseHostURI(rest)
+	}
+	if err != nil {
+		return nil, log.LogAndReturn(err)
+	}
+	if err := parsed.parseQuery(query); err != nil {
+		return nil, log.LogAndReturn(err)
+	}
+	return parsed, nil
+}
+
+func resolverProtocol(uri string) string {
+	for _, protocol := range resolverProtocols {
+		if strings.HasPrefix(uri, protocol+":") {
+			return protocol
+		}
+	}
+	return ""
+}
+
+// Parses URIs in the form of protocol://context/host:port/service/rpc, where the protocol
+// and context are optional. k8 URIs can also have a namespace after the context.
+func parseHostURI(uri string) (*URI, error) {
+	parsed := &URI{}
+	rest := uri
+	if i := strings.Index(rest, "://"); i >= 0 {
+		parsed.Protocol, rest = rest[:i], rest[i+len("://"):]
+		if err := checkProtocol(parsed.Protocol); err != nil {
+			return nil, err
+		}
+	}
+
+	segments := strings.Split(rest, "/")
+	if parsed.Protocol == K8Protocol && len(segments) > 3 {
+		var err error
+		if segments, err = parsed.parseK8Path(segments); err != nil {
+			return nil, fmt.Errorf("Invalid URI %q: %s", uri, err)
+		}
+	}
+	switch {
+	case len(segments) == 4 && parsed.Protocol != "":
+		parsed.Context, segments = segments[0], segments[1:]
+		if parsed.Context == "" {
+			return nil, fmt.Errorf("Invalid URI %q: context is empty", uri)
+		}
+	case len(segments) < 3:
+		return nil, fmt.Errorf("Invalid URI %q: expected host:port/service/rpc", uri)
+	case len(segments) > 3:
+		return nil, fmt.Errorf("Invalid URI %q: unexpected path %q after the rpc", uri, strings.Join(segments[3:], "/"))
+	}
+
+	var (
+		host, port string
+		err        error
+	)
+	if parsed.Protocol == K8Protocol && !strings.Contains(segments[0], ":") {
+		// The port of k8 targets is looked up by name when it's left out
+		host, err = segments[0], checkHost(segments[0])
+	} else {
+		host, port, err = splitHostPort(segments[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid URI %q: %s", uri, err)
+	}
+	parsed.Host, parsed.Port = host, port
+	if parsed.Protocol == K8Protocol {
+		if err := parsed.splitK8Host(); err != nil {
+			return nil, fmt.Errorf("Invalid URI %q: %s", uri, err)
+		}
+	}
+	if err := parsed.setMethod(segments[1], segments[2]); err != nil {
+		return nil, fmt.Errorf("Invalid URI %q: %s", uri, err)
+	}
+	return parsed, nil
+}
+
+// Parses the rest of a unix, unix-abstract or dns URI after the protocol, in the forms:
+//  unix:///path/to.sock/service/rpc or unix:relative/path.sock/service/rpc
+//  unix-abstract:name/service/rpc
+//  dns:///host:port/service/rpc or dns://authority/host:port/service/rpc
+func parseResolverURI(protocol, rest string) (*URI, error) {
+	segments := strings.Split(rest, "/")
+	if len(segments) < 3 {
+		return nil, errInvalidURIFormat
+	}
+	uri := &URI{Protocol: protocol}
+	if err := uri.setMethod(segments[len(segments)-2], segments[len(segments)-1]); err != nil {
+		return nil, fmt.Errorf("Invalid %s URI: %s", protocol, err)
+	}
+	target := strings.Join(segments[:len(segments)-2], "/")
+	if target == "" {
+		return nil, errInvalidURIFormat
+	}
+
+	switch protocol {
+	case UnixProtocol:
+		// unix://path is ambiguous, the socket path must be absolute after the //
+		if strings.HasPrefix(target, "//") {
+			target = strings.TrimPrefix(target, "//")
+			if !strings.HasPrefix(target, "/") {
+				return nil, errors.New("unix URIs must be in the form of unix:///absolute/path or unix:relative/path")
+			}
+		}
+		uri.Path = target
+	case UnixAbstractProtocol:
+		uri.Path = target
+	case DNSProtocol:
+		if strings.HasPrefix(target, "//") {
+			parts := strings.SplitN(strings.TrimPrefix(target, "//"), "/", 2)
+			if len(parts) != 2 {
+				return nil, errors.New("dns URIs must be in the form of dns:///host:port or dns://authority/host:port")
+			}
+			uri.Authority, target = parts[0], parts[1]
+		}
+		host, port, err := splitHostPort(target)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid dns URI: %s", err)
+		}
+		uri.Host, uri.Port = host, port
+	}
+	return uri, nil
+}
+
+// Protocols must be one gurl can call, so a typo isn't silently called over gRPC
+func checkProtocol(protocol string) error {
+	if protocol == "" {
+		return errors.New("Invalid URI: protocol is empty")
+	}
+	for _, valid := range protocols {
+		if protocol == valid {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid protocol %q: expected one of %s", protocol, strings.Join(protocols, ", "))
+}
+
+// Splits host:port, where the host may be a bracketed IPv6 literal such as [::1]
+func splitHostPort(hostPort string) (string, string, error) {
+	var host, port string
+	if strings.HasPrefix(hostPort, "[") {
+		end := strings.Index(hostPort, "]")
+		if end < 0 {
+			return "", "", fmt.Errorf("missing ] in IPv6 host %q", hostPort)
+		}
+		host = hostPort[1:end]
+		if net.ParseIP(host) == nil || !strings.Contains(host, ":") {
+			return "", "", fmt.Errorf("invalid IPv6 host %q", host)
+		}
+		rest := hostPort[end+1:]
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("expected :port after host [%s]", host)
+		}
+		port = rest[1:]
+	} else {
+		i := strings.LastIndex(hostPort, ":")
+		if i < 0 {
+			return "", "", fmt.Errorf("missing port in %q, expected host:port", hostPort)
+		}
+		host, port = hostPort[:i], hostPort[i+1:]
+		if err := checkHost(host); err != nil {
+			return "", "", err
+		}
+	}
+	if err := checkPort(port); err != nil {
+		return "", "", err
+	}
+	return host, port, nil
+}
+
+// Hosts are DNS names or IPv4 addresses. Underscores are allowed for names like Kubernetes
+// SRV style records.
+func checkHost(host string) error {
+	if host == "" {
+		return errors.New("host is empty")
+	}
+	if strings.Contains(host, ":") {
+		return fmt.Errorf("invalid host %q, IPv6 hosts must be in brackets like [::1]", host)
+	}
+	for _, r := range host {
+		if isLetter(r) || isDigit(r) || r == '-' || r == '_' || r == '.' {
 			continue
 		}
-		namedMatches[name] = submatches[i]
+		return fmt.Errorf("invalid host %q: unexpected character %q", host, r)
 	}
-	if len(namedMatches) < 1 {
-		return nil, log.LogAndReturn(errInvalidURIFormat)
+	return nil
+}
+
+func checkPort(port string) error {
+	if port == "" {
+		return errors.New("port is empty")
+	}
+	number, err := strconv.ParseUint(port, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid port %q: must be a number", port)
+	}
+	if number < 1 || number > 65535 {
+		return fmt.Errorf("invalid port %q: must be between 1 and 65535", port)
+	}
+	return nil
+}
+
+// Parses the segments of k8 URIs before host:port, in the form of context/namespace/kind,
+// where the namespace needs a context and every part is optional. Statefulsets can also be
+// given the ordinal of a pod, with statefulset/name/ordinal:port. Returns the segments from
+// host:port on.
+func (u *URI) parseK8Path(segments []string) ([]string, error) {
+	prefix, rest := segments[:len(segments)-3], segments[len(segments)-3:]
+	if len(prefix) >= 2 && k8Kinds[prefix[len(prefix)-2]] == K8StatefulSet {
+		name, ordinalPort := prefix[len(prefix)-1], rest[0]
+		i := strings.LastIndex(ordinalPort, ":")
+		if i < 0 {
+			i = len(ordinalPort)
+		}
+		if _, err := strconv.ParseUint(ordinalPort[:i], 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid statefulset ordinal %q: must be a number", ordinalPort[:i])
+		}
+		u.Kind, u.Ordinal = K8StatefulSet, ordinalPort[:i]
+		rest = append([]string{name + ordinalPort[i:]}, rest[1:]...)
+		prefix = prefix[:len(prefix)-2]
+	} else if kind, ok := k8Kinds[prefix[len(prefix)-1]]; ok {
+		u.Kind = kind
+		prefix = prefix[:len(prefix)-1]
+	}
+
+	switch len(prefix) {
+	case 0:
+	case 2:
+		u.Namespace = prefix[1]
+		if u.Namespace == "" {
+			return nil, errors.New("namespace is empty")
+		}
+		fallthrough
+	case 1:
+		u.Context = prefix[0]
+		if u.Context == "" {
+			return nil, errors.New("context is empty")
+		}
+	default:
+		return nil, fmt.Errorf("unexpected path %q before the host, expected context/namespace/kind", strings.Join(prefix, "/"))
+	}
+	return rest, nil
+}
+
+// Splits the namespace out of k8 hosts in the forms of the service's DNS name:
+// service.namespace, service.namespace.svc or service.namespace.svc.cluster.local. The names of
+// pods and deployments can contain dots, so hosts of other kinds are only split when they end
+// in .svc or .svc.cluster.local.
+func (u *URI) splitK8Host() error {
+	if u.Kind != "" && !strings.HasSuffix(u.Host, ".svc") && !strings.HasSuffix(u.Host, ".svc.cluster.local") {
+		return nil
+	}
+	host := strings.TrimSuffix(strings.TrimSuffix(u.Host, ".cluster.local"), ".svc")
+	i := strings.LastIndex(host, ".")
+	if i < 0 {
+		if host != u.Host {
+			return fmt.Errorf("namespace is missing in host %q, expected name.namespace.svc", u.Host)
+		}
+		return nil
+	}
+	name, namespace := host[:i], host[i+1:]
+	if name == "" {
+		return fmt.Errorf("name is empty in host %q", u.Host)
+	}
+	if namespace == "" {
+		return fmt.Errorf("namespace is empty in host %q", u.Host)
+	}
+	// Service names can't contain dots, so anything more is a host that isn't a service's
+	if u.Kind == "" && strings.Contains(name, ".") {
+		return fmt.Errorf("invalid host %q, expected service.namespace or service.namespace.svc", u.Host)
+	}
+	if u.Namespace != "" {
+		return fmt.Errorf("namespace is set in both the path and the host %q", u.Host)
+	}
+	u.Host, u.Namespace = name, namespace
+	return nil
+}
+
+// Sets the service and rpc, which can be anything but empty since they've already been split
+// on slashes
+func (u *URI) setMethod(service, rpc string) error {
+	if service == "" {
+		return errors.New("service is empty")
+	}
+	if rpc == "" {
+		return errors.New("rpc is empty")
+	}
+	u.Service, u.RPC = service, rpc
+	return nil
+}
+
+func (u *URI) parseQuery(query string) error {
+	if query == "" {
+		return nil
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return fmt.Errorf("Invalid URI query %q: %s", query, err)
 	}
-	uriWrapper := &URI{
-		Protocol: namedMatches["protocol"],
-		Context:  namedMatches["context"],
-		Host:     namedMatches["host"],
-		Port:     namedMatches["port"],
-		Service:  namedMatches["service"],
-		RPC:      namedMatches["rpc"],
+	for key, vals := range values {
+		if len(vals) > 1 {
+			return fmt.Errorf("Invalid URI query: %s is set more than once", key)
+		}
+		value := vals[0]
+		switch key {
+		case namespaceParam:
+			if u.Protocol != K8Protocol {
+				return fmt.Errorf("Invalid URI query: %s is only supported for %s:// URIs", key, K8Protocol)
+			}
+			if value == "" {
+				return fmt.Errorf("Invalid URI query: %s is empty", key)
+			}
+			if u.Namespace != "" {
+				return fmt.Errorf("Invalid URI query: %s is already set to %s in the URI", key, u.Namespace)
+			}
+			u.Namespace = value
+		case timeoutParam:
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("Invalid URI query: %s %q must be a positive duration such as 5s", key, value)
+			}
+			u.Timeout = timeout
+		default:
+			return fmt.Errorf("Invalid URI query: unknown parameter %q, expected %s or %s", key, namespaceParam, timeoutParam)
+		}
 	}
-	return uriWrapper, nil
+	return nil
+}
+
+func isLetter(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z'
+}
+
+func isDigit(r rune) bool {
+	return '0' <= r && r <= '9'
 }
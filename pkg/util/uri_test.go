@@ -2,7 +2,9 @@ package util
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseURI(t *testing.T) {
@@ -59,6 +61,252 @@ func TestParseURI(t *testing.T) {
 			},
 			Err: nil,
 		},
+		// Parse IPv6 literal with a 1 digit port
+		{
+			Input: "http://[::1]:8/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol: "http",
+				Host:     "::1",
+				Port:     "8",
+				Service:  "fakeService.Service",
+				RPC:      "fakeRPC",
+			},
+			Err: nil,
+		},
+		// Parse uppercase host with a 6 digit port and unusual characters in the service
+		{
+			Input: "API.Example.com:050051/fake$Service.Service/fake+RPC",
+			Expected: &URI{
+				Host:    "API.Example.com",
+				Port:    "050051",
+				Service: "fake$Service.Service",
+				RPC:     "fake+RPC",
+			},
+			Err: nil,
+		},
+		// Parse K8 protocol with query params
+		{
+			Input: "k8://sandbox-general/public-api:80/fakeService.Service/fakeRPC?namespace=payments&timeout=5s",
+			Expected: &URI{
+				Protocol:  "k8",
+				Context:   "sandbox-general",
+				Host:      "public-api",
+				Port:      "80",
+				Service:   "fakeService.Service",
+				RPC:       "fakeRPC",
+				Namespace: "payments",
+				Timeout:   5 * time.Second,
+			},
+			Err: nil,
+		},
+		// Parse K8 protocol with the namespace after the context
+		{
+			Input: "k8://sandbox-general/payments/public-api:80/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol:  "k8",
+				Context:   "sandbox-general",
+				Host:      "public-api",
+				Port:      "80",
+				Service:   "fakeService.Service",
+				RPC:       "fakeRPC",
+				Namespace: "payments",
+			},
+			Err: nil,
+		},
+		// Parse K8 protocol with the namespace in the host
+		{
+			Input: "k8://public-api.payments:80/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol:  "k8",
+				Host:      "public-api",
+				Port:      "80",
+				Service:   "fakeService.Service",
+				RPC:       "fakeRPC",
+				Namespace: "payments",
+			},
+			Err: nil,
+		},
+		// Parse K8 protocol with the service's full DNS name
+		{
+			Input: "k8://sandbox-general/public-api.payments.svc.cluster.local:80/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol:  "k8",
+				Context:   "sandbox-general",
+				Host:      "public-api",
+				Port:      "80",
+				Service:   "fakeService.Service",
+				RPC:       "fakeRPC",
+				Namespace: "payments",
+			},
+			Err: nil,
+		},
+		// Parse K8 protocol targeting a deployment
+		{
+			Input: "k8://sandbox-general/payments/deploy/public-api:80/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol:  "k8",
+				Context:   "sandbox-general",
+				Host:      "public-api",
+				Port:      "80",
+				Service:   "fakeService.Service",
+				RPC:       "fakeRPC",
+				Namespace: "payments",
+				Kind:      K8Deployment,
+			},
+			Err: nil,
+		},
+		// Parse K8 protocol targeting a pod without a context
+		{
+			Input: "k8://pod/public-api-7d9f-x2x:8080/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol: "k8",
+				Host:     "public-api-7d9f-x2x",
+				Port:     "8080",
+				Service:  "fakeService.Service",
+				RPC:      "fakeRPC",
+				Kind:     K8Pod,
+			},
+			Err: nil,
+		},
+		// Parse K8 protocol targeting a statefulset's pod by ordinal
+		{
+			Input: "k8://sandbox-general/statefulset/ledger.payments.svc/2:80/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol:  "k8",
+				Context:   "sandbox-general",
+				Host:      "ledger",
+				Port:      "80",
+				Service:   "fakeService.Service",
+				RPC:       "fakeRPC",
+				Namespace: "payments",
+				Kind:      K8StatefulSet,
+				Ordinal:   "2",
+			},
+			Err: nil,
+		},
+		// Pod and deployment names can contain dots, which don't separate a namespace
+		{
+			Input: "k8://pod/my.pod:8080/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol: "k8",
+				Host:     "my.pod",
+				Port:     "8080",
+				Service:  "fakeService.Service",
+				RPC:      "fakeRPC",
+				Kind:     K8Pod,
+			},
+			Err: nil,
+		},
+		{
+			Input: "k8://ctx/payments/deploy/api.v2.canary:8080/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol:  "k8",
+				Context:   "ctx",
+				Host:      "api.v2.canary",
+				Port:      "8080",
+				Service:   "fakeService.Service",
+				RPC:       "fakeRPC",
+				Namespace: "payments",
+				Kind:      K8Deployment,
+			},
+			Err: nil,
+		},
+		// Unless they end in .svc like a service's DNS name
+		{
+			Input: "k8://deploy/api.v2.payments.svc.cluster.local:8080/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol:  "k8",
+				Host:      "api.v2",
+				Port:      "8080",
+				Service:   "fakeService.Service",
+				RPC:       "fakeRPC",
+				Namespace: "payments",
+				Kind:      K8Deployment,
+			},
+			Err: nil,
+		},
+		// Parse K8 protocol without a port
+		{
+			Input: "k8://sandbox-general/public-api/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol: "k8",
+				Context:  "sandbox-general",
+				Host:     "public-api",
+				Service:  "fakeService.Service",
+				RPC:      "fakeRPC",
+			},
+			Err: nil,
+		},
+		{
+			Input: "k8://sts/ledger/0/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol: "k8",
+				Host:     "ledger",
+				Service:  "fakeService.Service",
+				RPC:      "fakeRPC",
+				Kind:     K8StatefulSet,
+				Ordinal:  "0",
+			},
+			Err: nil,
+		},
+		// Parse unix socket with an absolute path
+		{
+			Input: "unix:///var/run/app.sock/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol: "unix",
+				Path:     "/var/run/app.sock",
+				Service:  "fakeService.Service",
+				RPC:      "fakeRPC",
+			},
+			Err: nil,
+		},
+		// Parse unix socket with a relative path
+		{
+			Input: "unix:run/app.sock/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol: "unix",
+				Path:     "run/app.sock",
+				Service:  "fakeService.Service",
+				RPC:      "fakeRPC",
+			},
+			Err: nil,
+		},
+		// Parse abstract unix socket
+		{
+			Input: "unix-abstract:app/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol: "unix-abstract",
+				Path:     "app",
+				Service:  "fakeService.Service",
+				RPC:      "fakeRPC",
+			},
+			Err: nil,
+		},
+		// Parse dns target with the system resolver
+		{
+			Input: "dns:///public-api:80/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol: "dns",
+				Host:     "public-api",
+				Port:     "80",
+				Service:  "fakeService.Service",
+				RPC:      "fakeRPC",
+			},
+			Err: nil,
+		},
+		// Parse dns target with a DNS server
+		{
+			Input: "dns://8.8.8.8/public-api:80/fakeService.Service/fakeRPC",
+			Expected: &URI{
+				Protocol:  "dns",
+				Authority: "8.8.8.8",
+				Host:      "public-api",
+				Port:      "80",
+				Service:   "fakeService.Service",
+				RPC:       "fakeRPC",
+			},
+			Err: nil,
+		},
 		// Input that's a completely hot garbage returns error
 		{
 			Input:    "fakeNews",
@@ -83,3 +331,75 @@ func TestParseURI(t *testing.T) {
 		}
 	}
 }
+
+func TestURITarget(t *testing.T) {
+	testCases := []struct {
+		Input   string
+		Target  string
+		Network string
+	}{
+		{Input: "localhost:3000/fakeService.Service/fakeRPC", Target: "localhost:3000", Network: "tcp"},
+		{Input: "unix:///var/run/app.sock/fakeService.Service/fakeRPC", Target: "passthrough:////var/run/app.sock", Network: "unix"},
+		{Input: "unix-abstract:app/fakeService.Service/fakeRPC", Target: "passthrough:///@app", Network: "unix"},
+		{Input: "dns:///public-api:80/fakeService.Service/fakeRPC", Target: "dns:///public-api:80", Network: "tcp"},
+		{Input: "dns://8.8.8.8/public-api:80/fakeService.Service/fakeRPC", Target: "dns://8.8.8.8/public-api:80", Network: "tcp"},
+	}
+
+	for _, testCase := range testCases {
+		uri, err := ParseURI(testCase.Input)
+		if err != nil {
+			t.Errorf("Error parsing %s: %s", testCase.Input, err.Error())
+			continue
+		}
+		if uri.Target() != testCase.Target || uri.Network() != testCase.Network {
+			t.Errorf("Input: %s\nexpected: %s over %s\ngot: %s over %s", testCase.Input, testCase.Target, testCase.Network, uri.Target(), uri.Network())
+		}
+	}
+}
+
+func TestParseURIErrors(t *testing.T) {
+	// Each error should point out the invalid component
+	testCases := []struct {
+		Input    string
+		Expected string
+	}{
+		{Input: "localhost:3000/fakeService.Service/fakeRPC/garbage", Expected: `unexpected path "garbage" after the rpc`},
+		{Input: "localhost:3000/fakeService.Service", Expected: "expected host:port/service/rpc"},
+		{Input: "localhost/fakeService.Service/fakeRPC", Expected: `missing port in "localhost"`},
+		{Input: "localhost:http/fakeService.Service/fakeRPC", Expected: `invalid port "http": must be a number`},
+		{Input: "localhost:65536/fakeService.Service/fakeRPC", Expected: `invalid port "65536": must be between 1 and 65535`},
+		{Input: "local host:3000/fakeService.Service/fakeRPC", Expected: `invalid host "local host": unexpected character ' '`},
+		{Input: "::1:3000/fakeService.Service/fakeRPC", Expected: "IPv6 hosts must be in brackets"},
+		{Input: "[::1:3000/fakeService.Service/fakeRPC", Expected: "missing ] in IPv6 host"},
+		{Input: "[localhost]:3000/fakeService.Service/fakeRPC", Expected: `invalid IPv6 host "localhost"`},
+		{Input: "localhost:3000//fakeRPC", Expected: "service is empty"},
+		{Input: "localhost:3000/fakeService.Service/", Expected: "rpc is empty"},
+		{Input: "ht_tp://localhost:3000/fakeService.Service/fakeRPC", Expected: `Invalid protocol "ht_tp"`},
+		{Input: "https://localhost:3000/fakeService.Service/fakeRPC", Expected: `Invalid protocol "https": expected one of http, k8, unix, unix-abstract, dns, grpc-web, grpc-web-text, connect, rest`},
+		{Input: "grpcweb://localhost:3000/fakeService.Service/fakeRPC", Expected: `Invalid protocol "grpcweb"`},
+		{Input: "://localhost:3000/fakeService.Service/fakeRPC", Expected: "protocol is empty"},
+		{Input: "localhost:3000/fakeService.Service/fakeRPC?namespace=payments", Expected: "namespace is only supported for k8:// URIs"},
+		{Input: "k8://ctx/payments/public-api:80/fakeService.Service/fakeRPC?namespace=payments", Expected: "namespace is already set to payments"},
+		{Input: "k8://ctx//public-api:80/fakeService.Service/fakeRPC", Expected: "namespace is empty"},
+		{Input: "k8://ctx/payments/public-api.billing:80/fakeService.Service/fakeRPC", Expected: "namespace is set in both the path and the host"},
+		{Input: "k8://public-api.payments.example.com:80/fakeService.Service/fakeRPC", Expected: "expected service.namespace or service.namespace.svc"},
+		{Input: "k8://public-api.:80/fakeService.Service/fakeRPC", Expected: "namespace is empty"},
+		{Input: "k8://pod/my-pod.svc:80/fakeService.Service/fakeRPC", Expected: "namespace is missing"},
+		{Input: "http://ctx/payments/localhost:80/fakeService.Service/fakeRPC", Expected: "unexpected path"},
+		{Input: "k8://ctx/payments/extra/pod/public-api:80/fakeService.Service/fakeRPC", Expected: `unexpected path "ctx/payments/extra" before the host`},
+		{Input: "k8://sts/ledger/first:80/fakeService.Service/fakeRPC", Expected: `invalid statefulset ordinal "first"`},
+		{Input: "k8://public-api:/fakeService.Service/fakeRPC", Expected: "port is empty"},
+		{Input: "localhost/fakeService.Service/fakeRPC?namespace=payments", Expected: `missing port in "localhost"`},
+		{Input: "localhost:3000/fakeService.Service/fakeRPC?timeout=soon", Expected: `timeout "soon" must be a positive duration`},
+		{Input: "localhost:3000/fakeService.Service/fakeRPC?retries=3", Expected: `unknown parameter "retries"`},
+		{Input: "unix:///app.sock", Expected: "Invalid unix URI: service is empty"},
+		{Input: "dns:///public-api/fakeService.Service/fakeRPC", Expected: `missing port in "public-api"`},
+	}
+
+	for _, testCase := range testCases {
+		_, err := ParseURI(testCase.Input)
+		if err == nil || !strings.Contains(err.Error(), testCase.Expected) {
+			t.Errorf("Input: %s\nexpected error containing: %s\ngot: %v", testCase.Input, testCase.Expected, err)
+		}
+	}
+}
@@ -0,0 +1,822 @@
+// Package validate evaluates protoc-gen-validate (validate.rules) and protovalidate
+// (buf.validate.field) constraints on a request message before it's sent, so violations
+// are reported locally instead of by the server.
+//
+// Rules are read from the field options of the descriptors that protobuf.Collect loads, so
+// the proto defining the rules has to be in the configured import paths. CEL expressions
+// aren't evaluated.
+package validate
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wearefair/gurl/pkg/protobuf"
+)
+
+const (
+	pgvFieldRules      = "validate.rules"
+	pgvOneOfRequired   = "validate.required"
+	pgvMessageDisabled = "validate.disabled"
+	pgvMessageIgnored  = "validate.ignored"
+
+	protovalidateFieldRules    = "buf.validate.field"
+	protovalidateOneOfRules    = "buf.validate.oneof"
+	protovalidateMessageRules  = "buf.validate.message"
+	protovalidateDisabledField = "disabled"
+)
+
+var (
+	hostnameRegexp = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.?$`)
+	uuidRegexp     = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	wrapperTypes   = map[string]bool{
+		"google.protobuf.DoubleValue": true,
+		"google.protobuf.FloatValue":  true,
+		"google.protobuf.Int64Value":  true,
+		"google.protobuf.UInt64Value": true,
+		"google.protobuf.Int32Value":  true,
+		"google.protobuf.UInt32Value": true,
+		"google.protobuf.BoolValue":   true,
+		"google.protobuf.StringValue": true,
+		"google.protobuf.BytesValue":  true,
+	}
+	// Overridable for tests
+	now = time.Now
+)
+
+// Message evaluates the rules on every field of the message, recursing into nested messages.
+// Returns a protobuf.ValidationError listing every violation with its path, or nil if the
+// message is valid.
+func Message(message *dynamic.Message) error {
+	v := &validator{}
+	v.message("$", message)
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &protobuf.ValidationError{Problems: v.problems}
+}
+
+type validator struct {
+	problems []protobuf.Problem
+}
+
+func (v *validator) errorf(path, format string, args ...interface{}) {
+	v.problems = append(v.problems, protobuf.Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) message(path string, message *dynamic.Message) {
+	md := message.GetMessageDescriptor()
+	if v.messageDisabled(path, md) {
+		return
+	}
+
+	for _, oneOf := range md.GetOneOfs() {
+		required, err := oneOfRequired(oneOf)
+		if err != nil {
+			v.errorf(path, "can't read rules for oneof %s: %s", oneOf.GetName(), err)
+			continue
+		}
+		if required && !oneOfSet(message, oneOf) {
+			v.errorf(path+"."+oneOf.GetName(), "exactly one field of oneof %s is required", oneOf.GetName())
+		}
+	}
+
+	for _, fd := range md.GetFields() {
+		// Only the field that's set in a oneof is validated
+		if fd.GetOneOf() != nil && !message.HasField(fd) {
+			continue
+		}
+		fieldPath := path + "." + fd.GetJSONName()
+		rules, err := fieldRules(fd)
+		if err != nil {
+			v.errorf(fieldPath, "can't read rules: %s", err)
+			continue
+		}
+		v.field(fieldPath, message, fd, rules)
+	}
+}
+
+func (v *validator) messageDisabled(path string, md *desc.MessageDescriptor) bool {
+	for _, name := range []string{pgvMessageDisabled, pgvMessageIgnored} {
+		val, err := option(md.GetMessageOptions(), md.GetFile(), name)
+		if err != nil {
+			v.errorf(path, "can't read rules for %s: %s", md.GetFullyQualifiedName(), err)
+			return true
+		}
+		if disabled, ok := val.(bool); ok && disabled {
+			return true
+		}
+	}
+	val, err := option(md.GetMessageOptions(), md.GetFile(), protovalidateMessageRules)
+	if err != nil {
+		v.errorf(path, "can't read rules for %s: %s", md.GetFullyQualifiedName(), err)
+		return true
+	}
+	return ruleMessage(val).bool(protovalidateDisabledField)
+}
+
+func (v *validator) field(path string, message *dynamic.Message, fd *desc.FieldDescriptor, rules *ruleSet) {
+	set := message.HasField(fd)
+	// protovalidate marks required fields at the top level of the rules
+	if rules.bool("required") && !set {
+		v.errorf(path, "value is required")
+		return
+	}
+
+	switch {
+	case fd.IsMap():
+		entries, _ := message.GetField(fd).(map[interface{}]interface{})
+		if mapRules := rules.nested("map"); mapRules != nil {
+			v.mapRules(path, fd, mapRules, entries)
+		}
+		if fd.GetMapValueType().GetMessageType() != nil {
+			for key, val := range entries {
+				v.nestedMessage(fmt.Sprintf("%s[%q]", path, fmt.Sprint(key)), val)
+			}
+		}
+	case fd.IsRepeated():
+		items, _ := message.GetField(fd).([]interface{})
+		var itemRules *ruleSet
+		if repeatedRules := rules.nested("repeated"); repeatedRules != nil {
+			v.repeatedRules(path, repeatedRules, items)
+			itemRules = repeatedRules.nested("items")
+		}
+		for i, item := range items {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			v.value(itemPath, fd, itemRules, item)
+			if fd.GetMessageType() != nil && !itemRules.nested("message").bool("skip") {
+				v.nestedMessage(itemPath, item)
+			}
+		}
+	case fd.GetMessageType() != nil:
+		messageRules := rules.nested("message")
+		if !set {
+			if messageRules.bool("required") || rules.nested("duration").bool("required") ||
+				rules.nested("timestamp").bool("required") || rules.nested("any").bool("required") {
+				v.errorf(path, "value is required")
+			}
+			return
+		}
+		val := message.GetField(fd)
+		v.value(path, fd, rules, val)
+		if !messageRules.bool("skip") {
+			v.nestedMessage(path, val)
+		}
+	default:
+		v.value(path, fd, rules, message.GetField(fd))
+	}
+}
+
+func (v *validator) nestedMessage(path string, val interface{}) {
+	msg, ok := val.(proto.Message)
+	if !ok {
+		return
+	}
+	nested, err := dynamic.AsDynamicMessage(msg)
+	if err != nil {
+		v.errorf(path, "can't validate message: %s", err)
+		return
+	}
+	v.message(path, nested)
+}
+
+// Evaluates the type specific rules, such as string or int32 rules, against a single value
+func (v *validator) value(path string, fd *desc.FieldDescriptor, rules *ruleSet, val interface{}) {
+	if rules == nil {
+		return
+	}
+	// Scalar rules on wrapper types, such as google.protobuf.StringValue, apply to the wrapped value
+	val = unwrap(val)
+	if r := rules.nested("string"); r != nil {
+		if s, ok := val.(string); ok {
+			v.stringRules(path, r, s)
+		} else {
+			v.errorf(path, "string rules can't be applied to a %s", typeName(val))
+		}
+	}
+	if r := rules.nested("bytes"); r != nil {
+		if b, ok := val.([]byte); ok {
+			v.bytesRules(path, r, b)
+		} else {
+			v.errorf(path, "bytes rules can't be applied to a %s", typeName(val))
+		}
+	}
+	if r := rules.nested("bool"); r != nil {
+		if r.has("const") && r.get("const") != val {
+			v.errorf(path, "value must equal %v", r.get("const"))
+		}
+	}
+	if r := rules.nested("enum"); r != nil {
+		v.enumRules(path, fd, r, val)
+	}
+	for _, numeric := range []string{"float", "double", "int32", "int64", "uint32", "uint64", "sint32", "sint64", "fixed32", "fixed64", "sfixed32", "sfixed64"} {
+		if r := rules.nested(numeric); r != nil {
+			v.numericRules(path, r, toNumber(val), func(rule interface{}) string { return fmt.Sprint(rule) })
+		}
+	}
+	if r := rules.nested("duration"); r != nil {
+		v.numericRules(path, r, durationNanos(val), func(rule interface{}) string {
+			return time.Duration(nanos(rule)).String()
+		})
+	}
+	if r := rules.nested("timestamp"); r != nil {
+		v.timestampRules(path, r, val)
+	}
+	if r := rules.nested("any"); r != nil {
+		v.anyRules(path, r, val)
+	}
+}
+
+func (v *validator) stringRules(path string, r *ruleSet, val string) {
+	if r.bool("ignore_empty") && val == "" {
+		return
+	}
+	runes := uint64(utf8.RuneCountInString(val))
+	if r.has("const") && val != r.get("const") {
+		v.errorf(path, "value must equal %q", r.get("const"))
+	}
+	if r.has("len") && runes != r.uint("len") {
+		v.errorf(path, "value length must be %d characters", r.uint("len"))
+	}
+	if r.has("min_len") && runes < r.uint("min_len") {
+		v.errorf(path, "value length must be at least %d characters", r.uint("min_len"))
+	}
+	if r.has("max_len") && runes > r.uint("max_len") {
+		v.errorf(path, "value length must be at most %d characters", r.uint("max_len"))
+	}
+	v.lengthRules(path, r, "len_bytes", "min_bytes", "max_bytes", "bytes", uint64(len(val)))
+	if r.has("pattern") {
+		v.pattern(path, r.get("pattern").(string), val)
+	}
+	if r.has("prefix") && !strings.HasPrefix(val, r.get("prefix").(string)) {
+		v.errorf(path, "value must start with %q", r.get("prefix"))
+	}
+	if r.has("suffix") && !strings.HasSuffix(val, r.get("suffix").(string)) {
+		v.errorf(path, "value must end with %q", r.get("suffix"))
+	}
+	if r.has("contains") && !strings.Contains(val, r.get("contains").(string)) {
+		v.errorf(path, "value must contain %q", r.get("contains"))
+	}
+	if r.has("not_contains") && strings.Contains(val, r.get("not_contains").(string)) {
+		v.errorf(path, "value must not contain %q", r.get("not_contains"))
+	}
+	v.inRules(path, r, val, func(a, b interface{}) bool { return a == b })
+
+	switch {
+	case r.bool("email"):
+		if address, err := mail.ParseAddress(val); err != nil || address.Name != "" || address.Address != val {
+			v.errorf(path, "value must be a valid email address")
+		}
+	case r.bool("hostname"):
+		if !hostnameRegexp.MatchString(val) {
+			v.errorf(path, "value must be a valid hostname")
+		}
+	case r.bool("ip"):
+		if net.ParseIP(val) == nil {
+			v.errorf(path, "value must be a valid IP address")
+		}
+	case r.bool("ipv4"):
+		if ip := net.ParseIP(val); ip == nil || ip.To4() == nil {
+			v.errorf(path, "value must be a valid IPv4 address")
+		}
+	case r.bool("ipv6"):
+		if ip := net.ParseIP(val); ip == nil || ip.To4() != nil {
+			v.errorf(path, "value must be a valid IPv6 address")
+		}
+	case r.bool("uri"):
+		if parsed, err := url.Parse(val); err != nil || !parsed.IsAbs() {
+			v.errorf(path, "value must be an absolute URI")
+		}
+	case r.bool("uri_ref"):
+		if _, err := url.Parse(val); err != nil {
+			v.errorf(path, "value must be a valid URI reference")
+		}
+	case r.bool("address"):
+		if net.ParseIP(val) == nil && !hostnameRegexp.MatchString(val) {
+			v.errorf(path, "value must be a valid hostname or IP address")
+		}
+	case r.bool("uuid"):
+		if !uuidRegexp.MatchString(val) {
+			v.errorf(path, "value must be a valid UUID")
+		}
+	}
+}
+
+func (v *validator) bytesRules(path string, r *ruleSet, val []byte) {
+	if r.bool("ignore_empty") && len(val) == 0 {
+		return
+	}
+	equal := func(a, b interface{}) bool { return string(a.([]byte)) == string(b.([]byte)) }
+	if r.has("const") && !equal(val, r.get("const")) {
+		v.errorf(path, "value must equal %q", r.get("const"))
+	}
+	v.lengthRules(path, r, "len", "min_len", "max_len", "bytes", uint64(len(val)))
+	if r.has("pattern") {
+		v.pattern(path, r.get("pattern").(string), string(val))
+	}
+	if r.has("prefix") && !strings.HasPrefix(string(val), string(r.get("prefix").([]byte))) {
+		v.errorf(path, "value must start with %q", r.get("prefix"))
+	}
+	if r.has("suffix") && !strings.HasSuffix(string(val), string(r.get("suffix").([]byte))) {
+		v.errorf(path, "value must end with %q", r.get("suffix"))
+	}
+	if r.has("contains") && !strings.Contains(string(val), string(r.get("contains").([]byte))) {
+		v.errorf(path, "value must contain %q", r.get("contains"))
+	}
+	v.inRules(path, r, val, equal)
+}
+
+func (v *validator) lengthRules(path string, r *ruleSet, exact, min, max, unit string, length uint64) {
+	if r.has(exact) && length != r.uint(exact) {
+		v.errorf(path, "value length must be %d %s", r.uint(exact), unit)
+	}
+	if r.has(min) && length < r.uint(min) {
+		v.errorf(path, "value length must be at least %d %s", r.uint(min), unit)
+	}
+	if r.has(max) && length > r.uint(max) {
+		v.errorf(path, "value length must be at most %d %s", r.uint(max), unit)
+	}
+}
+
+func (v *validator) pattern(path, pattern, val string) {
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		v.errorf(path, "invalid pattern %q in rules: %s", pattern, err)
+		return
+	}
+	if !compiled.MatchString(val) {
+		v.errorf(path, "value must match pattern %q", pattern)
+	}
+}
+
+func (v *validator) enumRules(path string, fd *desc.FieldDescriptor, r *ruleSet, val interface{}) {
+	number, ok := val.(int32)
+	if !ok {
+		v.errorf(path, "enum rules can't be applied to a %s", typeName(val))
+		return
+	}
+	name := fmt.Sprint(number)
+	if enumValue := fd.GetEnumType().FindValueByNumber(number); enumValue != nil {
+		name = enumValue.GetName()
+	} else if r.bool("defined_only") {
+		v.errorf(path, "value must be one of the defined enum values")
+	}
+	if r.has("const") && r.get("const") != number {
+		v.errorf(path, "value must equal %s", enumName(fd, r.get("const").(int32)))
+	}
+	if r.has("in") && !contains(r.get("in"), number) {
+		v.errorf(path, "value must be in [%s], got %s", enumNames(fd, r.get("in")), name)
+	}
+	if r.has("not_in") && contains(r.get("not_in"), number) {
+		v.errorf(path, "value must not be in [%s], got %s", enumNames(fd, r.get("not_in")), name)
+	}
+}
+
+func (v *validator) numericRules(path string, r *ruleSet, val *big.Float, display func(interface{}) string) {
+	if val == nil {
+		return
+	}
+	if r.bool("ignore_empty") && val.Sign() == 0 {
+		return
+	}
+	compare := func(rule string) int {
+		ruleVal := r.get(rule)
+		if number := toNumber(ruleVal); number != nil {
+			return val.Cmp(number)
+		}
+		return val.Cmp(durationNanos(ruleVal))
+	}
+
+	if r.has("const") && compare("const") != 0 {
+		v.errorf(path, "value must equal %s", display(r.get("const")))
+	}
+	if r.has("in") || r.has("not_in") {
+		v.inRules(path, r, val, func(a, b interface{}) bool {
+			number := toNumber(b)
+			if number == nil {
+				number = durationNanos(b)
+			}
+			return a.(*big.Float).Cmp(number) == 0
+		})
+	}
+
+	lowerOK, upperOK := true, true
+	lower, upper := "", ""
+	switch {
+	case r.has("gt"):
+		lowerOK, lower = compare("gt") > 0, "greater than "+display(r.get("gt"))
+	case r.has("gte"):
+		lowerOK, lower = compare("gte") >= 0, "greater than or equal to "+display(r.get("gte"))
+	}
+	switch {
+	case r.has("lt"):
+		upperOK, upper = compare("lt") < 0, "less than "+display(r.get("lt"))
+	case r.has("lte"):
+		upperOK, upper = compare("lte") <= 0, "less than or equal to "+display(r.get("lte"))
+	}
+
+	switch {
+	case lower != "" && upper != "" && boundsExclusive(r):
+		// When the lower bound is above the upper bound, values must fall outside of the range
+		if !lowerOK && !upperOK {
+			v.errorf(path, "value must be %s or %s", upper, lower)
+		}
+	case lower != "" && upper != "":
+		if !lowerOK || !upperOK {
+			v.errorf(path, "value must be %s and %s", lower, upper)
+		}
+	case lower != "" && !lowerOK:
+		v.errorf(path, "value must be %s", lower)
+	case upper != "" && !upperOK:
+		v.errorf(path, "value must be %s", upper)
+	}
+}
+
+// Returns true if the lower bound rule is above the upper bound rule
+func boundsExclusive(r *ruleSet) bool {
+	number := func(rule interface{}) *big.Float {
+		if n := toNumber(rule); n != nil {
+			return n
+		}
+		return durationNanos(rule)
+	}
+	var lower, upper *big.Float
+	for _, name := range []string{"gt", "gte"} {
+		if r.has(name) {
+			lower = number(r.get(name))
+		}
+	}
+	for _, name := range []string{"lt", "lte"} {
+		if r.has(name) {
+			upper = number(r.get(name))
+		}
+	}
+	return lower.Cmp(upper) > 0
+}
+
+func (v *validator) timestampRules(path string, r *ruleSet, val interface{}) {
+	display := func(rule interface{}) string {
+		return time.Unix(0, nanos(rule)).UTC().Format(time.RFC3339Nano)
+	}
+	v.numericRules(path, r, durationNanos(val), display)
+
+	current := now()
+	timestamp := time.Unix(0, nanos(val))
+	if r.bool("lt_now") && !timestamp.Before(current) {
+		v.errorf(path, "value must be in the past")
+	}
+	if r.bool("gt_now") && !timestamp.After(current) {
+		v.errorf(path, "value must be in the future")
+	}
+	if r.has("within") {
+		within := time.Duration(nanos(r.get("within")))
+		difference := timestamp.Sub(current)
+		if difference < -within || difference > within {
+			v.errorf(path, "value must be within %s of the current time", within)
+		}
+	}
+}
+
+func (v *validator) anyRules(path string, r *ruleSet, val interface{}) {
+	anyMessage, ok := val.(proto.Message)
+	if !ok {
+		v.errorf(path, "any rules can't be applied to a %s", typeName(val))
+		return
+	}
+	msg, err := dynamic.AsDynamicMessage(anyMessage)
+	if err != nil {
+		v.errorf(path, "can't validate any: %s", err)
+		return
+	}
+	typeURL := msg.GetFieldByName("type_url")
+	v.inRules(path, r, typeURL, func(a, b interface{}) bool { return a == b })
+}
+
+func (v *validator) inRules(path string, r *ruleSet, val interface{}, equal func(a, b interface{}) bool) {
+	found := func(list interface{}) bool {
+		items, _ := list.([]interface{})
+		for _, item := range items {
+			if equal(val, item) {
+				return true
+			}
+		}
+		return false
+	}
+	if r.has("in") && !found(r.get("in")) {
+		v.errorf(path, "value must be in %v", formatList(r.get("in")))
+	}
+	if r.has("not_in") && found(r.get("not_in")) {
+		v.errorf(path, "value must not be in %v", formatList(r.get("not_in")))
+	}
+}
+
+func (v *validator) repeatedRules(path string, r *ruleSet, items []interface{}) {
+	if r.bool("ignore_empty") && len(items) == 0 {
+		return
+	}
+	count := uint64(len(items))
+	if r.has("min_items") && count < r.uint("min_items") {
+		v.errorf(path, "value must contain at least %d items", r.uint("min_items"))
+	}
+	if r.has("max_items") && count > r.uint("max_items") {
+		v.errorf(path, "value must contain at most %d items", r.uint("max_items"))
+	}
+	if r.bool("unique") {
+		seen := make(map[string]int)
+		for i, item := range items {
+			key := fmt.Sprintf("%v", item)
+			if first, ok := seen[key]; ok {
+				v.errorf(fmt.Sprintf("%s[%d]", path, i), "value must be unique, repeats item %d", first)
+				continue
+			}
+			seen[key] = i
+		}
+	}
+}
+
+func (v *validator) mapRules(path string, fd *desc.FieldDescriptor, r *ruleSet, entries map[interface{}]interface{}) {
+	if r.bool("ignore_empty") && len(entries) == 0 {
+		return
+	}
+	count := uint64(len(entries))
+	if r.has("min_pairs") && count < r.uint("min_pairs") {
+		v.errorf(path, "value must contain at least %d pairs", r.uint("min_pairs"))
+	}
+	if r.has("max_pairs") && count > r.uint("max_pairs") {
+		v.errorf(path, "value must contain at most %d pairs", r.uint("max_pairs"))
+	}
+	keyRules, valueRules := r.nested("keys"), r.nested("values")
+	for _, key := range sortedKeys(entries) {
+		entryPath := fmt.Sprintf("%s[%q]", path, fmt.Sprint(key))
+		v.value(entryPath, fd.GetMapKeyType(), keyRules, key)
+		v.value(entryPath, fd.GetMapValueType(), valueRules, entries[key])
+	}
+}
+
+func sortedKeys(entries map[interface{}]interface{}) []interface{} {
+	keys := make([]interface{}, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	// Keys are all the same type, so sorting by their string representation is stable
+	sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+	return keys
+}
+
+func oneOfSet(message *dynamic.Message, oneOf *desc.OneOfDescriptor) bool {
+	for _, choice := range oneOf.GetChoices() {
+		if message.HasField(choice) {
+			return true
+		}
+	}
+	return false
+}
+
+func oneOfRequired(oneOf *desc.OneOfDescriptor) (bool, error) {
+	val, err := option(oneOf.GetOneOfOptions(), oneOf.GetFile(), pgvOneOfRequired)
+	if err != nil {
+		return false, err
+	}
+	if required, ok := val.(bool); ok && required {
+		return true, nil
+	}
+	val, err = option(oneOf.GetOneOfOptions(), oneOf.GetFile(), protovalidateOneOfRules)
+	if err != nil {
+		return false, err
+	}
+	return ruleMessage(val).bool("required"), nil
+}
+
+// Returns the validation rules for a field, or nil if it has none
+func fieldRules(fd *desc.FieldDescriptor) (*ruleSet, error) {
+	for _, name := range []string{pgvFieldRules, protovalidateFieldRules} {
+		val, err := option(fd.GetFieldOptions(), fd.GetFile(), name)
+		if err != nil {
+			return nil, err
+		}
+		if rules := ruleMessage(val); rules != nil {
+			return rules, nil
+		}
+	}
+	return nil, nil
+}
+
+// Reads a custom option off of a descriptor's options. Custom options are extensions that
+// aren't known to the Go protobuf registry, so they're parsed using the extension descriptors
+// found in the file and its dependencies. Returns nil if the option isn't set.
+func option(options proto.Message, file *desc.FileDescriptor, name string) (interface{}, error) {
+	if options == nil || reflect.ValueOf(options).IsNil() {
+		return nil, nil
+	}
+	optionsDescriptor, err := desc.LoadMessageDescriptorForMessage(options)
+	if err != nil {
+		return nil, err
+	}
+	registry := dynamic.NewExtensionRegistryWithDefaults()
+	registry.AddExtensionsFromFileRecursively(file)
+	extension := registry.FindExtensionByName(optionsDescriptor.GetFullyQualifiedName(), name)
+	if extension == nil {
+		return nil, nil
+	}
+
+	raw, err := proto.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	parsed := dynamic.NewMessageFactoryWithExtensionRegistry(registry).NewDynamicMessage(optionsDescriptor)
+	if err := parsed.Unmarshal(raw); err != nil {
+		return nil, err
+	}
+	if !parsed.HasField(extension) {
+		return nil, nil
+	}
+	return parsed.TryGetField(extension)
+}
+
+// ruleSet wraps a rules message, such as validate.StringRules, so rules can be looked up by name.
+// A nil ruleSet has no rules set.
+type ruleSet struct {
+	msg *dynamic.Message
+}
+
+func ruleMessage(val interface{}) *ruleSet {
+	msg, ok := val.(proto.Message)
+	if !ok {
+		return nil
+	}
+	dm, err := dynamic.AsDynamicMessage(msg)
+	if err != nil {
+		return nil
+	}
+	return &ruleSet{msg: dm}
+}
+
+func (r *ruleSet) field(name string) *desc.FieldDescriptor {
+	if r == nil {
+		return nil
+	}
+	return r.msg.GetMessageDescriptor().FindFieldByName(name)
+}
+
+func (r *ruleSet) has(name string) bool {
+	fd := r.field(name)
+	if fd == nil || !r.msg.HasField(fd) {
+		return false
+	}
+	if fd.IsRepeated() {
+		items, _ := r.msg.GetField(fd).([]interface{})
+		return len(items) > 0
+	}
+	return true
+}
+
+func (r *ruleSet) get(name string) interface{} {
+	return r.msg.GetField(r.field(name))
+}
+
+func (r *ruleSet) bool(name string) bool {
+	if !r.has(name) {
+		return false
+	}
+	val, ok := r.get(name).(bool)
+	return ok && val
+}
+
+func (r *ruleSet) uint(name string) uint64 {
+	val, _ := toNumber(r.get(name)).Uint64()
+	return val
+}
+
+func (r *ruleSet) nested(name string) *ruleSet {
+	if !r.has(name) {
+		return nil
+	}
+	return ruleMessage(r.get(name))
+}
+
+// Converts any numeric value into a big.Float so values of different types can be compared
+// exactly. Returns nil if the value isn't a number.
+func toNumber(val interface{}) *big.Float {
+	f := new(big.Float).SetPrec(128)
+	switch n := val.(type) {
+	case int32:
+		return f.SetInt64(int64(n))
+	case int64:
+		return f.SetInt64(n)
+	case uint32:
+		return f.SetUint64(uint64(n))
+	case uint64:
+		return f.SetUint64(n)
+	case float32:
+		return f.SetFloat64(float64(n))
+	case float64:
+		return f.SetFloat64(n)
+	}
+	return nil
+}
+
+// Returns the value field of the well known wrapper types, such as google.protobuf.StringValue,
+// or the value itself if it isn't a wrapper.
+func unwrap(val interface{}) interface{} {
+	msg, ok := val.(proto.Message)
+	if !ok {
+		return val
+	}
+	dm, err := dynamic.AsDynamicMessage(msg)
+	if err != nil {
+		return val
+	}
+	name := dm.GetMessageDescriptor().GetFullyQualifiedName()
+	if !wrapperTypes[name] {
+		return val
+	}
+	return dm.GetFieldByName("value")
+}
+
+// Describes the type of a value in problems
+func typeName(val interface{}) string {
+	if msg, ok := val.(proto.Message); ok {
+		if dm, err := dynamic.AsDynamicMessage(msg); err == nil {
+			return dm.GetMessageDescriptor().GetFullyQualifiedName()
+		}
+	}
+	return fmt.Sprintf("%T", val)
+}
+
+// Converts a google.protobuf.Duration or Timestamp into nanoseconds. Returns nil if the
+// value isn't a message.
+func durationNanos(val interface{}) *big.Float {
+	if _, ok := val.(proto.Message); !ok {
+		return nil
+	}
+	return new(big.Float).SetPrec(128).SetInt64(nanos(val))
+}
+
+func nanos(val interface{}) int64 {
+	msg, ok := val.(proto.Message)
+	if !ok {
+		return 0
+	}
+	dm, err := dynamic.AsDynamicMessage(msg)
+	if err != nil {
+		return 0
+	}
+	seconds, _ := dm.TryGetFieldByName("seconds")
+	nanos, _ := dm.TryGetFieldByName("nanos")
+	secondsVal, _ := seconds.(int64)
+	nanosVal, _ := nanos.(int32)
+	return secondsVal*int64(time.Second) + int64(nanosVal)
+}
+
+func contains(list interface{}, val interface{}) bool {
+	items, _ := list.([]interface{})
+	for _, item := range items {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+func enumName(fd *desc.FieldDescriptor, number int32) string {
+	if enumValue := fd.GetEnumType().FindValueByNumber(number); enumValue != nil {
+		return enumValue.GetName()
+	}
+	return fmt.Sprint(number)
+}
+
+func enumNames(fd *desc.FieldDescriptor, list interface{}) string {
+	items, _ := list.([]interface{})
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = enumName(fd, item.(int32))
+	}
+	return strings.Join(names, ", ")
+}
+
+func formatList(list interface{}) string {
+	items, _ := list.([]interface{})
+	formatted := make([]string, len(items))
+	for i, item := range items {
+		if b, ok := item.([]byte); ok {
+			item = string(b)
+		}
+		formatted[i] = fmt.Sprintf("%q", fmt.Sprint(item))
+		if toNumber(item) != nil {
+			formatted[i] = fmt.Sprint(item)
+		}
+	}
+	return "[" + strings.Join(formatted, ", ") + "]"
+}
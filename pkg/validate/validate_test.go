@@ -0,0 +1,188 @@
+package validate
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/wearefair/gurl/pkg/protobuf"
+)
+
+const validSignup = `{
+	"username": "alice_1",
+	"email": "alice@example.com",
+	"age": 30,
+	"seats": "5",
+	"discount": 2,
+	"acceptedTerms": true,
+	"avatar": "cmF3",
+	"plan": "PAID",
+	"profile": { "displayName": "alice" },
+	"uncheckedProfile": { "displayName": "much too long to pass" },
+	"tags": ["a", "b"],
+	"quotas": { "q_cpu": 1 },
+	"trial": "86400s",
+	"startsAt": "2018-02-01T00:00:00Z",
+	"phone": "555-1234",
+	"nickname": "ally"
+}`
+
+func TestMessage(t *testing.T) {
+	now = func() time.Time {
+		return time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	defer func() { now = time.Now }()
+	messageDescriptor := signupDescriptor(t)
+
+	testCases := []struct {
+		// Fields cleared from the valid signup, such as another field of a oneof that's set
+		Clear []string
+		// Fields set on top of the valid signup
+		Fields   []string
+		Expected []protobuf.Problem
+	}{
+		// The valid signup has no violations
+		{},
+		{
+			Fields: []string{"username=Al", "email=Alice <alice@example.com>", "referrer=not-a-uuid", "age=12", "seats=2"},
+			Expected: []protobuf.Problem{
+				{Path: "$.username", Message: "value length must be at least 3 characters"},
+				{Path: "$.username", Message: `value must match pattern "^[a-z0-9_]+$"`},
+				{Path: "$.email", Message: "value must be a valid email address"},
+				{Path: "$.referrer", Message: "value must be a valid UUID"},
+				{Path: "$.age", Message: "value must be greater than or equal to 13 and less than 130"},
+				{Path: "$.seats", Message: "value must be in [1, 5, 10]"},
+			},
+		},
+		{
+			Fields: []string{"discount=0.5", "accepted_terms=false", "avatar=dG9vbG9uZw", "plan=PLAN_UNSPECIFIED"},
+			Expected: []protobuf.Problem{
+				{Path: "$.discount", Message: "value must be less than 0 or greater than 1"},
+				{Path: "$.acceptedTerms", Message: "value must equal true"},
+				{Path: "$.avatar", Message: "value length must be at most 4 bytes"},
+				{Path: "$.plan", Message: "value must not be in [PLAN_UNSPECIFIED], got PLAN_UNSPECIFIED"},
+			},
+		},
+		{
+			Fields: []string{"profile.display_name=much too long", "tags+=a", "tags+=", "quotas[cpu]=0", "quotas[q_mem]=1"},
+			Expected: []protobuf.Problem{
+				{Path: "$.profile.displayName", Message: "value length must be at most 8 characters"},
+				{Path: "$.tags", Message: "value must contain at most 3 items"},
+				{Path: "$.tags[2]", Message: "value must be unique, repeats item 0"},
+				{Path: "$.tags[3]", Message: "value length must be at least 1 characters"},
+				{Path: "$.quotas", Message: "value must contain at most 2 pairs"},
+				{Path: `$.quotas["cpu"]`, Message: `value must start with "q_"`},
+				{Path: `$.quotas["cpu"]`, Message: "value must be greater than 0"},
+			},
+		},
+		{
+			Clear:  []string{"phone"},
+			Fields: []string{`trial="2592001s"`, `starts_at="2017-12-31T00:00:00Z"`, "website=/relative"},
+			Expected: []protobuf.Problem{
+				{Path: "$.trial", Message: "value must be less than or equal to 720h0m0s"},
+				{Path: "$.startsAt", Message: "value must be in the future"},
+				{Path: "$.website", Message: "value must be an absolute URI"},
+			},
+		},
+		// Rules on wrapper types apply to the wrapped value
+		{
+			Fields:   []string{`nickname="a"`},
+			Expected: []protobuf.Problem{{Path: "$.nickname", Message: "value length must be at least 2 characters"}},
+		},
+	}
+
+	for _, testCase := range testCases {
+		message := dynamic.NewMessage(messageDescriptor)
+		if err := message.UnmarshalJSON([]byte(validSignup)); err != nil {
+			t.Fatalf("Error unmarshalling signup: %s", err.Error())
+		}
+		for _, field := range testCase.Clear {
+			message.ClearFieldByName(field)
+		}
+		for _, field := range testCase.Fields {
+			if err := protobuf.SetField(message, field); err != nil {
+				t.Fatalf("Error setting %s: %s", field, err.Error())
+			}
+		}
+
+		err := Message(message)
+		if testCase.Expected == nil {
+			if err != nil {
+				t.Errorf("Fields: %v, expected no violations, got: %s", testCase.Fields, err)
+			}
+			continue
+		}
+		validationErr, ok := err.(*protobuf.ValidationError)
+		if !ok {
+			t.Errorf("Fields: %v, expected a ValidationError, got: %v", testCase.Fields, err)
+			continue
+		}
+		if !reflect.DeepEqual(validationErr.Problems, testCase.Expected) {
+			t.Errorf("Fields: %v\nexpected: %v\ngot: %v", testCase.Fields, testCase.Expected, validationErr.Problems)
+		}
+	}
+}
+
+func TestMessageRequired(t *testing.T) {
+	message := dynamic.NewMessage(signupDescriptor(t))
+	err := Message(message)
+	validationErr, ok := err.(*protobuf.ValidationError)
+	if !ok {
+		t.Fatalf("Expected a ValidationError, got: %v", err)
+	}
+
+	expected := map[string]string{
+		"$.contact": "exactly one field of oneof contact is required",
+		"$.profile": "value is required",
+		"$.trial":   "value is required",
+	}
+	found := make(map[string]bool)
+	for _, problem := range validationErr.Problems {
+		if message, ok := expected[problem.Path]; ok && problem.Message == message {
+			found[problem.Path] = true
+		}
+	}
+	for path, message := range expected {
+		if !found[path] {
+			t.Errorf("Expected %s: %s, got: %v", path, message, validationErr.Problems)
+		}
+	}
+}
+
+func TestMessageWithoutRules(t *testing.T) {
+	descriptors, err := protobuf.Collect([]string{}, []string{testdataPath(t)})
+	if err != nil {
+		t.Fatalf("Error collecting test descriptors: %s", err.Error())
+	}
+	messageDescriptor, err := protobuf.NewCollector(descriptors).GetMessage("gurltest.Person")
+	if err != nil {
+		t.Fatalf("Error getting message descriptor: %s", err.Error())
+	}
+	if err := Message(dynamic.NewMessage(messageDescriptor)); err != nil {
+		t.Errorf("Expected no violations for a message without rules, got: %s", err)
+	}
+}
+
+// Helper to get the gurltest.Signup descriptor from the protobuf package's testdata folder
+func signupDescriptor(t *testing.T) *desc.MessageDescriptor {
+	descriptors, err := protobuf.Collect([]string{}, []string{testdataPath(t)})
+	if err != nil {
+		t.Fatalf("Error collecting test descriptors: %s", err.Error())
+	}
+	messageDescriptor, err := protobuf.NewCollector(descriptors).GetMessage("gurltest.Signup")
+	if err != nil {
+		t.Fatalf("Error getting message descriptor: %s", err.Error())
+	}
+	return messageDescriptor
+}
+
+func testdataPath(t *testing.T) string {
+	path, err := filepath.Abs("../protobuf/testdata")
+	if err != nil {
+		t.Fatalf("Error getting testdata path: %s", err.Error())
+	}
+	return path
+}